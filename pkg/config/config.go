@@ -1,8 +1,11 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
 	"reflect"
 	"strconv"
@@ -10,12 +13,40 @@ import (
 	"time"
 
 	"github.com/nothinux/octo-proxy/pkg/errors"
+	"github.com/rs/zerolog/log"
 
 	"gopkg.in/yaml.v2"
 )
 
 type hostConfigType int
 
+const (
+	LoadBalancerRoundRobin       = "roundRobin"
+	LoadBalancerLeastConnections = "leastConnections"
+	LoadBalancerRandomTwoChoices = "randomTwoChoices"
+	LoadBalancerWeighted         = "weighted"
+)
+
+const (
+	MirrorModeCompare = "compare"
+)
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckTLS  = "tls"
+	HealthCheckHTTP = "http"
+)
+
 const (
 	slistener hostConfigType = iota
 	starget
@@ -29,40 +60,197 @@ type Config struct {
 }
 
 type ServerConfig struct {
-	Name     string       `yaml:"name"`
-	Listener HostConfig   `yaml:"listener"`
-	Targets  []HostConfig `yaml:"targets"`
-	Mirror   HostConfig   `yaml:"mirror"`
+	Name             string                 `yaml:"name"`
+	Protocol         string                 `yaml:"protocol"`
+	Listener         HostConfig             `yaml:"listener"`
+	Targets          []HostConfig           `yaml:"targets"`
+	Mirror           HostConfig             `yaml:"mirror"`
+	Mirrors          []MirrorConfig         `yaml:"mirrors"`
+	LoadBalancer     string                 `yaml:"loadBalancer"`
+	OutlierDetection OutlierDetectionConfig `yaml:"outlierDetection"`
+	Routes           []RouteConfig          `yaml:"routes"`
+	DrainTimeout     string                 `yaml:"drainTimeout"`
+	DrainDuration    time.Duration
+}
+
+// RouteConfig hold targets that handle connections with matching tls server name
+type RouteConfig struct {
+	SNI     []string     `yaml:"sni"`
+	Targets []HostConfig `yaml:"targets"`
 }
 
 type HostConfig struct {
-	Host             string `yaml:"host"`
-	Port             string `yaml:"port"`
+	Host             string       `yaml:"host"`
+	Port             string       `yaml:"port"`
+	Unix             string       `yaml:"unix"`
+	Socket           SocketConfig `yaml:"socket"`
+	SocketActivation bool         `yaml:"socketActivation"`
+	Weight           int          `yaml:"weight"`
 	ConnectionConfig `yaml:"connection"`
 	TLSConfig        `yaml:"tls"`
+	HealthCheck      HealthCheckConfig   `yaml:"healthCheck"`
+	ProxyProtocol    ProxyProtocolConfig `yaml:"proxyProtocol"`
+}
+
+// SocketConfig hold file mode and ownership of unix socket listener
+type SocketConfig struct {
+	Mode     string `yaml:"mode"`
+	User     string `yaml:"user"`
+	Group    string `yaml:"group"`
+	FileMode os.FileMode
+}
+
+type MirrorConfig struct {
+	HostConfig   `yaml:",inline"`
+	Percentage   int    `yaml:"percentage"`
+	MaxBytes     int64  `yaml:"maxBytes"`
+	Mode         string `yaml:"mode"`
+	CompareBytes int    `yaml:"compareBytes"`
+}
+
+// IsCompare returns true when mirror response is compared with target response
+func (m MirrorConfig) IsCompare() bool {
+	return m.Mode == MirrorModeCompare
 }
 
 type ConnectionConfig struct {
-	ConnectTimeout         int    `yaml:"connectTimeout"` // TODO: Implement connect timeout
+	ConnectTimeout         string `yaml:"connectTimeout"`
 	Timeout                string `yaml:"timeout"`
-	IdleTimeout            int    `yaml:"idleTimeout"` // TODO: Implement idle timeout
+	IdleTimeout            string `yaml:"idleTimeout"`
 	ConnectTimeoutDuration time.Duration
 	TimeoutDuration        time.Duration
 	IdleTimeoutDuration    time.Duration
 }
 
+type HealthCheckConfig struct {
+	Type               string                `yaml:"type"`
+	Interval           string                `yaml:"interval"`
+	Timeout            string                `yaml:"timeout"`
+	HealthyThreshold   int                   `yaml:"healthyThreshold"`
+	UnhealthyThreshold int                   `yaml:"unhealthyThreshold"`
+	HTTP               HTTPHealthCheckConfig `yaml:"http"`
+	Send               string                `yaml:"send"`
+	Expect             string                `yaml:"expect"`
+	IntervalDuration   time.Duration
+	TimeoutDuration    time.Duration
+}
+
+type HTTPHealthCheckConfig struct {
+	Method         string `yaml:"method"`
+	Path           string `yaml:"path"`
+	Host           string `yaml:"host"`
+	ExpectedStatus []int  `yaml:"expectedStatus"`
+}
+
+// ProxyProtocolConfig hold PROXY protocol configuration. In listener it
+// configures how the header is read, in target and mirror only version is
+// used and it can be set as a scalar, e.g. `proxyProtocol: v2`
+type ProxyProtocolConfig struct {
+	Enabled         bool     `yaml:"enabled"`
+	TrustedCIDRs    []string `yaml:"trustedCIDRs"`
+	Timeout         string   `yaml:"timeout"`
+	Version         string   `yaml:"version"`
+	TimeoutDuration time.Duration
+	TrustedNetworks []*net.IPNet
+}
+
+func (p *ProxyProtocolConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var version string
+	if err := unmarshal(&version); err == nil {
+		p.Version = version
+		return nil
+	}
+
+	type plain ProxyProtocolConfig
+	return unmarshal((*plain)(p))
+}
+
+type OutlierDetectionConfig struct {
+	ConsecutiveFailures      int    `yaml:"consecutiveFailures"`
+	BaseEjectionTime         string `yaml:"baseEjectionTime"`
+	MaxEjectionTime          string `yaml:"maxEjectionTime"`
+	MaxEjectionPercent       int    `yaml:"maxEjectionPercent"`
+	BaseEjectionTimeDuration time.Duration
+	MaxEjectionTimeDuration  time.Duration
+}
+
 type TLSConfig struct {
-	CaCert          string   `yaml:"caCert"`
-	Cert            string   `yaml:"cert"`
-	Key             string   `yaml:"key"`
-	SNI             string   `yaml:"sni"`
-	CRL             string   `yaml:"crl"`
-	Mode            string   `yaml:"mode"`
-	SubjectAltNames []string `yaml:"subjectAltNames"`
+	CaCert          string              `yaml:"caCert"`
+	Cert            string              `yaml:"cert"`
+	Key             string              `yaml:"key"`
+	Certificates    []CertificateConfig `yaml:"certificates"`
+	SNI             string              `yaml:"sni"`
+	CRL             string              `yaml:"crl"`
+	CRLRefresh      string              `yaml:"crlRefreshInterval"`
+	Mode            string              `yaml:"mode"`
+	SubjectAltNames []string            `yaml:"subjectAltNames"`
+	MinVersion      string              `yaml:"minVersion"`
+	MaxVersion      string              `yaml:"maxVersion"`
+	CipherSuites    []string            `yaml:"cipherSuites"`
+	Curves          []string            `yaml:"curves"`
+	ALPN            []string            `yaml:"alpn"`
+	OCSP            OCSPConfig          `yaml:"ocsp"`
+	SessionTicket   SessionTicketConfig `yaml:"sessionTicket"`
 	SubjectAltName
+	TLSOptions
 	Role
 }
 
+const (
+	OCSPPolicySoft = "soft"
+	OCSPPolicyHard = "hard"
+)
+
+// OCSPConfig configure OCSP checking of peer certificate and OCSP stapling
+// of listener certificate
+type OCSPConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	Stapling        bool   `yaml:"stapling"`
+	Policy          string `yaml:"policy"`
+	Responder       string `yaml:"responder"`
+	Timeout         string `yaml:"timeout"`
+	TimeoutDuration time.Duration
+}
+
+// SessionTicketConfig configure tls session resumption. Listener with
+// keyFiles derive the ticket keys from the files, so every octo-proxy process
+// using the same files can resume sessions of each other
+type SessionTicketConfig struct {
+	Disabled                 bool     `yaml:"disabled"`
+	KeyFiles                 []string `yaml:"keyFiles"`
+	RotationInterval         string   `yaml:"rotationInterval"`
+	RotationIntervalDuration time.Duration
+}
+
+// IsHardFail returns true when peer certificate must be rejected if its
+// OCSP status can't be checked
+func (o OCSPConfig) IsHardFail() bool {
+	return o.Policy == OCSPPolicyHard
+}
+
+// IsCRLURL returns true when crl is loaded from http distribution point
+func (t TLSConfig) IsCRLURL() bool {
+	return strings.HasPrefix(t.CRL, "http://") || strings.HasPrefix(t.CRL, "https://")
+}
+
+// TLSOptions hold tls versions, cipher suites, curves and crl refresh
+// interval parsed from TLSConfig
+type TLSOptions struct {
+	MinVersionID       uint16
+	MaxVersionID       uint16
+	CipherSuiteIDs     []uint16
+	CurveIDs           []tls.CurveID
+	CRLRefreshDuration time.Duration
+}
+
+// CertificateConfig is certificate used by the listener when the tls server
+// name sent by the client match one of the sni
+type CertificateConfig struct {
+	SNI  []string `yaml:"sni"`
+	Cert string   `yaml:"cert"`
+	Key  string   `yaml:"key"`
+}
+
 type SubjectAltName struct {
 	IPAddress []string
 	Uri       []string
@@ -81,6 +269,70 @@ func (t TLSConfig) IsSimple() bool {
 	return t.Mode == "simple"
 }
 
+// IsPassthrough returns true when tls is not terminated by the listener
+func (t TLSConfig) IsPassthrough() bool {
+	return t.Mode == "passthrough"
+}
+
+// IsUnix returns true when host is unix domain socket
+func (h HostConfig) IsUnix() bool {
+	return h.Unix != ""
+}
+
+// IsAbstract returns true when host is unix domain socket in abstract namespace
+func (h HostConfig) IsAbstract() bool {
+	return strings.HasPrefix(h.Unix, "@")
+}
+
+// Network returns network name used to listen or dial the host
+func (h HostConfig) Network() string {
+	if h.IsUnix() {
+		return "unix"
+	}
+
+	return "tcp"
+}
+
+// Address returns address used to listen or dial the host
+func (h HostConfig) Address() string {
+	if h.IsUnix() {
+		return h.Unix
+	}
+
+	return net.JoinHostPort(h.Host, h.Port)
+}
+
+// IsUDP returns true when server is proxying udp datagrams
+func (s ServerConfig) IsUDP() bool {
+	return s.Protocol == ProtocolUDP
+}
+
+// IsEnabled returns true when health check is configured
+func (h HealthCheckConfig) IsEnabled() bool {
+	return !reflect.DeepEqual(HealthCheckConfig{}, h)
+}
+
+// IsTrusted returns true when PROXY protocol header from ip can be trusted,
+// all sources are trusted when trusted CIDRs is not configured
+func (p ProxyProtocolConfig) IsTrusted(ip net.IP) bool {
+	if len(p.TrustedNetworks) == 0 {
+		return true
+	}
+
+	for _, n := range p.TrustedNetworks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsEnabled returns true when outlier detection is configured
+func (o OutlierDetectionConfig) IsEnabled() bool {
+	return !reflect.DeepEqual(OutlierDetectionConfig{}, o)
+}
+
 func (h hostConfigType) String() string {
 	return [...]string{"listener", "target", "mirror", "metrics"}[h]
 }
@@ -164,6 +416,16 @@ func GenerateConfig(listener string, targets []string, metrics string) (*Config,
 	return validateConfig(c)
 }
 
+// defaultServerName returns name of the server that doesn't specify name, the
+// name is the listener address prefixed by the protocol for udp servers
+func defaultServerName(c ServerConfig) string {
+	if c.IsUDP() {
+		return ProtocolUDP + "://" + c.Listener.Address()
+	}
+
+	return c.Listener.Address()
+}
+
 func validateConfig(c *Config) (*Config, error) {
 	if c == nil {
 		return nil, errors.New("config", "error no configuration found")
@@ -173,6 +435,8 @@ func validateConfig(c *Config) (*Config, error) {
 		return nil, errors.New("servers", "error no server configuration found")
 	}
 
+	names := make(map[string]int)
+
 	for i := range c.ServerConfigs {
 		listener := &c.ServerConfigs[i].Listener
 		mirror := &c.ServerConfigs[i].Mirror
@@ -181,20 +445,75 @@ func validateConfig(c *Config) (*Config, error) {
 			return nil, err
 		}
 
-		if len(c.ServerConfigs[i].Targets) == 0 {
+		// targets is the default route when routes is configured
+		if len(c.ServerConfigs[i].Targets) == 0 && len(c.ServerConfigs[i].Routes) == 0 {
 			return nil, errors.New("server", fmt.Sprintf("no target configurations in servers.[%d]", i))
 		}
 
+		if !protocolIsValid(c.ServerConfigs[i].Protocol) {
+			return nil, errors.New("server", fmt.Sprintf("not supported protocol in servers.[%d]", i))
+		}
+
+		// servers are matched by name on reload, server without name is
+		// named after its listener so the name is kept when other servers
+		// are changed
+		if c.ServerConfigs[i].Name == "" {
+			// socket passed by systemd is selected by server name
+			if listener.SocketActivation {
+				return nil, errors.New("server", fmt.Sprintf("name in servers.[%d] must be specified with socketActivation", i))
+			}
+
+			c.ServerConfigs[i].Name = defaultServerName(c.ServerConfigs[i])
+		}
+
+		name := c.ServerConfigs[i].Name
+		if j, ok := names[name]; ok {
+			return nil, errors.New("server", fmt.Sprintf("name %s in servers.[%d] is already used in servers.[%d]", name, i, j))
+		}
+		names[name] = i
+
+		if !loadBalancerIsValid(c.ServerConfigs[i].LoadBalancer) {
+			return nil, errors.New("server", fmt.Sprintf("not supported loadBalancer in servers.[%d]", i))
+		}
+
+		if err := setOutlierDetection(&c.ServerConfigs[i].OutlierDetection); err != nil {
+			return nil, errors.New("server", fmt.Sprintf("%v in servers.[%d].outlierDetection", err, i))
+		}
+
 		for j := range c.ServerConfigs[i].Targets {
-			if err := errorCheck(i, starget, &c.ServerConfigs[i].Targets[j]); err != nil {
+			if err := setTarget(i, fmt.Sprintf("targets[%d]", j), &c.ServerConfigs[i].Targets[j]); err != nil {
 				return nil, err
 			}
+		}
+
+		if len(c.ServerConfigs[i].Routes) > 0 && !listener.TLSConfig.IsPassthrough() {
+			return nil, errors.New("server", fmt.Sprintf("routes in servers.[%d] can only be used with tls passthrough mode", i))
+		}
+
+		for k := range c.ServerConfigs[i].Routes {
+			r := &c.ServerConfigs[i].Routes[k]
 
-			if err := setTimeout(&c.ServerConfigs[i].Targets[j]); err != nil {
-				return nil, errors.New("server", fmt.Sprintf("failed to parse timeout servers.[%d].targets[%d]: %v", i, j, err))
+			if len(r.SNI) == 0 {
+				return nil, errors.New("server", fmt.Sprintf("no sni in servers.[%d].routes[%d]", i, k))
 			}
 
-			setSAN(&c.ServerConfigs[i].Targets[j])
+			for l := range r.SNI {
+				r.SNI[l] = strings.ToLower(r.SNI[l])
+
+				if !sniIsValid(r.SNI[l]) {
+					return nil, errors.New("server", fmt.Sprintf("sni %s in servers.[%d].routes[%d] is not valid", r.SNI[l], i, k))
+				}
+			}
+
+			if len(r.Targets) == 0 {
+				return nil, errors.New("server", fmt.Sprintf("no target configurations in servers.[%d].routes[%d]", i, k))
+			}
+
+			for j := range r.Targets {
+				if err := setTarget(i, fmt.Sprintf("routes[%d].targets[%d]", k, j), &r.Targets[j]); err != nil {
+					return nil, err
+				}
+			}
 		}
 
 		// check config for error only when configuration is not nil
@@ -209,6 +528,60 @@ func validateConfig(c *Config) (*Config, error) {
 
 			setSAN(mirror)
 		}
+
+		for j := range c.ServerConfigs[i].Mirrors {
+			m := &c.ServerConfigs[i].Mirrors[j]
+
+			if err := errorCheck(i, smirror, &m.HostConfig); err != nil {
+				return nil, err
+			}
+
+			if err := setTimeout(&m.HostConfig); err != nil {
+				return nil, errors.New("server", fmt.Sprintf("failed to parse timeout servers.[%d].mirrors[%d]: %v", i, j, err))
+			}
+
+			if m.Percentage < 0 || m.Percentage > 100 {
+				return nil, errors.New("server", fmt.Sprintf("percentage in servers.[%d].mirrors[%d] must be between 0 and 100", i, j))
+			}
+
+			// mirror all connections if percentage is not set
+			if m.Percentage == 0 {
+				m.Percentage = 100
+			}
+
+			if m.MaxBytes < 0 {
+				return nil, errors.New("server", fmt.Sprintf("can't use negative value for maxBytes in servers.[%d].mirrors[%d]", i, j))
+			}
+
+			if m.Mode != "" && !m.IsCompare() {
+				return nil, errors.New("server", fmt.Sprintf("not supported mode in servers.[%d].mirrors[%d]", i, j))
+			}
+
+			if m.CompareBytes < 0 {
+				return nil, errors.New("server", fmt.Sprintf("can't use negative value for compareBytes in servers.[%d].mirrors[%d]", i, j))
+			}
+
+			if m.IsCompare() && m.CompareBytes == 0 {
+				m.CompareBytes = 4096
+			}
+
+			setSAN(&m.HostConfig)
+		}
+
+		if c.ServerConfigs[i].DrainTimeout != "" {
+			d, err := parseDuration("drainTimeout", c.ServerConfigs[i].DrainTimeout)
+			if err != nil {
+				return nil, errors.New("server", fmt.Sprintf("failed to parse drainTimeout servers.[%d]: %v", i, err))
+			}
+			c.ServerConfigs[i].DrainDuration = d
+		}
+
+		if c.ServerConfigs[i].IsUDP() {
+			if err := checkUDP(c.ServerConfigs[i]); err != nil {
+				return nil, errors.New("server", fmt.Sprintf("%v in servers.[%d]", err, i))
+			}
+		}
+
 		// set all listener role to server
 		if !reflect.DeepEqual(TLSConfig{}, c.ServerConfigs[i].Listener.TLSConfig) {
 			listener.TLSConfig.Role.Server = true
@@ -218,6 +591,10 @@ func validateConfig(c *Config) (*Config, error) {
 			return nil, errors.New("server", fmt.Sprintf("failed to parse timeout servers.[%d]: %v", i, err))
 		}
 
+		if err := setProxyProtocol(&listener.ProxyProtocol); err != nil {
+			return nil, errors.New("server", fmt.Sprintf("%v in servers.[%d].listener.proxyProtocol", err, i))
+		}
+
 		setSAN(listener)
 	}
 
@@ -237,52 +614,357 @@ func validateConfig(c *Config) (*Config, error) {
 	return c, nil
 }
 
+// setTarget validate target configuration and set its default value, path
+// is location of the target in server configuration
+func setTarget(i int, path string, c *HostConfig) error {
+	if err := errorCheck(i, starget, c); err != nil {
+		return err
+	}
+
+	if c.Weight < 0 {
+		return errors.New("server", fmt.Sprintf("can't use negative value for weight in servers.[%d].%s", i, path))
+	}
+
+	if err := setTimeout(c); err != nil {
+		return errors.New("server", fmt.Sprintf("failed to parse timeout servers.[%d].%s: %v", i, path, err))
+	}
+
+	if err := setHealthCheck(c); err != nil {
+		return errors.New("server", fmt.Sprintf("%v in servers.[%d].%s.healthCheck", err, i, path))
+	}
+
+	setSAN(c)
+
+	return nil
+}
+
 type timeoutFormat struct {
 	unit     string
 	duration time.Duration
 }
 
 func setTimeout(c *HostConfig) error {
-	var format []timeoutFormat
-	format = append(format, timeoutFormat{"ms", time.Millisecond})
-	format = append(format, timeoutFormat{"s", time.Second})
+	var err error
+
+	if c.ConnectionConfig.ConnectTimeout != "" {
+		c.ConnectionConfig.ConnectTimeoutDuration, err = parseDuration("connectTimeout", c.ConnectionConfig.ConnectTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ConnectionConfig.IdleTimeout != "" {
+		c.ConnectionConfig.IdleTimeoutDuration, err = parseDuration("idleTimeout", c.ConnectionConfig.IdleTimeout)
+		if err != nil {
+			return err
+		}
+	}
 
 	timeout := c.ConnectionConfig.Timeout
 
+	// connection with idle timeout is kept open as long as it's active, so
+	// the default deadline is only used when idle timeout is not set
 	if timeout == "" {
-		c.ConnectionConfig.TimeoutDuration = time.Duration(300) * time.Second
+		if c.ConnectionConfig.IdleTimeoutDuration == 0 {
+			c.ConnectionConfig.TimeoutDuration = time.Duration(300) * time.Second
+		}
 		return nil
 	}
 
-	if timeout == "0" {
-		return nil
+	d, err := parseDuration("timeout", timeout)
+	if err != nil {
+		return err
 	}
 
+	c.ConnectionConfig.TimeoutDuration = d
+
+	return nil
+}
+
+// parseDuration parse value in milliseconds with `ms` unit or seconds with `s` unit,
+// seconds is used if unit is not provided
+func parseDuration(name, value string) (time.Duration, error) {
+	var format []timeoutFormat
+	format = append(format, timeoutFormat{"ms", time.Millisecond})
+	format = append(format, timeoutFormat{"s", time.Second})
+
 	for _, v := range format {
-		if strings.HasSuffix(timeout, v.unit) {
-			return setTimeoutDuration(c, strings.TrimSuffix(timeout, v.unit), v.duration)
+		if strings.HasSuffix(value, v.unit) {
+			return parseDurationUnit(name, strings.TrimSuffix(value, v.unit), v.duration)
 		}
 	}
 
-	// use seconds if user not provide unit
-	return setTimeoutDuration(c, timeout, time.Second)
+	return parseDurationUnit(name, value, time.Second)
 }
 
-func setTimeoutDuration(c *HostConfig, timeout string, td time.Duration) error {
-	t, err := strconv.Atoi(timeout)
+func parseDurationUnit(name, value string, td time.Duration) (time.Duration, error) {
+	t, err := strconv.Atoi(value)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if t < 0 {
-		return fmt.Errorf("can't use negative value for timeout")
+		return 0, fmt.Errorf("can't use negative value for %s", name)
+	}
+
+	return time.Duration(t) * td, nil
+}
+
+// setHealthCheck validate health check configuration and set its default value
+func setHealthCheck(c *HostConfig) error {
+	hc := &c.HealthCheck
+
+	if !hc.IsEnabled() {
+		return nil
+	}
+
+	switch hc.Type {
+	case "":
+		hc.Type = HealthCheckTCP
+	case HealthCheckTCP:
+	case HealthCheckTLS:
+		if !c.TLSConfig.IsSimple() && !c.TLSConfig.IsMutual() {
+			return fmt.Errorf("tls health check requires tls mode")
+		}
+	case HealthCheckHTTP:
+		if hc.Send != "" || hc.Expect != "" {
+			return fmt.Errorf("send and expect can't be used in http health check")
+		}
+
+		setHTTPHealthCheck(&hc.HTTP)
+	default:
+		return fmt.Errorf("not supported type")
+	}
+
+	if hc.Type != HealthCheckHTTP && !reflect.DeepEqual(HTTPHealthCheckConfig{}, hc.HTTP) {
+		return fmt.Errorf("http can only be used in http health check")
+	}
+
+	var err error
+
+	hc.IntervalDuration = 10 * time.Second
+	if hc.Interval != "" {
+		hc.IntervalDuration, err = parseDuration("interval", hc.Interval)
+		if err != nil {
+			return err
+		}
+	}
+
+	hc.TimeoutDuration = 3 * time.Second
+	if hc.Timeout != "" {
+		hc.TimeoutDuration, err = parseDuration("timeout", hc.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if hc.IntervalDuration == 0 || hc.TimeoutDuration == 0 {
+		return fmt.Errorf("interval and timeout must be greater than zero")
+	}
+
+	if hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		return fmt.Errorf("can't use negative value for threshold")
+	}
+
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = 2
+	}
+
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 3
+	}
+
+	return nil
+}
+
+// checkProxyProtocol check that listener only configure how the header is
+// read and target or mirror only configure the version of the header
+func checkProxyProtocol(hct hostConfigType, c ProxyProtocolConfig) error {
+	if reflect.DeepEqual(ProxyProtocolConfig{}, c) {
+		return nil
+	}
+
+	switch hct {
+	case slistener:
+		if c.Version != "" {
+			return fmt.Errorf("version can't be used in listener")
+		}
+	case starget, smirror:
+		if !reflect.DeepEqual(ProxyProtocolConfig{Version: c.Version}, c) {
+			return fmt.Errorf("only version can be used in %s", hct.String())
+		}
+
+		if c.Version != ProxyProtocolV1 && c.Version != ProxyProtocolV2 {
+			return fmt.Errorf("not supported version")
+		}
+	default:
+		return fmt.Errorf("not supported")
+	}
+
+	return nil
+}
+
+// setProxyProtocol validate PROXY protocol configuration and set its default value
+func setProxyProtocol(c *ProxyProtocolConfig) error {
+	if !c.Enabled {
+		if !reflect.DeepEqual(ProxyProtocolConfig{}, *c) {
+			return fmt.Errorf("trustedCIDRs and timeout can only be used when enabled")
+		}
+		return nil
 	}
 
-	c.ConnectionConfig.TimeoutDuration = time.Duration(t) * td
+	for _, cidr := range c.TrustedCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("%s is not valid CIDR", cidr)
+		}
+
+		c.TrustedNetworks = append(c.TrustedNetworks, n)
+	}
+
+	c.TimeoutDuration = 5 * time.Second
+	if c.Timeout != "" {
+		var err error
+
+		c.TimeoutDuration, err = parseDuration("timeout", c.Timeout)
+		if err != nil {
+			return err
+		}
+
+		if c.TimeoutDuration == 0 {
+			return fmt.Errorf("timeout must be greater than zero")
+		}
+	}
 
 	return nil
 }
 
+// setOutlierDetection validate outlier detection configuration and set its default value
+func setOutlierDetection(c *OutlierDetectionConfig) error {
+	if !c.IsEnabled() {
+		return nil
+	}
+
+	if c.ConsecutiveFailures < 0 {
+		return fmt.Errorf("can't use negative value for consecutiveFailures")
+	}
+
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = 5
+	}
+
+	if c.MaxEjectionPercent < 0 || c.MaxEjectionPercent > 100 {
+		return fmt.Errorf("maxEjectionPercent must be between 0 and 100")
+	}
+
+	if c.MaxEjectionPercent == 0 {
+		c.MaxEjectionPercent = 10
+	}
+
+	var err error
+
+	c.BaseEjectionTimeDuration = 30 * time.Second
+	if c.BaseEjectionTime != "" {
+		c.BaseEjectionTimeDuration, err = parseDuration("baseEjectionTime", c.BaseEjectionTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.MaxEjectionTimeDuration = 300 * time.Second
+	if c.MaxEjectionTime != "" {
+		c.MaxEjectionTimeDuration, err = parseDuration("maxEjectionTime", c.MaxEjectionTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.MaxEjectionTimeDuration < c.BaseEjectionTimeDuration {
+		return fmt.Errorf("maxEjectionTime can't be less than baseEjectionTime")
+	}
+
+	return nil
+}
+
+// checkUDP check that server doesn't use features that only work with tcp
+func checkUDP(c ServerConfig) error {
+	if !reflect.DeepEqual(TLSConfig{}, c.Listener.TLSConfig) {
+		return fmt.Errorf("can't use tls in listener with udp protocol")
+	}
+
+	if c.Listener.IsUnix() {
+		return fmt.Errorf("can't use unix in listener with udp protocol")
+	}
+
+	if c.Listener.ProxyProtocol.Enabled {
+		return fmt.Errorf("can't use proxyProtocol in listener with udp protocol")
+	}
+
+	for j, t := range c.Targets {
+		if t.IsUnix() {
+			return fmt.Errorf("can't use unix in targets[%d] with udp protocol", j)
+		}
+
+		if t.ProxyProtocol.Version != "" {
+			return fmt.Errorf("can't use proxyProtocol in targets[%d] with udp protocol", j)
+		}
+
+		if !reflect.DeepEqual(TLSConfig{}, t.TLSConfig) {
+			return fmt.Errorf("can't use tls in targets[%d] with udp protocol", j)
+		}
+
+		if t.HealthCheck.IsEnabled() {
+			return fmt.Errorf("can't use healthCheck in targets[%d] with udp protocol", j)
+		}
+	}
+
+	if !reflect.DeepEqual(TLSConfig{}, c.Mirror.TLSConfig) {
+		return fmt.Errorf("can't use tls in mirror with udp protocol")
+	}
+
+	if c.Mirror.IsUnix() {
+		return fmt.Errorf("can't use unix in mirror with udp protocol")
+	}
+
+	if c.Mirror.ProxyProtocol.Version != "" {
+		return fmt.Errorf("can't use proxyProtocol in mirror with udp protocol")
+	}
+
+	for j, m := range c.Mirrors {
+		if m.IsUnix() {
+			return fmt.Errorf("can't use unix in mirrors[%d] with udp protocol", j)
+		}
+
+		if m.ProxyProtocol.Version != "" {
+			return fmt.Errorf("can't use proxyProtocol in mirrors[%d] with udp protocol", j)
+		}
+
+		if !reflect.DeepEqual(TLSConfig{}, m.TLSConfig) {
+			return fmt.Errorf("can't use tls in mirrors[%d] with udp protocol", j)
+		}
+
+		if m.IsCompare() {
+			return fmt.Errorf("can't use compare mode in mirrors[%d] with udp protocol", j)
+		}
+	}
+
+	return nil
+}
+
+func setHTTPHealthCheck(c *HTTPHealthCheckConfig) {
+	if c.Method == "" {
+		c.Method = "GET"
+	}
+
+	if c.Path == "" {
+		c.Path = "/"
+	}
+
+	if len(c.ExpectedStatus) == 0 {
+		c.ExpectedStatus = []int{200}
+	}
+}
+
 func setSAN(c *HostConfig) {
 	if len(c.TLSConfig.SubjectAltNames) != 0 {
 		c.TLSConfig.SubjectAltName = *parseSubjectAltNames(c.TLSConfig.SubjectAltNames)
@@ -294,6 +976,309 @@ func errorCheck(i int, hct hostConfigType, c *HostConfig) error {
 		return errors.New("server", fmt.Sprintf("no %s configuration in servers.[%d]", hct.String(), i))
 	}
 
+	if c.SocketActivation {
+		if err := checkSocketActivation(i, hct, c); err != nil {
+			return err
+		}
+	} else if c.IsUnix() {
+		if err := checkUnix(i, hct, c); err != nil {
+			return err
+		}
+	} else if err := checkHostPort(i, hct, c); err != nil {
+		return err
+	}
+
+	if err := checkProxyProtocol(hct, c.ProxyProtocol); err != nil {
+		return errors.New("server", fmt.Sprintf("%v in servers.[%d].%s.proxyProtocol", err, i, hct.String()))
+	}
+
+	if err := checkCertificates(hct, c.TLSConfig); err != nil {
+		return errors.New("server.tlsConfig", fmt.Sprintf("%v in servers.[%d].%s", err, i, hct.String()))
+	}
+
+	if err := setRevocation(hct, &c.TLSConfig); err != nil {
+		return errors.New("server.tlsConfig", fmt.Sprintf("%v in servers.[%d].%s", err, i, hct.String()))
+	}
+
+	if err := setTLSOptions(&c.TLSConfig); err != nil {
+		return errors.New("server.tlsConfig", fmt.Sprintf("%v in servers.[%d].%s", err, i, hct.String()))
+	}
+
+	if err := setSessionTicket(hct, &c.TLSConfig); err != nil {
+		return errors.New("server.tlsConfig", fmt.Sprintf("%v in servers.[%d].%s", err, i, hct.String()))
+	}
+
+	// subjectAltNames is only enforced on mutual tls, it's ignored in other
+	// modes so existing configurations can still be loaded
+	if len(c.TLSConfig.SubjectAltNames) > 0 && !c.TLSConfig.IsMutual() {
+		log.Warn().
+			Str("mode", c.TLSConfig.Mode).
+			Msgf("subjectAltNames in servers.[%d].%s is ignored, it can only be used if mode is mutual", i, hct.String())
+	}
+
+	if c.TLSConfig.IsMutual() {
+		for _, san := range c.TLSConfig.SubjectAltNames {
+			if !subjectAltNameIsValid(san) {
+				return errors.New("server.tlsConfig", fmt.Sprintf("subjectAltName %s in servers.[%d].%s is not valid", san, i, hct.String()))
+			}
+		}
+	}
+
+	if c.TLSConfig.IsPassthrough() {
+		if hct != slistener {
+			return errors.New("server.tlsConfig", fmt.Sprintf("passthrough mode in servers.[%d].%s can only be used in listener", i, hct.String()))
+		}
+
+		if c.TLSConfig.CaCert != "" || c.TLSConfig.Cert != "" || c.TLSConfig.Key != "" {
+			return errors.New("server.tlsConfig", fmt.Sprintf("cacert, cert and key in servers.[%d].%s can't be used in passthrough mode", i, hct.String()))
+		}
+	}
+
+	// inform user when cacert, cert and key provided but tlsConfig mode is not set
+	if c.TLSConfig.CaCert != "" || c.TLSConfig.Cert != "" || c.TLSConfig.Key != "" {
+		if c.TLSConfig.Mode == "" {
+			return errors.New("server.tlsConfig", fmt.Sprintf("ignore cacert, cert or key in servers.[%d].%s because tlsConfig.mode is not set", i, hct.String()))
+		}
+
+		if !c.TLSConfig.IsMutual() && !c.TLSConfig.IsSimple() {
+			return errors.New("server.tlsConfig", fmt.Sprintf("not supported mode in servers.[%d].%s", i, hct.String()))
+		}
+	}
+
+	if c.TLSConfig.IsMutual() {
+		// if mode is mutual cert, key and ca cert must be set
+		hasCert := c.TLSConfig.Cert != "" && c.TLSConfig.Key != "" || len(c.TLSConfig.Certificates) > 0
+		if c.TLSConfig.CaCert == "" || !hasCert {
+			return errors.New("server.tlsConfig", fmt.Sprintf("cacert, cert and key in servers.[%d].%s must be set if mode is mutual", i, hct.String()))
+		}
+	}
+
+	return nil
+}
+
+// setRevocation validate crl and ocsp configuration and set its default value
+func setRevocation(hct hostConfigType, c *TLSConfig) error {
+	if c.CRL == "" && c.CRLRefresh != "" {
+		return fmt.Errorf("crlRefreshInterval can only be used with crl")
+	}
+
+	if c.CRL != "" {
+		if c.IsCRLURL() {
+			if u, err := url.Parse(c.CRL); err != nil || u.Host == "" {
+				return fmt.Errorf("crl %s is not valid url", c.CRL)
+			}
+		}
+
+		c.CRLRefreshDuration = time.Hour
+		if c.CRLRefresh != "" {
+			var err error
+
+			c.CRLRefreshDuration, err = parseDuration("crlRefreshInterval", c.CRLRefresh)
+			if err != nil {
+				return err
+			}
+
+			if c.CRLRefreshDuration == 0 {
+				return fmt.Errorf("crlRefreshInterval must be greater than zero")
+			}
+		}
+	}
+
+	o := &c.OCSP
+
+	if !o.Enabled && !o.Stapling {
+		if !reflect.DeepEqual(OCSPConfig{}, *o) {
+			return fmt.Errorf("ocsp policy, responder and timeout can only be used when enabled")
+		}
+		return nil
+	}
+
+	if o.Enabled && !c.IsMutual() && (hct == slistener || !c.IsSimple()) {
+		return fmt.Errorf("ocsp can only be used in mutual mode or in target with simple mode")
+	}
+
+	if o.Stapling && (hct != slistener || (!c.IsSimple() && !c.IsMutual())) {
+		return fmt.Errorf("ocsp stapling can only be used in listener with simple or mutual mode")
+	}
+
+	switch o.Policy {
+	case "":
+		o.Policy = OCSPPolicySoft
+	case OCSPPolicySoft, OCSPPolicyHard:
+	default:
+		return fmt.Errorf("not supported ocsp policy %s", o.Policy)
+	}
+
+	if o.Responder != "" {
+		if u, err := url.Parse(o.Responder); err != nil || u.Host == "" {
+			return fmt.Errorf("ocsp responder %s is not valid url", o.Responder)
+		}
+	}
+
+	o.TimeoutDuration = 5 * time.Second
+	if o.Timeout != "" {
+		var err error
+
+		o.TimeoutDuration, err = parseDuration("timeout", o.Timeout)
+		if err != nil {
+			return err
+		}
+
+		if o.TimeoutDuration == 0 {
+			return fmt.Errorf("ocsp timeout must be greater than zero")
+		}
+	}
+
+	return nil
+}
+
+// setSessionTicket validate session ticket configuration and set the default
+// rotation interval
+func setSessionTicket(hct hostConfigType, c *TLSConfig) error {
+	st := &c.SessionTicket
+
+	if reflect.DeepEqual(SessionTicketConfig{}, *st) {
+		return nil
+	}
+
+	if !c.IsSimple() && !c.IsMutual() {
+		return fmt.Errorf("sessionTicket can only be used with simple or mutual mode")
+	}
+
+	if len(st.KeyFiles) == 0 {
+		if st.RotationInterval != "" {
+			return fmt.Errorf("sessionTicket rotationInterval can only be used with keyFiles")
+		}
+		return nil
+	}
+
+	if hct != slistener {
+		return fmt.Errorf("sessionTicket keyFiles can only be used in listener")
+	}
+
+	if st.Disabled {
+		return fmt.Errorf("sessionTicket keyFiles can't be used if session ticket is disabled")
+	}
+
+	for _, f := range st.KeyFiles {
+		if f == "" {
+			return fmt.Errorf("sessionTicket keyFiles can't be empty")
+		}
+	}
+
+	st.RotationIntervalDuration = time.Hour
+	if st.RotationInterval != "" {
+		var err error
+
+		st.RotationIntervalDuration, err = parseDuration("rotationInterval", st.RotationInterval)
+		if err != nil {
+			return err
+		}
+
+		if st.RotationIntervalDuration < time.Second {
+			return fmt.Errorf("sessionTicket rotationInterval must be at least 1s")
+		}
+	}
+
+	return nil
+}
+
+// setTLSOptions parse tls versions, cipher suites and curves, they can only
+// be used in simple or mutual mode
+func setTLSOptions(c *TLSConfig) error {
+	if c.MinVersion == "" && c.MaxVersion == "" && len(c.CipherSuites) == 0 && len(c.Curves) == 0 && len(c.ALPN) == 0 {
+		return nil
+	}
+
+	if !c.IsSimple() && !c.IsMutual() {
+		return fmt.Errorf("tls options can only be used with simple or mutual mode")
+	}
+
+	var err error
+
+	if c.MinVersionID, err = parseTLSVersion(c.MinVersion); err != nil {
+		return err
+	}
+
+	if c.MaxVersionID, err = parseTLSVersion(c.MaxVersion); err != nil {
+		return err
+	}
+
+	if c.MaxVersionID != 0 && c.MinVersionID > c.MaxVersionID {
+		return fmt.Errorf("minVersion can't be greater than maxVersion")
+	}
+
+	// cipher suites in tls 1.3 are not configurable
+	if len(c.CipherSuites) > 0 && c.MinVersionID == tls.VersionTLS13 {
+		return fmt.Errorf("cipherSuites can't be used if minVersion is 1.3")
+	}
+
+	c.CipherSuiteIDs = nil
+	for _, name := range c.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return fmt.Errorf("not supported cipher suite %s", name)
+		}
+		c.CipherSuiteIDs = append(c.CipherSuiteIDs, id)
+	}
+
+	c.CurveIDs = nil
+	for _, name := range c.Curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("not supported curve %s", name)
+		}
+		c.CurveIDs = append(c.CurveIDs, id)
+	}
+
+	for _, proto := range c.ALPN {
+		if proto == "" || len(proto) > 255 {
+			return fmt.Errorf("alpn protocol %q is not valid", proto)
+		}
+	}
+
+	return nil
+}
+
+// checkCertificates check certificates selected by sni, it can only be used
+// by listener that terminate tls
+func checkCertificates(hct hostConfigType, c TLSConfig) error {
+	if len(c.Certificates) == 0 {
+		return nil
+	}
+
+	if hct != slistener {
+		return fmt.Errorf("certificates can only be used in listener")
+	}
+
+	if !c.IsSimple() && !c.IsMutual() {
+		return fmt.Errorf("certificates can only be used with simple or mutual mode")
+	}
+
+	for k := range c.Certificates {
+		cc := &c.Certificates[k]
+
+		if len(cc.SNI) == 0 {
+			return fmt.Errorf("no sni in certificates[%d]", k)
+		}
+
+		for l := range cc.SNI {
+			cc.SNI[l] = strings.ToLower(cc.SNI[l])
+
+			if !sniIsValid(cc.SNI[l]) {
+				return fmt.Errorf("sni %s in certificates[%d] is not valid", cc.SNI[l], k)
+			}
+		}
+
+		if cc.Cert == "" || cc.Key == "" {
+			return fmt.Errorf("cert and key in certificates[%d] must be set", k)
+		}
+	}
+
+	return nil
+}
+
+func checkHostPort(i int, hct hostConfigType, c *HostConfig) error {
 	if c.Host == "" {
 		return errors.New("server", fmt.Sprintf("host in servers.[%d].%s.host not specified", i, hct.String()))
 	}
@@ -316,22 +1301,61 @@ func errorCheck(i int, hct hostConfigType, c *HostConfig) error {
 		return errors.New("server", fmt.Sprintf("port in servers.[%d].%s.port is not valid port number", i, hct.String()))
 	}
 
-	// inform user when cacert, cert and key provided but tlsConfig mode is not set
-	if c.TLSConfig.CaCert != "" || c.TLSConfig.Cert != "" || c.TLSConfig.Key != "" {
-		if c.TLSConfig.Mode == "" {
-			return errors.New("server.tlsConfig", fmt.Sprintf("ignore cacert, cert or key in servers.[%d].%s because tlsConfig.mode is not set", i, hct.String()))
-		}
+	if !reflect.DeepEqual(SocketConfig{}, c.Socket) {
+		return errors.New("server", fmt.Sprintf("socket in servers.[%d].%s can only be used with unix", i, hct.String()))
+	}
 
-		if !c.TLSConfig.IsMutual() && !c.TLSConfig.IsSimple() {
-			return errors.New("server.tlsConfig", fmt.Sprintf("not supported mode in servers.[%d].%s", i, hct.String()))
-		}
+	return nil
+}
+
+// checkSocketActivation check listener that use socket passed by systemd,
+// the socket is selected by server name so address can't be configured
+func checkSocketActivation(i int, hct hostConfigType, c *HostConfig) error {
+	if hct != slistener {
+		return errors.New("server", fmt.Sprintf("socketActivation in servers.[%d].%s can only be used in listener", i, hct.String()))
 	}
 
-	if c.TLSConfig.IsMutual() {
-		// if mode is mutual cert, key and ca cert must be set
-		if c.TLSConfig.CaCert == "" || c.TLSConfig.Cert == "" || c.TLSConfig.Key == "" {
-			return errors.New("server.tlsConfig", fmt.Sprintf("cacert, cert and key in servers.[%d].%s must be set if mode is mutual", i, hct.String()))
+	if c.Host != "" || c.Port != "" || c.Unix != "" {
+		return errors.New("server", fmt.Sprintf("host, port and unix in servers.[%d].%s can't be used with socketActivation", i, hct.String()))
+	}
+
+	if !reflect.DeepEqual(SocketConfig{}, c.Socket) {
+		return errors.New("server", fmt.Sprintf("socket in servers.[%d].%s can't be used with socketActivation", i, hct.String()))
+	}
+
+	return nil
+}
+
+// checkUnix check unix domain socket configuration, socket file mode and
+// ownership can only be set in listener that doesn't use abstract namespace
+func checkUnix(i int, hct hostConfigType, c *HostConfig) error {
+	if hct == smetrics {
+		return errors.New("server", fmt.Sprintf("unix in servers.[%d].%s is not supported", i, hct.String()))
+	}
+
+	if c.Host != "" || c.Port != "" {
+		return errors.New("server", fmt.Sprintf("host and port in servers.[%d].%s can't be used with unix", i, hct.String()))
+	}
+
+	if c.IsAbstract() && len(c.Unix) == 1 {
+		return errors.New("server", fmt.Sprintf("unix in servers.[%d].%s is not valid abstract socket name", i, hct.String()))
+	}
+
+	if reflect.DeepEqual(SocketConfig{}, c.Socket) {
+		return nil
+	}
+
+	if hct != slistener || c.IsAbstract() {
+		return errors.New("server", fmt.Sprintf("socket in servers.[%d].%s can only be used in listener with unix socket file", i, hct.String()))
+	}
+
+	if c.Socket.Mode != "" {
+		mode, err := strconv.ParseUint(c.Socket.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return errors.New("server", fmt.Sprintf("socket.mode in servers.[%d].%s is not valid file mode", i, hct.String()))
 		}
+
+		c.Socket.FileMode = os.FileMode(mode)
 	}
 
 	return nil
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/tls"
+	"net"
 	"reflect"
 	"strings"
 	"testing"
@@ -18,6 +20,20 @@ var (
       port: 80`
 
 	invalidConfig = `server{}`
+
+	proxyProtocolConfig = `servers:
+- name: proxy-1
+  listener:
+    host: 127.0.0.1
+    port: 8080
+    proxyProtocol:
+      enabled: true
+      trustedCIDRs:
+        - 10.0.0.0/8
+  targets:
+    - host: 127.0.0.1
+      port: 80
+      proxyProtocol: v2`
 )
 
 func TestNewConfig(t *testing.T) {
@@ -254,6 +270,34 @@ func TestReadConfig(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:   "proxy protocol in listener and target",
+			Config: proxyProtocolConfig,
+			expectedConfig: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ProxyProtocol: ProxyProtocolConfig{
+								Enabled:      true,
+								TrustedCIDRs: []string{"10.0.0.0/8"},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ProxyProtocol: ProxyProtocolConfig{
+									Version: ProxyProtocolV2,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			Name:           "invalid yaml file",
 			Config:         invalidConfig,
@@ -528,7 +572,7 @@ func TestValidateConfig(t *testing.T) {
 			expectedError:  "port in servers.[0].target.port is not valid port number",
 		},
 		{
-			Name: "no host in mirror",
+			Name: "health check with default value",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -541,44 +585,48 @@ func TestValidateConfig(t *testing.T) {
 							{
 								Host: "127.0.0.1",
 								Port: "80",
+								HealthCheck: HealthCheckConfig{
+									Interval: "500ms",
+								},
 							},
 						},
-						Mirror: HostConfig{
-							Port: "2210",
-						},
 					},
 				},
 			},
-			expectedConfig: nil,
-			expectedError:  "host in servers.[0].mirror.host not specified",
-		},
-		{
-			Name: "no port in mirror",
-			Config: &Config{
+			expectedConfig: &Config{
 				ServerConfigs: []ServerConfig{
 					{
 						Name: "proxy-1",
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								TimeoutDuration: 300 * time.Second,
+							},
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									TimeoutDuration: 300 * time.Second,
+								},
+								HealthCheck: HealthCheckConfig{
+									Type:               HealthCheckTCP,
+									Interval:           "500ms",
+									IntervalDuration:   500 * time.Millisecond,
+									TimeoutDuration:    3 * time.Second,
+									HealthyThreshold:   2,
+									UnhealthyThreshold: 3,
+								},
 							},
 						},
-						Mirror: HostConfig{
-							Host: "192.168.1.1",
-						},
 					},
 				},
 			},
-			expectedConfig: nil,
-			expectedError:  "port in servers.[0].mirror.port not specified",
 		},
 		{
-			Name: "port in mirror is invalid",
+			Name: "not supported health check type",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -591,20 +639,19 @@ func TestValidateConfig(t *testing.T) {
 							{
 								Host: "127.0.0.1",
 								Port: "80",
+								HealthCheck: HealthCheckConfig{
+									Type: "icmp",
+								},
 							},
 						},
-						Mirror: HostConfig{
-							Host: "192.168.1.1",
-							Port: "2cc",
-						},
 					},
 				},
 			},
 			expectedConfig: nil,
-			expectedError:  "port in servers.[0].mirror.port is not valid",
+			expectedError:  "not supported type in servers.[0].targets[0].healthCheck",
 		},
 		{
-			Name: "set timeout on listener",
+			Name: "tls health check without tls mode",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -612,46 +659,49 @@ func TestValidateConfig(t *testing.T) {
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
-							ConnectionConfig: ConnectionConfig{
-								Timeout: "10s",
-							},
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
+								HealthCheck: HealthCheckConfig{
+									Type: HealthCheckTLS,
+								},
 							},
 						},
 					},
 				},
 			},
-			expectedConfig: &Config{
+			expectedConfig: nil,
+			expectedError:  "tls health check requires tls mode in servers.[0].targets[0].healthCheck",
+		},
+		{
+			Name: "negative health check interval",
+			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
 						Name: "proxy-1",
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
-							ConnectionConfig: ConnectionConfig{
-								Timeout:         "10s",
-								TimeoutDuration: 10 * time.Second,
-							},
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
-								ConnectionConfig: ConnectionConfig{
-									TimeoutDuration: 300 * time.Second,
+								HealthCheck: HealthCheckConfig{
+									Interval: "-1s",
 								},
 							},
 						},
 					},
 				},
 			},
+			expectedConfig: nil,
+			expectedError:  "can't use negative value for interval in servers.[0].targets[0].healthCheck",
 		},
 		{
-			Name: "set timeout on listener using ms",
+			Name: "send and expect in http health check",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -659,46 +709,54 @@ func TestValidateConfig(t *testing.T) {
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
-							ConnectionConfig: ConnectionConfig{
-								Timeout: "10ms",
-							},
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
+								HealthCheck: HealthCheckConfig{
+									Type:   HealthCheckHTTP,
+									Send:   "PING",
+									Expect: "PONG",
+								},
 							},
 						},
 					},
 				},
 			},
-			expectedConfig: &Config{
+			expectedConfig: nil,
+			expectedError:  "send and expect can't be used in http health check in servers.[0].targets[0].healthCheck",
+		},
+		{
+			Name: "http config in tcp health check",
+			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
 						Name: "proxy-1",
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
-							ConnectionConfig: ConnectionConfig{
-								Timeout:         "10ms",
-								TimeoutDuration: 10 * time.Millisecond,
-							},
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
-								ConnectionConfig: ConnectionConfig{
-									TimeoutDuration: 300 * time.Second,
+								HealthCheck: HealthCheckConfig{
+									Type: HealthCheckTCP,
+									HTTP: HTTPHealthCheckConfig{
+										Path: "/healthz",
+									},
 								},
 							},
 						},
 					},
 				},
 			},
+			expectedConfig: nil,
+			expectedError:  "http can only be used in http health check in servers.[0].targets[0].healthCheck",
 		},
 		{
-			Name: "set zero timeout on listener & target",
+			Name: "outlier detection with default value",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -706,19 +764,16 @@ func TestValidateConfig(t *testing.T) {
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
-							ConnectionConfig: ConnectionConfig{
-								Timeout: "0",
-							},
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
-								ConnectionConfig: ConnectionConfig{
-									Timeout: "0",
-								},
 							},
 						},
+						OutlierDetection: OutlierDetectionConfig{
+							ConsecutiveFailures: 3,
+						},
 					},
 				},
 			},
@@ -730,8 +785,7 @@ func TestValidateConfig(t *testing.T) {
 							Host: "127.0.0.1",
 							Port: "8080",
 							ConnectionConfig: ConnectionConfig{
-								Timeout:         "0",
-								TimeoutDuration: 0,
+								TimeoutDuration: 300 * time.Second,
 							},
 						},
 						Targets: []HostConfig{
@@ -739,17 +793,22 @@ func TestValidateConfig(t *testing.T) {
 								Host: "127.0.0.1",
 								Port: "80",
 								ConnectionConfig: ConnectionConfig{
-									Timeout:         "0",
-									TimeoutDuration: 0,
+									TimeoutDuration: 300 * time.Second,
 								},
 							},
 						},
+						OutlierDetection: OutlierDetectionConfig{
+							ConsecutiveFailures:      3,
+							MaxEjectionPercent:       10,
+							BaseEjectionTimeDuration: 30 * time.Second,
+							MaxEjectionTimeDuration:  300 * time.Second,
+						},
 					},
 				},
 			},
 		},
 		{
-			Name: "set invalid timeout on listener",
+			Name: "invalid max ejection percent",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -757,9 +816,6 @@ func TestValidateConfig(t *testing.T) {
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
-							ConnectionConfig: ConnectionConfig{
-								Timeout: "foo",
-							},
 						},
 						Targets: []HostConfig{
 							{
@@ -767,14 +823,17 @@ func TestValidateConfig(t *testing.T) {
 								Port: "80",
 							},
 						},
+						OutlierDetection: OutlierDetectionConfig{
+							MaxEjectionPercent: 120,
+						},
 					},
 				},
 			},
 			expectedConfig: nil,
-			expectedError:  "failed to parse timeout servers.[0]: strconv.Atoi: parsing \"foo\": invalid syntax",
+			expectedError:  "maxEjectionPercent must be between 0 and 100 in servers.[0].outlierDetection",
 		},
 		{
-			Name: "set invalid timeout on target",
+			Name: "max ejection time less than base ejection time",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -787,19 +846,20 @@ func TestValidateConfig(t *testing.T) {
 							{
 								Host: "127.0.0.1",
 								Port: "80",
-								ConnectionConfig: ConnectionConfig{
-									Timeout: "foo",
-								},
 							},
 						},
+						OutlierDetection: OutlierDetectionConfig{
+							BaseEjectionTime: "60s",
+							MaxEjectionTime:  "10s",
+						},
 					},
 				},
 			},
 			expectedConfig: nil,
-			expectedError:  "failed to parse timeout servers.[0].targets[0]: strconv.Atoi: parsing \"foo\": invalid syntax",
+			expectedError:  "maxEjectionTime can't be less than baseEjectionTime in servers.[0].outlierDetection",
 		},
 		{
-			Name: "set invalid timeout on mirror",
+			Name: "connect timeout and idle timeout without default timeout",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -807,82 +867,80 @@ func TestValidateConfig(t *testing.T) {
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								Timeout:     "0",
+								IdleTimeout: "60s",
+							},
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
-							},
-						},
-						Mirror: HostConfig{
-							Host: "127.0.0.1",
-							Port: "81",
-							ConnectionConfig: ConnectionConfig{
-								Timeout: "-1",
+								ConnectionConfig: ConnectionConfig{
+									ConnectTimeout: "500ms",
+									IdleTimeout:    "30",
+								},
 							},
 						},
 					},
 				},
 			},
-			expectedConfig: nil,
-			expectedError:  "failed to parse timeout servers.[0].mirror: can't use negative value for timeout",
-		},
-		{
-			Name: "set timeout on listener, target and set mirror to default",
-			Config: &Config{
+			expectedConfig: &Config{
 				ServerConfigs: []ServerConfig{
 					{
 						Name: "proxy-1",
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								Timeout:             "0",
+								IdleTimeout:         "60s",
+								IdleTimeoutDuration: 60 * time.Second,
+							},
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									ConnectTimeout:         "500ms",
+									IdleTimeout:            "30",
+									ConnectTimeoutDuration: 500 * time.Millisecond,
+									IdleTimeoutDuration:    30 * time.Second,
+								},
 							},
 						},
-						Mirror: HostConfig{
-							Host: "127.0.0.1",
-							Port: "9999",
-						},
 					},
 				},
 			},
-			expectedConfig: &Config{
+		},
+		{
+			Name: "invalid idle timeout",
+			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
 						Name: "proxy-1",
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
-							ConnectionConfig: ConnectionConfig{
-								TimeoutDuration: 300 * time.Second,
-							},
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
 								ConnectionConfig: ConnectionConfig{
-									TimeoutDuration: 300 * time.Second,
+									IdleTimeout: "-5s",
 								},
 							},
 						},
-						Mirror: HostConfig{
-							Host: "127.0.0.1",
-							Port: "9999",
-							ConnectionConfig: ConnectionConfig{
-								TimeoutDuration: 300 * time.Second,
-							},
-						},
 					},
 				},
 			},
+			expectedConfig: nil,
+			expectedError:  "failed to parse timeout servers.[0].targets[0]: can't use negative value for idleTimeout",
 		},
 		{
-			Name: "valid tlsConfig on listener",
+			Name: "multiple mirrors",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -890,12 +948,6 @@ func TestValidateConfig(t *testing.T) {
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
-							TLSConfig: TLSConfig{
-								Mode:   "mutual",
-								Key:    "/tmp/key.pem",
-								CaCert: "/tmp/ca-cert.pem",
-								Cert:   "/tmp/cert.pem",
-							},
 						},
 						Targets: []HostConfig{
 							{
@@ -903,6 +955,23 @@ func TestValidateConfig(t *testing.T) {
 								Port: "80",
 							},
 						},
+						Mirrors: []MirrorConfig{
+							{
+								HostConfig: HostConfig{
+									Host: "127.0.0.1",
+									Port: "81",
+								},
+								Mode: MirrorModeCompare,
+							},
+							{
+								HostConfig: HostConfig{
+									Host: "127.0.0.1",
+									Port: "82",
+								},
+								Percentage: 5,
+								MaxBytes:   1024,
+							},
+						},
 					},
 				},
 			},
@@ -916,15 +985,6 @@ func TestValidateConfig(t *testing.T) {
 							ConnectionConfig: ConnectionConfig{
 								TimeoutDuration: 300 * time.Second,
 							},
-							TLSConfig: TLSConfig{
-								Role: Role{
-									Server: true,
-								},
-								Mode:   "mutual",
-								Key:    "/tmp/key.pem",
-								CaCert: "/tmp/ca-cert.pem",
-								Cert:   "/tmp/cert.pem",
-							},
 						},
 						Targets: []HostConfig{
 							{
@@ -935,12 +995,37 @@ func TestValidateConfig(t *testing.T) {
 								},
 							},
 						},
+						Mirrors: []MirrorConfig{
+							{
+								HostConfig: HostConfig{
+									Host: "127.0.0.1",
+									Port: "81",
+									ConnectionConfig: ConnectionConfig{
+										TimeoutDuration: 300 * time.Second,
+									},
+								},
+								Percentage:   100,
+								Mode:         MirrorModeCompare,
+								CompareBytes: 4096,
+							},
+							{
+								HostConfig: HostConfig{
+									Host: "127.0.0.1",
+									Port: "82",
+									ConnectionConfig: ConnectionConfig{
+										TimeoutDuration: 300 * time.Second,
+									},
+								},
+								Percentage: 5,
+								MaxBytes:   1024,
+							},
+						},
 					},
 				},
 			},
 		},
 		{
-			Name: "tlsConfig mode is mutual but no cert provided",
+			Name: "invalid mirror percentage",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -948,11 +1033,6 @@ func TestValidateConfig(t *testing.T) {
 						Listener: HostConfig{
 							Host: "127.0.0.1",
 							Port: "8080",
-							TLSConfig: TLSConfig{
-								Mode:   "mutual",
-								Key:    "/tmp/key.pem",
-								CaCert: "/tmp/ca-cert.pem",
-							},
 						},
 						Targets: []HostConfig{
 							{
@@ -960,14 +1040,23 @@ func TestValidateConfig(t *testing.T) {
 								Port: "80",
 							},
 						},
+						Mirrors: []MirrorConfig{
+							{
+								HostConfig: HostConfig{
+									Host: "127.0.0.1",
+									Port: "81",
+								},
+								Percentage: 101,
+							},
+						},
 					},
 				},
 			},
 			expectedConfig: nil,
-			expectedError:  "cacert, cert and key in servers.[0].listener must be set if mode is mutual",
+			expectedError:  "percentage in servers.[0].mirrors[0] must be between 0 and 100",
 		},
 		{
-			Name: "tlsConfig mode is mutual but no key provided",
+			Name: "not supported mirror mode",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -980,21 +1069,25 @@ func TestValidateConfig(t *testing.T) {
 							{
 								Host: "127.0.0.1",
 								Port: "80",
-								TLSConfig: TLSConfig{
-									Mode:   "mutual",
-									Cert:   "/tmp/cert.pem",
-									CaCert: "/tmp/ca-cert.pem",
+							},
+						},
+						Mirrors: []MirrorConfig{
+							{
+								HostConfig: HostConfig{
+									Host: "127.0.0.1",
+									Port: "81",
 								},
+								Mode: "diff",
 							},
 						},
 					},
 				},
 			},
 			expectedConfig: nil,
-			expectedError:  "cacert, cert and key in servers.[0].target must be set if mode is mutual",
+			expectedError:  "not supported mode in servers.[0].mirrors[0]",
 		},
 		{
-			Name: "caCert, cert, and key is set, but mode is not set",
+			Name: "negative compareBytes in mirror",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
@@ -1007,74 +1100,1998 @@ func TestValidateConfig(t *testing.T) {
 							{
 								Host: "127.0.0.1",
 								Port: "80",
-								TLSConfig: TLSConfig{
-									CaCert: "/tmp/ca-cert.pem",
-									Cert:   "/tmp/cert.pem",
-									Key:    "/tmp/key.pem",
+							},
+						},
+						Mirrors: []MirrorConfig{
+							{
+								HostConfig: HostConfig{
+									Host: "127.0.0.1",
+									Port: "81",
 								},
+								Mode:         MirrorModeCompare,
+								CompareBytes: -1,
 							},
 						},
 					},
 				},
 			},
 			expectedConfig: nil,
-			expectedError:  "ignore cacert, cert or key in servers.[0].target because tlsConfig.mode is not set",
+			expectedError:  "can't use negative value for compareBytes in servers.[0].mirrors[0]",
 		},
 		{
-			Name: "check if mode is not mutual or simple",
+			Name: "unix socket listener and target",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
 						Name: "proxy-1",
 						Listener: HostConfig{
-							Host: "127.0.0.1",
-							Port: "8080",
+							Unix: "/run/octo.sock",
+							Socket: SocketConfig{
+								Mode:  "0660",
+								Group: "docker",
+							},
 						},
 						Targets: []HostConfig{
 							{
-								Host: "127.0.0.1",
-								Port: "80",
-								TLSConfig: TLSConfig{
-									CaCert: "/tmp/ca-cert.pem",
-									Cert:   "/tmp/cert.pem",
-									Key:    "/tmp/key.pem",
-									Mode:   "server",
+								Unix: "@docker",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Unix: "/run/octo.sock",
+							Socket: SocketConfig{
+								Mode:     "0660",
+								Group:    "docker",
+								FileMode: 0660,
+							},
+							ConnectionConfig: ConnectionConfig{
+								TimeoutDuration: 300 * time.Second,
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Unix: "@docker",
+								ConnectionConfig: ConnectionConfig{
+									TimeoutDuration: 300 * time.Second,
 								},
 							},
 						},
 					},
 				},
 			},
-			expectedConfig: nil,
-			expectedError:  "not supported mode in servers.[0].target",
 		},
 		{
-			Name: "check if mode is nil",
+			Name: "unix socket with host",
 			Config: &Config{
 				ServerConfigs: []ServerConfig{
 					{
 						Name: "proxy-1",
 						Listener: HostConfig{
+							Unix: "/run/octo.sock",
 							Host: "127.0.0.1",
-							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "host and port in servers.[0].listener can't be used with unix",
+		},
+		{
+			Name: "socket in unix target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Unix:   "/run/docker.sock",
+								Socket: SocketConfig{Mode: "0660"},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "socket in servers.[0].target can only be used in listener with unix socket file",
+		},
+		{
+			Name: "socket in tcp listener",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host:   "127.0.0.1",
+							Port:   "8080",
+							Socket: SocketConfig{User: "root"},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "socket in servers.[0].listener can only be used with unix",
+		},
+		{
+			Name: "invalid socket mode",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Unix:   "/run/octo.sock",
+							Socket: SocketConfig{Mode: "rw-rw----"},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "socket.mode in servers.[0].listener is not valid file mode",
+		},
+		{
+			Name: "proxy protocol in listener",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ProxyProtocol: ProxyProtocolConfig{
+								Enabled:      true,
+								TrustedCIDRs: []string{"10.0.0.0/8"},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								TimeoutDuration: 300 * time.Second,
+							},
+							ProxyProtocol: ProxyProtocolConfig{
+								Enabled:         true,
+								TrustedCIDRs:    []string{"10.0.0.0/8"},
+								TimeoutDuration: 5 * time.Second,
+								TrustedNetworks: []*net.IPNet{
+									{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+								},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									TimeoutDuration: 300 * time.Second,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "invalid proxy protocol trusted CIDR",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ProxyProtocol: ProxyProtocolConfig{
+								Enabled:      true,
+								TrustedCIDRs: []string{"10.0.0.0"},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "10.0.0.0 is not valid CIDR in servers.[0].listener.proxyProtocol",
+		},
+		{
+			Name: "proxy protocol in target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ProxyProtocol: ProxyProtocolConfig{
+									Enabled: true,
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "only version can be used in target in servers.[0].target.proxyProtocol",
+		},
+		{
+			Name: "not supported proxy protocol version in target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ProxyProtocol: ProxyProtocolConfig{
+									Version: "v3",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "not supported version in servers.[0].target.proxyProtocol",
+		},
+		{
+			Name: "not supported protocol",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name:     "proxy-1",
+						Protocol: "sctp",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "not supported protocol in servers.[0]",
+		},
+		{
+			Name: "tls in udp listener",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name:     "proxy-1",
+						Protocol: ProtocolUDP,
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "simple",
+								Cert: "cert.pem",
+								Key:  "key.pem",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "can't use tls in listener with udp protocol in servers.[0]",
+		},
+		{
+			Name: "health check in udp target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name:     "proxy-1",
+						Protocol: ProtocolUDP,
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								HealthCheck: HealthCheckConfig{
+									Type: HealthCheckTCP,
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "can't use healthCheck in targets[0] with udp protocol in servers.[0]",
+		},
+		{
+			Name: "not supported load balancer",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+						LoadBalancer: "ringHash",
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "not supported loadBalancer in servers.[0]",
+		},
+		{
+			Name: "negative weight in target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host:   "127.0.0.1",
+								Port:   "80",
+								Weight: -1,
+							},
+						},
+						LoadBalancer: LoadBalancerWeighted,
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "can't use negative value for weight in servers.[0].targets[0]",
+		},
+		{
+			Name: "no host in mirror",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+						Mirror: HostConfig{
+							Port: "2210",
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "host in servers.[0].mirror.host not specified",
+		},
+		{
+			Name: "no port in mirror",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+						Mirror: HostConfig{
+							Host: "192.168.1.1",
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "port in servers.[0].mirror.port not specified",
+		},
+		{
+			Name: "port in mirror is invalid",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+						Mirror: HostConfig{
+							Host: "192.168.1.1",
+							Port: "2cc",
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "port in servers.[0].mirror.port is not valid",
+		},
+		{
+			Name: "set timeout on listener",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								Timeout: "10s",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								Timeout:         "10s",
+								TimeoutDuration: 10 * time.Second,
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									TimeoutDuration: 300 * time.Second,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "set timeout on listener using ms",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								Timeout: "10ms",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								Timeout:         "10ms",
+								TimeoutDuration: 10 * time.Millisecond,
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									TimeoutDuration: 300 * time.Second,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "set zero timeout on listener & target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								Timeout: "0",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									Timeout: "0",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								Timeout:         "0",
+								TimeoutDuration: 0,
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									Timeout:         "0",
+									TimeoutDuration: 0,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "set invalid timeout on listener",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								Timeout: "foo",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "failed to parse timeout servers.[0]: strconv.Atoi: parsing \"foo\": invalid syntax",
+		},
+		{
+			Name: "set invalid timeout on target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									Timeout: "foo",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "failed to parse timeout servers.[0].targets[0]: strconv.Atoi: parsing \"foo\": invalid syntax",
+		},
+		{
+			Name: "set invalid timeout on mirror",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+						Mirror: HostConfig{
+							Host: "127.0.0.1",
+							Port: "81",
+							ConnectionConfig: ConnectionConfig{
+								Timeout: "-1",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "failed to parse timeout servers.[0].mirror: can't use negative value for timeout",
+		},
+		{
+			Name: "set timeout on listener, target and set mirror to default",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+						Mirror: HostConfig{
+							Host: "127.0.0.1",
+							Port: "9999",
+						},
+					},
+				},
+			},
+			expectedConfig: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								TimeoutDuration: 300 * time.Second,
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									TimeoutDuration: 300 * time.Second,
+								},
+							},
+						},
+						Mirror: HostConfig{
+							Host: "127.0.0.1",
+							Port: "9999",
+							ConnectionConfig: ConnectionConfig{
+								TimeoutDuration: 300 * time.Second,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "valid tlsConfig on listener",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:   "mutual",
+								Key:    "/tmp/key.pem",
+								CaCert: "/tmp/ca-cert.pem",
+								Cert:   "/tmp/cert.pem",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							ConnectionConfig: ConnectionConfig{
+								TimeoutDuration: 300 * time.Second,
+							},
+							TLSConfig: TLSConfig{
+								Role: Role{
+									Server: true,
+								},
+								Mode:   "mutual",
+								Key:    "/tmp/key.pem",
+								CaCert: "/tmp/ca-cert.pem",
+								Cert:   "/tmp/cert.pem",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								ConnectionConfig: ConnectionConfig{
+									TimeoutDuration: 300 * time.Second,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "tlsConfig mode is mutual but no cert provided",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:   "mutual",
+								Key:    "/tmp/key.pem",
+								CaCert: "/tmp/ca-cert.pem",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "cacert, cert and key in servers.[0].listener must be set if mode is mutual",
+		},
+		{
+			Name: "tlsConfig mode is mutual but no key provided",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									Mode:   "mutual",
+									Cert:   "/tmp/cert.pem",
+									CaCert: "/tmp/ca-cert.pem",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "cacert, cert and key in servers.[0].target must be set if mode is mutual",
+		},
+		{
+			Name: "caCert, cert, and key is set, but mode is not set",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									CaCert: "/tmp/ca-cert.pem",
+									Cert:   "/tmp/cert.pem",
+									Key:    "/tmp/key.pem",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "ignore cacert, cert or key in servers.[0].target because tlsConfig.mode is not set",
+		},
+		{
+			Name: "check if mode is not mutual or simple",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									CaCert: "/tmp/ca-cert.pem",
+									Cert:   "/tmp/cert.pem",
+									Key:    "/tmp/key.pem",
+									Mode:   "server",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "not supported mode in servers.[0].target",
+		},
+		{
+			Name: "check if mode is nil",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									CaCert: "/tmp/ca-cert.pem",
+									Cert:   "/tmp/cert.pem",
+									Key:    "/tmp/key.pem",
+									Mode:   "",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "ignore cacert, cert or key in servers.[0].target because tlsConfig.mode is not set",
+		},
+		{
+			Name: "check if routes used without passthrough mode",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Routes: []RouteConfig{
+							{
+								SNI: []string{"example.com"},
+								Targets: []HostConfig{
+									{
+										Host: "127.0.0.1",
+										Port: "443",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "routes in servers.[0] can only be used with tls passthrough mode",
+		},
+		{
+			Name: "check if sni in routes not specified",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "passthrough",
+							},
+						},
+						Routes: []RouteConfig{
+							{
+								SNI: []string{},
+								Targets: []HostConfig{
+									{
+										Host: "127.0.0.1",
+										Port: "443",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "no sni in servers.[0].routes[0]",
+		},
+		{
+			Name: "check if sni in routes is not valid",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "passthrough",
+							},
+						},
+						Routes: []RouteConfig{
+							{
+								SNI: []string{"api.*.example.com"},
+								Targets: []HostConfig{
+									{
+										Host: "127.0.0.1",
+										Port: "443",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "sni api.*.example.com in servers.[0].routes[0] is not valid",
+		},
+		{
+			Name: "check if targets in routes not specified",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "passthrough",
+							},
+						},
+						Routes: []RouteConfig{
+							{
+								SNI: []string{"example.com"},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "no target configurations in servers.[0].routes[0]",
+		},
+		{
+			Name: "check if passthrough mode used with cert",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "passthrough",
+								Cert: "/tmp/cert.pem",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "cacert, cert and key in servers.[0].listener can't be used in passthrough mode",
+		},
+		{
+			Name: "check if passthrough mode used in target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									Mode: "passthrough",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "passthrough mode in servers.[0].target can only be used in listener",
+		},
+		{
+			Name: "check if certificates used in target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									Mode: "simple",
+									Certificates: []CertificateConfig{
+										{
+											SNI:  []string{"example.com"},
+											Cert: "/tmp/cert.pem",
+											Key:  "/tmp/key.pem",
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "certificates can only be used in listener in servers.[0].target",
+		},
+		{
+			Name: "check if certificates used without mode",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "",
+								Certificates: []CertificateConfig{
+									{
+										SNI:  []string{"example.com"},
+										Cert: "/tmp/cert.pem",
+										Key:  "/tmp/key.pem",
+									},
+								},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "certificates can only be used with simple or mutual mode in servers.[0].listener",
+		},
+		{
+			Name: "check if sni in certificates not specified",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "simple",
+								Certificates: []CertificateConfig{
+									{
+										SNI:  []string{},
+										Cert: "/tmp/cert.pem",
+										Key:  "/tmp/key.pem",
+									},
+								},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "no sni in certificates[0] in servers.[0].listener",
+		},
+		{
+			Name: "check if sni in certificates is not valid",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "simple",
+								Certificates: []CertificateConfig{
+									{
+										SNI:  []string{"*.*.example.com"},
+										Cert: "/tmp/cert.pem",
+										Key:  "/tmp/key.pem",
+									},
+								},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "sni *.*.example.com in certificates[0] is not valid in servers.[0].listener",
+		},
+		{
+			Name: "check if key in certificates not specified",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "simple",
+								Certificates: []CertificateConfig{
+									{
+										SNI:  []string{"example.com"},
+										Cert: "/tmp/cert.pem",
+									},
+								},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "cert and key in certificates[0] must be set in servers.[0].listener",
+		},
+		{
+			Name: "check if subjectAltNames is not valid",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:            "mutual",
+								CaCert:          "/tmp/ca-cert.pem",
+								Cert:            "/tmp/cert.pem",
+								Key:             "/tmp/key.pem",
+								SubjectAltNames: []string{"spiffe:///web"},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "subjectAltName spiffe:///web in servers.[0].listener is not valid",
+		},
+		{
+			Name: "check if tls options used without mode",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								MinVersion: "1.3",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "tls options can only be used with simple or mutual mode in servers.[0].listener",
+		},
+		{
+			Name: "check if tls version is not supported",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:       "simple",
+								Cert:       "/tmp/cert.pem",
+								Key:        "/tmp/key.pem",
+								MinVersion: "1.1",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "not supported tls version 1.1 in servers.[0].listener",
+		},
+		{
+			Name: "check if minVersion greater than maxVersion",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:       "simple",
+								Cert:       "/tmp/cert.pem",
+								Key:        "/tmp/key.pem",
+								MinVersion: "1.3",
+								MaxVersion: "1.2",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "minVersion can't be greater than maxVersion in servers.[0].listener",
+		},
+		{
+			Name: "check if cipherSuites used with tls 1.3",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:         "simple",
+								Cert:         "/tmp/cert.pem",
+								Key:          "/tmp/key.pem",
+								MinVersion:   "1.3",
+								CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "cipherSuites can't be used if minVersion is 1.3 in servers.[0].listener",
+		},
+		{
+			Name: "check if cipher suite is not supported",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:         "simple",
+								Cert:         "/tmp/cert.pem",
+								Key:          "/tmp/key.pem",
+								CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "not supported cipher suite TLS_RSA_WITH_RC4_128_SHA in servers.[0].listener",
+		},
+		{
+			Name: "check if curve is not supported",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:   "simple",
+								Cert:   "/tmp/cert.pem",
+								Key:    "/tmp/key.pem",
+								Curves: []string{"P224"},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "not supported curve P224 in servers.[0].listener",
+		},
+		{
+			Name: "check if crlRefreshInterval is used without crl",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:       "simple",
+								Cert:       "/tmp/cert.pem",
+								Key:        "/tmp/key.pem",
+								CRLRefresh: "60s",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "crlRefreshInterval can only be used with crl in servers.[0].listener",
+		},
+		{
+			Name: "check if crl url is not valid",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "simple",
+								Cert: "/tmp/cert.pem",
+								Key:  "/tmp/key.pem",
+								CRL:  "http://",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "crl http:// is not valid url in servers.[0].listener",
+		},
+		{
+			Name: "check if crlRefreshInterval is zero",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode:       "simple",
+								Cert:       "/tmp/cert.pem",
+								Key:        "/tmp/key.pem",
+								CRL:        "/tmp/ca.crl",
+								CRLRefresh: "0",
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "crlRefreshInterval must be greater than zero in servers.[0].listener",
+		},
+		{
+			Name: "check if ocsp is used in listener with simple mode",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "simple",
+								Cert: "/tmp/cert.pem",
+								Key:  "/tmp/key.pem",
+								OCSP: OCSPConfig{
+									Enabled: true,
+								},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "ocsp can only be used in mutual mode or in target with simple mode in servers.[0].listener",
+		},
+		{
+			Name: "check if ocsp stapling is used in target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
 						},
 						Targets: []HostConfig{
 							{
 								Host: "127.0.0.1",
 								Port: "80",
 								TLSConfig: TLSConfig{
-									CaCert: "/tmp/ca-cert.pem",
-									Cert:   "/tmp/cert.pem",
-									Key:    "/tmp/key.pem",
-									Mode:   "",
+									Mode: "simple",
+									OCSP: OCSPConfig{
+										Stapling: true,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "ocsp stapling can only be used in listener with simple or mutual mode in servers.[0].target",
+		},
+		{
+			Name: "check if ocsp policy is used when ocsp is disabled",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									Mode: "simple",
+									OCSP: OCSPConfig{
+										Policy: "hard",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "ocsp policy, responder and timeout can only be used when enabled in servers.[0].target",
+		},
+		{
+			Name: "check if ocsp policy is not supported",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									Mode: "simple",
+									OCSP: OCSPConfig{
+										Enabled: true,
+										Policy:  "strict",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "not supported ocsp policy strict in servers.[0].target",
+		},
+		{
+			Name: "check if ocsp responder is not valid url",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									Mode: "simple",
+									OCSP: OCSPConfig{
+										Enabled:   true,
+										Responder: "ocsp.example.com",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "ocsp responder ocsp.example.com is not valid url in servers.[0].target",
+		},
+		{
+			Name: "check if sessionTicket is used without tls",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								SessionTicket: SessionTicketConfig{
+									Disabled: true,
+								},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "sessionTicket can only be used with simple or mutual mode in servers.[0].listener",
+		},
+		{
+			Name: "check if sessionTicket keyFiles is used in target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+								TLSConfig: TLSConfig{
+									Mode: "simple",
+									SessionTicket: SessionTicketConfig{
+										KeyFiles: []string{"/tmp/ticket.key"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "sessionTicket keyFiles can only be used in listener in servers.[0].target",
+		},
+		{
+			Name: "check if sessionTicket rotationInterval is used without keyFiles",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "simple",
+								Cert: "/tmp/cert.pem",
+								Key:  "/tmp/key.pem",
+								SessionTicket: SessionTicketConfig{
+									RotationInterval: "60s",
 								},
 							},
 						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
 					},
 				},
 			},
 			expectedConfig: nil,
-			expectedError:  "ignore cacert, cert or key in servers.[0].target because tlsConfig.mode is not set",
+			expectedError:  "sessionTicket rotationInterval can only be used with keyFiles in servers.[0].listener",
+		},
+		{
+			Name: "check if sessionTicket keyFiles is used when disabled",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "simple",
+								Cert: "/tmp/cert.pem",
+								Key:  "/tmp/key.pem",
+								SessionTicket: SessionTicketConfig{
+									Disabled: true,
+									KeyFiles: []string{"/tmp/ticket.key"},
+								},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "sessionTicket keyFiles can't be used if session ticket is disabled in servers.[0].listener",
+		},
+		{
+			Name: "check if sessionTicket rotationInterval is too short",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+							TLSConfig: TLSConfig{
+								Mode: "simple",
+								Cert: "/tmp/cert.pem",
+								Key:  "/tmp/key.pem",
+								SessionTicket: SessionTicketConfig{
+									KeyFiles:         []string{"/tmp/ticket.key"},
+									RotationInterval: "500ms",
+								},
+							},
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "sessionTicket rotationInterval must be at least 1s in servers.[0].listener",
+		},
+		{
+			Name: "check if drainTimeout is negative",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+						DrainTimeout: "-10s",
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "failed to parse drainTimeout servers.[0]: can't use negative value for drainTimeout",
+		},
+		{
+			Name: "socketActivation without server name",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Listener: HostConfig{
+							SocketActivation: true,
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "name in servers.[0] must be specified with socketActivation",
+		},
+		{
+			Name: "socketActivation with port in listener",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Port:             "443",
+							SocketActivation: true,
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "host, port and unix in servers.[0].listener can't be used with socketActivation",
+		},
+		{
+			Name: "socketActivation with socket in listener",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							Socket:           SocketConfig{Mode: "0660"},
+							SocketActivation: true,
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "socket in servers.[0].listener can't be used with socketActivation",
+		},
+		{
+			Name: "socketActivation in target",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "proxy-1",
+						Listener: HostConfig{
+							SocketActivation: true,
+						},
+						Targets: []HostConfig{
+							{
+								SocketActivation: true,
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "socketActivation in servers.[0].target can only be used in listener",
+		},
+		{
+			Name: "check if server name is duplicated",
+			Config: &Config{
+				ServerConfigs: []ServerConfig{
+					{
+						Name: "127.0.0.1:8081",
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8080",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+					{
+						Listener: HostConfig{
+							Host: "127.0.0.1",
+							Port: "8081",
+						},
+						Targets: []HostConfig{
+							{
+								Host: "127.0.0.1",
+								Port: "80",
+							},
+						},
+					},
+				},
+			},
+			expectedConfig: nil,
+			expectedError:  "name 127.0.0.1:8081 in servers.[1] is already used in servers.[0]",
 		},
 		{
 			Name: "check if host in metrics not specified",
@@ -1220,3 +3237,161 @@ func TestValidateConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestSubjectAltNamesWithoutMutual(t *testing.T) {
+	c := &Config{
+		ServerConfigs: []ServerConfig{
+			{
+				Name: "proxy-1",
+				Listener: HostConfig{
+					Host: "127.0.0.1",
+					Port: "8080",
+					TLSConfig: TLSConfig{
+						Mode:            "simple",
+						Cert:            "/tmp/cert.pem",
+						Key:             "/tmp/key.pem",
+						SubjectAltNames: []string{"spiffe://example.org/web"},
+					},
+				},
+				Targets: []HostConfig{
+					{
+						Host: "127.0.0.1",
+						Port: "80",
+					},
+				},
+			},
+		},
+	}
+
+	// subjectAltNames is ignored, so the configuration can still be loaded
+	if _, err := validateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTLSOptions(t *testing.T) {
+	c := &TLSConfig{
+		Mode:         "simple",
+		MinVersion:   "1.2",
+		MaxVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"X25519", "P256"},
+		ALPN:         []string{"h2", "http/1.1"},
+	}
+
+	if err := setTLSOptions(c); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := TLSOptions{
+		MinVersionID:   tls.VersionTLS12,
+		MaxVersionID:   tls.VersionTLS13,
+		CipherSuiteIDs: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		CurveIDs:       []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+
+	if !reflect.DeepEqual(c.TLSOptions, expected) {
+		t.Fatalf("got %v, want %v", c.TLSOptions, expected)
+	}
+
+	t.Run("test tls 1.3 cipher suite is not supported", func(t *testing.T) {
+		if _, ok := cipherSuiteID("TLS_AES_128_GCM_SHA256"); ok {
+			t.Fatalf("cipher suite must not be supported")
+		}
+	})
+}
+
+func TestSetRevocation(t *testing.T) {
+	c := &TLSConfig{
+		Mode:   "mutual",
+		CaCert: "/tmp/ca.pem",
+		Cert:   "/tmp/cert.pem",
+		Key:    "/tmp/key.pem",
+		CRL:    "https://ca.example.com/ca.crl",
+		OCSP: OCSPConfig{
+			Enabled:  true,
+			Stapling: true,
+		},
+	}
+
+	if err := setRevocation(slistener, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.CRLRefreshDuration != time.Hour {
+		t.Fatalf("got %v, want %v", c.CRLRefreshDuration, time.Hour)
+	}
+
+	expected := OCSPConfig{
+		Enabled:         true,
+		Stapling:        true,
+		Policy:          OCSPPolicySoft,
+		TimeoutDuration: 5 * time.Second,
+	}
+
+	if !reflect.DeepEqual(c.OCSP, expected) {
+		t.Fatalf("got %v, want %v", c.OCSP, expected)
+	}
+}
+
+func TestSetSessionTicket(t *testing.T) {
+	c := &TLSConfig{
+		Mode: "simple",
+		Cert: "/tmp/cert.pem",
+		Key:  "/tmp/key.pem",
+		SessionTicket: SessionTicketConfig{
+			KeyFiles: []string{"/tmp/ticket.key"},
+		},
+	}
+
+	if err := setSessionTicket(slistener, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.SessionTicket.RotationIntervalDuration != time.Hour {
+		t.Fatalf("got %v, want %v", c.SessionTicket.RotationIntervalDuration, time.Hour)
+	}
+}
+
+func TestDefaultServerName(t *testing.T) {
+	r, err := readConfig(strings.NewReader(`servers:
+- listener:
+    host: 127.0.0.1
+    port: 8080
+  targets:
+    - host: 127.0.0.1
+      port: 80
+- name: proxy-2
+  listener:
+    host: 127.0.0.1
+    port: 8081
+  targets:
+    - host: 127.0.0.1
+      port: 80
+- protocol: udp
+  listener:
+    host: 127.0.0.1
+    port: 8080
+  targets:
+    - host: 127.0.0.1
+      port: 53
+- listener:
+    unix: /run/octo.sock
+  targets:
+    - host: 127.0.0.1
+      port: 80`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := validateConfig(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"127.0.0.1:8080", "proxy-2", "udp://127.0.0.1:8080", "/run/octo.sock"} {
+		if c.ServerConfigs[i].Name != name {
+			t.Fatalf("got %v, want %v", c.ServerConfigs[i].Name, name)
+		}
+	}
+}
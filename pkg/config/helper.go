@@ -1,7 +1,10 @@
 package config
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -9,6 +12,50 @@ import (
 
 var ipRegex = regexp.MustCompile("(25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])")
 
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// parseTLSVersion returns tls version id, empty version returns 0
+func parseTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	id, ok := tlsVersions[v]
+	if !ok {
+		return 0, fmt.Errorf("not supported tls version %s", v)
+	}
+
+	return id, nil
+}
+
+// cipherSuiteID returns id of secure cipher suite that can be configured in
+// tls 1.2, cipher suites with known security issues are not supported
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name != name {
+			continue
+		}
+
+		for _, v := range cs.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				return cs.ID, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
 func hostIsValid(h string) bool {
 	if ipRegex.MatchString(h) {
 		return hostIPIsValid(h)
@@ -22,18 +69,73 @@ func parseSubjectAltNames(sans []string) *SubjectAltName {
 	configSAN := &SubjectAltName{}
 
 	for _, san := range sans {
-		if ipRegex.MatchString(san) {
-			configSAN.IPAddress = append(configSAN.IPAddress, san)
-		} else if strings.Contains(san, "://") {
+		if strings.Contains(san, "://") {
 			configSAN.Uri = append(configSAN.Uri, san)
+		} else if net.ParseIP(san) != nil {
+			configSAN.IPAddress = append(configSAN.IPAddress, san)
 		} else {
-			configSAN.DNS = append(configSAN.DNS, san)
+			configSAN.DNS = append(configSAN.DNS, strings.ToLower(san))
 		}
 	}
 
 	return configSAN
 }
 
+// loadBalancerIsValid check if policy is supported, empty policy will
+// fallback to round robin
+func loadBalancerIsValid(policy string) bool {
+	switch policy {
+	case "", LoadBalancerRoundRobin, LoadBalancerLeastConnections,
+		LoadBalancerRandomTwoChoices, LoadBalancerWeighted:
+		return true
+	}
+
+	return false
+}
+
+// protocolIsValid check if protocol is supported, empty protocol will
+// fallback to tcp
+func protocolIsValid(protocol string) bool {
+	switch protocol {
+	case "", ProtocolTCP, ProtocolUDP:
+		return true
+	}
+
+	return false
+}
+
+// subjectAltNameIsValid check if subject alternative name is an uri, ip
+// address, or a hostname that can be a wildcard hostname
+func subjectAltNameIsValid(san string) bool {
+	if strings.Contains(san, "://") {
+		u, err := url.Parse(san)
+		return err == nil && u.Scheme != "" && u.Host != ""
+	}
+
+	if net.ParseIP(san) != nil {
+		return true
+	}
+
+	return sniIsValid(strings.ToLower(san))
+}
+
+// sniIsValid check if server name is a hostname or a wildcard hostname
+// in format *.example.com
+func sniIsValid(sni string) bool {
+	name := strings.TrimPrefix(sni, "*.")
+	if name == "" || strings.Contains(name, "*") {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
 func hostIPIsValid(h string) bool {
 	return net.ParseIP(h) != nil
 }
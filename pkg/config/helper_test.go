@@ -55,6 +55,20 @@ func TestParseSubjectAltNames(t *testing.T) {
 				DNS: []string{"github.com", "gitlab.com"},
 			},
 		},
+		{
+			Name: "test dns san with number",
+			sans: []string{"web1.example.com", "*.Example.com"},
+			expectedSAN: &SubjectAltName{
+				DNS: []string{"web1.example.com", "*.example.com"},
+			},
+		},
+		{
+			Name: "test ipv6 san",
+			sans: []string{"::1"},
+			expectedSAN: &SubjectAltName{
+				IPAddress: []string{"::1"},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -68,6 +82,48 @@ func TestParseSubjectAltNames(t *testing.T) {
 	}
 }
 
+func TestSubjectAltNameIsValid(t *testing.T) {
+	tests := []struct {
+		Name     string
+		san      string
+		expected bool
+	}{
+		{
+			Name:     "test spiffe id",
+			san:      "spiffe://example.org/ns/default/sa/web",
+			expected: true,
+		},
+		{
+			Name:     "test uri without host",
+			san:      "spiffe:///ns/default",
+			expected: false,
+		},
+		{
+			Name:     "test ip address",
+			san:      "10.0.0.1",
+			expected: true,
+		},
+		{
+			Name:     "test wildcard dns",
+			san:      "*.example.com",
+			expected: true,
+		},
+		{
+			Name:     "test invalid wildcard dns",
+			san:      "api.*.example.com",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			if got := subjectAltNameIsValid(tt.san); got != tt.expected {
+				t.Fatalf("got %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
 func TestPortIsValid(t *testing.T) {
 	t.Run("test valid port", func(t *testing.T) {
 		if !portIsValid("80") {
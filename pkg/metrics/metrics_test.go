@@ -9,6 +9,24 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+func TestAddGauge(t *testing.T) {
+	m := AddGauge("example_metrics_gauge", "help")
+
+	expected := prometheus.NewDesc("example_metrics_gauge", "help", nil, nil)
+	if m.Desc().String() != expected.String() {
+		t.Fatalf("got %v, want %v", m.Desc(), expected)
+	}
+
+	metrics := &pcm.Metric{}
+
+	m.Set(1)
+	m.Write(metrics)
+
+	if metrics.Gauge.GetValue() != 1 {
+		t.Fatalf("got %v, want %v", metrics.Gauge.GetValue(), 1)
+	}
+}
+
 func TestAddGaugeVec(t *testing.T) {
 	tests := []struct {
 		Name            string
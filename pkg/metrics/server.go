@@ -1,17 +1,21 @@
 package metrics
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/upgrade"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Metrics struct {
 	*http.Server
+	listener net.Listener
 }
 
 func New(c config.HostConfig) *Metrics {
@@ -27,7 +31,7 @@ func New(c config.HostConfig) *Metrics {
 		WriteTimeout: 5 * time.Second,
 	}
 
-	return &Metrics{srv}
+	return &Metrics{Server: srv}
 }
 
 func (m *Metrics) Run() error {
@@ -37,3 +41,34 @@ func (m *Metrics) Run() error {
 
 	return nil
 }
+
+// Listen bind address of the metrics server, the listener passed by the
+// previous process on upgrade is used when it's available
+func (m *Metrics) Listen() (net.Listener, error) {
+	l, err := upgrade.Listener("tcp", m.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if l == nil {
+		l, err = net.Listen("tcp", m.Addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.listener = l
+
+	return l, nil
+}
+
+// ListenerFile returns copy of the listener file, so the listener can be
+// passed to the new process on upgrade
+func (m *Metrics) ListenerFile() (*upgrade.File, error) {
+	l, ok := m.listener.(upgrade.Filer)
+	if !ok {
+		return nil, errors.New("metrics listener is not created")
+	}
+
+	return upgrade.NewFile("tcp", m.Addr, l)
+}
@@ -32,3 +32,27 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestListen(t *testing.T) {
+	m := New(config.HostConfig{Host: "127.0.0.1", Port: "9128"})
+
+	if _, err := m.ListenerFile(); err == nil {
+		t.Fatalf("ListenerFile must return error before listen")
+	}
+
+	l, err := m.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := m.ListenerFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.File.Close()
+
+	if f.Address != "127.0.0.1:9128" {
+		t.Fatalf("got %v, want %v", f.Address, "127.0.0.1:9128")
+	}
+}
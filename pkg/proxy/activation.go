@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/nothinux/octo-proxy/pkg/upgrade"
+)
+
+const (
+	// listenFdsStart is the first file descriptor passed by systemd
+	listenFdsStart = 3
+
+	// activationNetwork is network name of activated socket passed to the
+	// new process on upgrade
+	activationNetwork = "systemd"
+)
+
+// activated hold sockets passed by systemd socket activation, keyed by the
+// FileDescriptorName of the socket. The sockets are kept open, so the
+// listener can be created again when the server is restarted on reload
+var activated struct {
+	sync.Mutex
+	loaded bool
+	files  map[string][]*os.File
+	err    error
+}
+
+func listenFds() (map[string][]*os.File, error) {
+	files := make(map[string][]*os.File)
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return files, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("LISTEN_FDS is not valid")
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// the sockets must not be inherited by the processes started by
+	// octo-proxy
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		// systemd use unknown when FileDescriptorName is not set
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		files[name] = append(files[name], os.NewFile(uintptr(fd), name))
+	}
+
+	return files, nil
+}
+
+// activatedFile returns the socket passed by systemd with the name. Socket
+// passed by the previous process on upgrade is kept with the sockets passed
+// by systemd, because systemd only pass the sockets to the first process
+func activatedFile(name string) (*os.File, error) {
+	activated.Lock()
+	defer activated.Unlock()
+
+	if !activated.loaded {
+		activated.files, activated.err = listenFds()
+		activated.loaded = true
+	}
+
+	if activated.err != nil {
+		return nil, activated.err
+	}
+
+	if f := upgrade.TakeFile(activationNetwork, name); f != nil {
+		activated.files[name] = []*os.File{f}
+	}
+
+	switch len(activated.files[name]) {
+	case 0:
+		return nil, fmt.Errorf("socket %s is not passed by systemd", name)
+	case 1:
+		return activated.files[name][0], nil
+	default:
+		return nil, fmt.Errorf("more than one socket named %s is passed by systemd", name)
+	}
+}
+
+// activatedListener returns listener of the socket passed by systemd
+func activatedListener(name string) (net.Listener, error) {
+	f, err := activatedFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.FileListener(f)
+}
+
+// activatedPacketConn returns udp listener of the socket passed by systemd
+func activatedPacketConn(name string) (net.PacketConn, error) {
+	f, err := activatedFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+	"github.com/nothinux/octo-proxy/pkg/upgrade"
+)
+
+// TestActivationHelper is run by systemd socket activation test as the
+// process started by systemd
+func TestActivationHelper(t *testing.T) {
+	target := os.Getenv("OCTO_ACTIVATION_TEST_TARGET")
+	if target == "" {
+		return
+	}
+
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{target}, "")
+	if err != nil {
+		os.Exit(1)
+	}
+
+	c := cfg.ServerConfigs[0]
+	c.Name = "web"
+	c.Listener = config.HostConfig{SocketActivation: true}
+
+	if os.Getenv("OCTO_ACTIVATION_TEST_UPGRADE") != "" {
+		upgradeHelper(c)
+		return
+	}
+
+	// systemd set LISTEN_PID to pid of the started process
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	p := New(c.Name)
+	if err := p.Run(c); err != nil {
+		os.Exit(2)
+	}
+}
+
+// upgradeHelper run as the process started by upgrade, the activated socket
+// is passed by the previous process. The server is started again like a
+// reload that changes the listener, before notifying the previous process
+func upgradeHelper(c config.ServerConfig) {
+	if err := upgrade.Init(); err != nil {
+		os.Exit(1)
+	}
+
+	old := New(c.Name)
+	if err := old.Listen(c); err != nil {
+		os.Exit(2)
+	}
+	go old.Serve()
+
+	c.Listener.TimeoutDuration = 10 * time.Second
+
+	p := New(c.Name)
+	if err := p.Listen(c); err != nil {
+		os.Exit(3)
+	}
+	old.Shutdown()
+
+	go p.Serve()
+
+	if err := upgrade.Ready(); err != nil {
+		os.Exit(4)
+	}
+
+	time.Sleep(10 * time.Second)
+}
+
+func TestSocketActivation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	start := func(t *testing.T, names string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=TestActivationHelper")
+		cmd.Env = append(os.Environ(),
+			"OCTO_ACTIVATION_TEST_TARGET="+testhelper.RunEchoServer(t),
+			"LISTEN_FDS=1",
+			"LISTEN_FDNAMES="+names,
+		)
+		cmd.ExtraFiles = []*os.File{f}
+
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		return cmd
+	}
+
+	t.Run("test listener use socket passed by systemd", func(t *testing.T) {
+		cmd := start(t, "web")
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+
+		// the socket is bound before the process is started, so the
+		// connection is queued until the proxy accepts it
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		echo(t, conn)
+	})
+
+	t.Run("test socket passed on upgrade can be used again", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		cmd := exec.Command(os.Args[0], "-test.run=TestActivationHelper")
+		cmd.Env = append(os.Environ(),
+			"OCTO_ACTIVATION_TEST_TARGET="+testhelper.RunEchoServer(t),
+			"OCTO_ACTIVATION_TEST_UPGRADE=1",
+			`OCTO_UPGRADE_LISTENERS=["systemd://web"]`,
+		)
+		cmd.ExtraFiles = []*os.File{w, f}
+
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+
+		r.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := r.Read(make([]byte, 1)); err != nil {
+			t.Fatalf("new process is not ready: %v", err)
+		}
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		echo(t, conn)
+	})
+
+	t.Run("test socket with other name is not used", func(t *testing.T) {
+		cmd := start(t, "other")
+
+		err := cmd.Wait()
+		if err == nil || !strings.Contains(err.Error(), "exit status 2") {
+			t.Fatalf("got %v, want exit status 2", err)
+		}
+	})
+}
+
+func TestListenFds(t *testing.T) {
+	t.Run("test sockets of other process are ignored", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", "1")
+		t.Setenv("LISTEN_FDS", "1")
+
+		files, err := listenFds()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != 0 {
+			t.Fatalf("got %v sockets, want %v", len(files), 0)
+		}
+	})
+
+	t.Run("test LISTEN_FDS is not valid", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		t.Setenv("LISTEN_FDS", "a")
+
+		if _, err := listenFds(); err == nil {
+			t.Fatalf("listenFds must return error")
+		}
+	})
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+)
+
+// Target hold target configuration and its runtime state
+type Target struct {
+	config.HostConfig
+	active    int64
+	unhealthy int32
+	probed    int32
+	outlier   outlierState
+}
+
+func newTargets(hcs []config.HostConfig) []*Target {
+	targets := make([]*Target, 0, len(hcs))
+
+	for _, hc := range hcs {
+		targets = append(targets, &Target{HostConfig: hc})
+	}
+
+	return targets
+}
+
+// targetPool hold targets of the previous configuration, so targets that
+// are not changed keep their runtime state
+type targetPool struct {
+	targets []*Target
+}
+
+func (p *targetPool) add(targets []*Target) {
+	p.targets = append(p.targets, targets...)
+}
+
+// take returns target from the pool that has the same configuration, or a
+// new target when there is none, every target can only be taken once
+func (p *targetPool) take(hcs []config.HostConfig) []*Target {
+	targets := make([]*Target, 0, len(hcs))
+
+	for _, hc := range hcs {
+		t := &Target{HostConfig: hc}
+
+		for i, pt := range p.targets {
+			if reflect.DeepEqual(pt.HostConfig, hc) {
+				t = pt
+				p.targets = append(p.targets[:i], p.targets[i+1:]...)
+				break
+			}
+		}
+
+		targets = append(targets, t)
+	}
+
+	return targets
+}
+
+func (t *Target) acquire() {
+	atomic.AddInt64(&t.active, 1)
+}
+
+func (t *Target) release() {
+	atomic.AddInt64(&t.active, -1)
+}
+
+func (t *Target) activeConn() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+func (t *Target) isHealthy() bool {
+	return atomic.LoadInt32(&t.unhealthy) == 0
+}
+
+func (t *Target) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&t.unhealthy, 0)
+	} else {
+		atomic.StoreInt32(&t.unhealthy, 1)
+	}
+}
+
+// isAvailable returns true if target can be picked by balancer
+func (t *Target) isAvailable() bool {
+	return t.isHealthy() && !t.isEjected()
+}
+
+// available returns targets that can be picked by balancer
+func available(targets []*Target) []*Target {
+	ts := make([]*Target, 0, len(targets))
+
+	for _, t := range targets {
+		if t.isAvailable() {
+			ts = append(ts, t)
+		}
+	}
+
+	return ts
+}
+
+func (t *Target) weight() int {
+	if t.Weight == 0 {
+		return 1
+	}
+
+	return t.Weight
+}
+
+// Balancer decide which targets will be used for every new connection
+type Balancer interface {
+	// Next returns available targets ordered by priority, the first target
+	// is the preferred one and the rest are used as fallback when dial failed
+	Next() []*Target
+	// Targets returns all targets owned by the balancer
+	Targets() []*Target
+}
+
+// newBalancer returns balancer for the given policy, round robin is used
+// when policy is not set
+func newBalancer(policy string, hcs []config.HostConfig) Balancer {
+	return newBalancerWithTargets(policy, newTargets(hcs))
+}
+
+func newBalancerWithTargets(policy string, targets []*Target) Balancer {
+	switch policy {
+	case config.LoadBalancerLeastConnections:
+		return &leastConnections{targets: targets}
+	case config.LoadBalancerRandomTwoChoices:
+		return &randomTwoChoices{targets: targets}
+	case config.LoadBalancerWeighted:
+		return &weighted{targets: targets, current: make([]int, len(targets))}
+	default:
+		return &roundRobin{targets: targets}
+	}
+}
+
+// rotate returns copy of targets that start from index n
+func rotate(targets []*Target, n int) []*Target {
+	ts := make([]*Target, 0, len(targets))
+	ts = append(ts, targets[n:]...)
+	ts = append(ts, targets[:n]...)
+
+	return ts
+}
+
+type roundRobin struct {
+	targets []*Target
+	next    uint64
+}
+
+func (b *roundRobin) Next() []*Target {
+	targets := available(b.targets)
+	if len(targets) == 0 {
+		return nil
+	}
+
+	n := atomic.AddUint64(&b.next, 1) - 1
+
+	return rotate(targets, int(n%uint64(len(targets))))
+}
+
+func (b *roundRobin) Targets() []*Target {
+	return b.targets
+}
+
+type leastConnections struct {
+	targets []*Target
+	next    uint64
+}
+
+func (b *leastConnections) Next() []*Target {
+	targets := available(b.targets)
+	if len(targets) == 0 {
+		return nil
+	}
+
+	// rotate the targets first, so targets with same active connection
+	// are picked in round robin order
+	n := atomic.AddUint64(&b.next, 1) - 1
+	ts := rotate(targets, int(n%uint64(len(targets))))
+
+	sort.SliceStable(ts, func(i, j int) bool {
+		return ts[i].activeConn() < ts[j].activeConn()
+	})
+
+	return ts
+}
+
+func (b *leastConnections) Targets() []*Target {
+	return b.targets
+}
+
+type randomTwoChoices struct {
+	targets []*Target
+}
+
+func (b *randomTwoChoices) Next() []*Target {
+	targets := available(b.targets)
+
+	ts := make([]*Target, 0, len(targets))
+	for _, i := range rand.Perm(len(targets)) {
+		ts = append(ts, targets[i])
+	}
+
+	// compare the first two random targets and prefer the one that has
+	// less active connection
+	if len(ts) > 1 && ts[1].activeConn() < ts[0].activeConn() {
+		ts[0], ts[1] = ts[1], ts[0]
+	}
+
+	return ts
+}
+
+func (b *randomTwoChoices) Targets() []*Target {
+	return b.targets
+}
+
+// weighted implement smooth weighted round robin
+type weighted struct {
+	sync.Mutex
+	targets []*Target
+	current []int
+}
+
+func (b *weighted) Next() []*Target {
+	b.Lock()
+	total, selected := 0, -1
+	for i, t := range b.targets {
+		if !t.isAvailable() {
+			continue
+		}
+
+		b.current[i] += t.weight()
+		total += t.weight()
+
+		if selected == -1 || b.current[i] > b.current[selected] {
+			selected = i
+		}
+	}
+
+	if selected == -1 {
+		b.Unlock()
+		return nil
+	}
+	b.current[selected] -= total
+	b.Unlock()
+
+	ts := make([]*Target, 0, len(b.targets))
+	ts = append(ts, b.targets[selected])
+
+	// use the rest of available targets as fallback ordered by their weight
+	rest := make([]*Target, 0, len(b.targets)-1)
+	for i, t := range b.targets {
+		if i != selected && t.isAvailable() {
+			rest = append(rest, t)
+		}
+	}
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[i].weight() > rest[j].weight()
+	})
+
+	return append(ts, rest...)
+}
+
+func (b *weighted) Targets() []*Target {
+	return b.targets
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+)
+
+var balancerTargets = []config.HostConfig{
+	{Host: "127.0.0.1", Port: "8001"},
+	{Host: "127.0.0.1", Port: "8002"},
+	{Host: "127.0.0.1", Port: "8003"},
+}
+
+func TestNewBalancer(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Policy   string
+		Expected string
+	}{
+		{
+			Name:     "Test default policy",
+			Policy:   "",
+			Expected: "*proxy.roundRobin",
+		},
+		{
+			Name:     "Test round robin policy",
+			Policy:   config.LoadBalancerRoundRobin,
+			Expected: "*proxy.roundRobin",
+		},
+		{
+			Name:     "Test least connections policy",
+			Policy:   config.LoadBalancerLeastConnections,
+			Expected: "*proxy.leastConnections",
+		},
+		{
+			Name:     "Test random two choices policy",
+			Policy:   config.LoadBalancerRandomTwoChoices,
+			Expected: "*proxy.randomTwoChoices",
+		},
+		{
+			Name:     "Test weighted policy",
+			Policy:   config.LoadBalancerWeighted,
+			Expected: "*proxy.weighted",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			b := newBalancer(tt.Policy, balancerTargets)
+
+			if got := fmt.Sprintf("%T", b); got != tt.Expected {
+				t.Fatalf("got %v, want %v", got, tt.Expected)
+			}
+
+			if len(b.Next()) != len(balancerTargets) {
+				t.Fatalf("got %v, want %v", len(b.Next()), len(balancerTargets))
+			}
+		})
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	b := newBalancer(config.LoadBalancerRoundRobin, balancerTargets)
+
+	for i := 0; i < 6; i++ {
+		ts := b.Next()
+
+		want := balancerTargets[i%len(balancerTargets)].Port
+		if ts[0].Port != want {
+			t.Fatalf("got %v, want %v", ts[0].Port, want)
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	b := newBalancer(config.LoadBalancerLeastConnections, balancerTargets)
+
+	b.Targets()[0].acquire()
+	b.Targets()[0].acquire()
+	b.Targets()[2].acquire()
+
+	for i := 0; i < 3; i++ {
+		ts := b.Next()
+		if ts[0].Port != "8002" {
+			t.Fatalf("got %v, want 8002", ts[0].Port)
+		}
+
+		if ts[2].Port != "8001" {
+			t.Fatalf("got %v, want 8001", ts[2].Port)
+		}
+	}
+}
+
+func TestRandomTwoChoices(t *testing.T) {
+	b := newBalancer(config.LoadBalancerRandomTwoChoices, balancerTargets[:2])
+
+	b.Targets()[0].acquire()
+
+	for i := 0; i < 10; i++ {
+		ts := b.Next()
+		if ts[0].Port != "8002" {
+			t.Fatalf("got %v, want 8002", ts[0].Port)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	hcs := []config.HostConfig{
+		{Host: "127.0.0.1", Port: "8001", Weight: 5},
+		{Host: "127.0.0.1", Port: "8002", Weight: 1},
+		{Host: "127.0.0.1", Port: "8003"},
+	}
+
+	b := newBalancer(config.LoadBalancerWeighted, hcs)
+
+	picked := map[string]int{}
+	for i := 0; i < 70; i++ {
+		ts := b.Next()
+		picked[ts[0].Port]++
+
+		if len(ts) != len(hcs) {
+			t.Fatalf("got %v, want %v", len(ts), len(hcs))
+		}
+	}
+
+	expected := map[string]int{"8001": 50, "8002": 10, "8003": 10}
+	for port, n := range expected {
+		if picked[port] != n {
+			t.Fatalf("got %v, want %v for target %s", picked[port], n, port)
+		}
+	}
+}
+
+func TestTargetPool(t *testing.T) {
+	prev := newTargets(balancerTargets)
+	prev[0].setHealthy(false)
+	prev[1].acquire()
+
+	pool := &targetPool{}
+	pool.add(prev)
+
+	targets := pool.take([]config.HostConfig{
+		balancerTargets[1],
+		balancerTargets[0],
+		balancerTargets[0],
+		{Host: "127.0.0.1", Port: "8004"},
+	})
+
+	t.Run("test unchanged target is reused", func(t *testing.T) {
+		if targets[0] != prev[1] || targets[0].activeConn() != 1 {
+			t.Fatalf("target %s must be reused", targets[0].Address())
+		}
+
+		if targets[1] != prev[0] || targets[1].isHealthy() {
+			t.Fatalf("target %s must be reused", targets[1].Address())
+		}
+	})
+
+	t.Run("test target is only reused once", func(t *testing.T) {
+		if targets[2] == prev[0] || !targets[2].isHealthy() {
+			t.Fatalf("duplicate target must be a new target")
+		}
+	})
+
+	t.Run("test new target is created", func(t *testing.T) {
+		if targets[3].Address() != "127.0.0.1:8004" {
+			t.Fatalf("got %v, want %v", targets[3].Address(), "127.0.0.1:8004")
+		}
+	})
+}
+
+func TestDialTargetsAcquire(t *testing.T) {
+	up := testhelper.RunServer(t, func(c net.Conn) {
+		c.Close()
+	})
+
+	// closed listener, so dialing the target is failed
+	down, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	hcs := []config.HostConfig{}
+	for _, addr := range []string{down.Addr().String(), up} {
+		host, port, _ := net.SplitHostPort(addr)
+		hcs = append(hcs, config.HostConfig{Host: host, Port: port})
+	}
+
+	c := config.ServerConfig{
+		LoadBalancer: config.LoadBalancerLeastConnections,
+		Targets:      hcs,
+	}
+	g := newTargetGroup(c, newTargets(c.Targets))
+
+	conn, tc, err := g.dialTargets(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ts := g.balancer.Targets()
+
+	t.Run("test reached target is acquired", func(t *testing.T) {
+		if tc != ts[1] {
+			t.Fatalf("got %v, want %v", tc.Address(), ts[1].Address())
+		}
+
+		if got := ts[1].activeConn(); got != 1 {
+			t.Fatalf("got %v, want %v", got, 1)
+		}
+	})
+
+	t.Run("test failed target is released", func(t *testing.T) {
+		if got := ts[0].activeConn(); got != 0 {
+			t.Fatalf("got %v, want %v", got, 0)
+		}
+	})
+}
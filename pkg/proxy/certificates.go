@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+)
+
+// certStore select listener certificate by the tls server name sent by the
+// client, exact match is preferred over wildcard match
+type certStore struct {
+	exact    map[string]*tls.Certificate
+	wildcard map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// newCertStore load all certificates, fallback is used when server name
+// doesn't match any certificate, when fallback is nil the first certificate
+// is used
+func newCertStore(certs []config.CertificateConfig, fallback *tls.Certificate) (*certStore, error) {
+	s := &certStore{
+		exact:    make(map[string]*tls.Certificate),
+		wildcard: make(map[string]*tls.Certificate),
+		fallback: fallback,
+	}
+
+	for _, cc := range certs {
+		pair, err := getCertKeyPair(config.TLSConfig{Cert: cc.Cert, Key: cc.Key})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sni := range cc.SNI {
+			if strings.HasPrefix(sni, "*.") {
+				s.wildcard[sni[2:]] = &pair
+				continue
+			}
+
+			s.exact[sni] = &pair
+		}
+
+		if s.fallback == nil {
+			s.fallback = &pair
+		}
+	}
+
+	return s, nil
+}
+
+func (s *certStore) getCertificate(h *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.TrimSuffix(strings.ToLower(h.ServerName), ".")
+
+	if cert, ok := s.exact[serverName]; ok {
+		return cert, nil
+	}
+
+	if i := strings.Index(serverName, "."); i > 0 {
+		if cert, ok := s.wildcard[serverName[i+1:]]; ok {
+			return cert, nil
+		}
+	}
+
+	if s.fallback == nil {
+		return nil, fmt.Errorf("no certificate for server name %s", h.ServerName)
+	}
+
+	return s.fallback, nil
+}
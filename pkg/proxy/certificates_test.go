@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+)
+
+func TestCertStore(t *testing.T) {
+	fallback, err := getCertKeyPair(config.TLSConfig{
+		Cert: "../testdata/localhost.pem",
+		Key:  "../testdata/localhost-key.pem",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := []config.CertificateConfig{
+		{
+			SNI:  []string{"cert"},
+			Cert: "../testdata/cert.pem",
+			Key:  "../testdata/cert-key.pem",
+		},
+		{
+			SNI:  []string{"*.example.com"},
+			Cert: "../testdata/client.pem",
+			Key:  "../testdata/client-key.pem",
+		},
+	}
+
+	store, err := newCertStore(certs, &fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name       string
+		ServerName string
+		Expected   string
+	}{
+		{
+			Name:       "test exact match",
+			ServerName: "CERT",
+			Expected:   "../testdata/cert.pem",
+		},
+		{
+			Name:       "test wildcard match",
+			ServerName: "api.example.com",
+			Expected:   "../testdata/client.pem",
+		},
+		{
+			Name:       "test wildcard doesn't match multiple label",
+			ServerName: "v1.api.example.com",
+			Expected:   "../testdata/localhost.pem",
+		},
+		{
+			Name:       "test default certificate",
+			ServerName: "",
+			Expected:   "../testdata/localhost.pem",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			cert, err := store.getCertificate(&tls.ClientHelloInfo{ServerName: tt.ServerName})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(cert.Certificate[0], readCertificate(t, tt.Expected).Raw) {
+				t.Fatalf("got wrong certificate, want %s", tt.Expected)
+			}
+		})
+	}
+
+	t.Run("test first certificate used as default", func(t *testing.T) {
+		store, err := newCertStore(certs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, err := store.getCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(cert.Certificate[0], readCertificate(t, "../testdata/cert.pem").Raw) {
+			t.Fatalf("got wrong certificate, want %s", "../testdata/cert.pem")
+		}
+	})
+
+	t.Run("test certificate not found", func(t *testing.T) {
+		_, err := newCertStore([]config.CertificateConfig{
+			{
+				SNI:  []string{"cert"},
+				Cert: "../testdata/cert.pem",
+				Key:  "../testdata/file",
+			},
+		}, nil)
+		if err == nil {
+			t.Fatalf("newCertStore must return error")
+		}
+	})
+}
+
+func TestGetTLSConfigWithCertificates(t *testing.T) {
+	ptls, err := getTLSConfig(config.TLSConfig{
+		Mode: "simple",
+		Cert: "../testdata/localhost.pem",
+		Key:  "../testdata/localhost-key.pem",
+		Certificates: []config.CertificateConfig{
+			{
+				SNI:  []string{"cert"},
+				Cert: "../testdata/cert.pem",
+				Key:  "../testdata/cert-key.pem",
+			},
+			{
+				SNI:  []string{"client"},
+				Cert: "../testdata/client.pem",
+				Key:  "../testdata/client-key.pem",
+			},
+		},
+		Role: config.Role{Server: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := testhelper.RunTLSServer(t, ptls.Config, tlsHandshake)
+
+	ca, err := os.ReadFile("../testdata/ca-cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	// handshake only succeed when certificate for the server name is used
+	for _, serverName := range []string{"cert", "client", "localhost"} {
+		t.Run("test handshake with server name "+serverName, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{
+				ServerName: serverName,
+				RootCAs:    pool,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		})
+	}
+}
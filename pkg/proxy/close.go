@@ -1,8 +1,8 @@
 package proxy
 
-import "net"
+import "io"
 
-func closeConn(conn []net.Conn) {
+func closeConn(conn []io.Closer) {
 	for i := 0; i < len(conn); i++ {
 		if conn[i] != nil {
 			conn[i].Close()
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	mirrorCompared   = metrics.AddCounterVecMultiLabels("octo_mirror_response_compared_total", "total mirror response compared with target response")
+	mirrorMismatch   = metrics.AddCounterVecMultiLabels("octo_mirror_response_mismatch_total", "total mirror response that doesn't match target response")
+	mirrorIncomplete = metrics.AddCounterVecMultiLabels("octo_mirror_response_incomplete_total", "total mirror response not compared because the mirror didn't receive the whole request")
+)
+
+// responseCapture capture response stream up to the limit, it keeps counting
+// the size of the stream after the limit is reached
+type responseCapture struct {
+	sync.Mutex
+	buf   []byte
+	limit int
+	size  int64
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newResponseCapture(limit int) *responseCapture {
+	return &responseCapture{
+		limit: limit,
+		done:  make(chan struct{}),
+	}
+}
+
+// newPrimaryCapture returns capture for target response if at least one of
+// the mirrors is running in compare mode, otherwise returns nil
+func newPrimaryCapture(mirrors []config.MirrorConfig) *responseCapture {
+	limit := 0
+	for _, mc := range mirrors {
+		if mc.IsCompare() && mc.CompareBytes > limit {
+			limit = mc.CompareBytes
+		}
+	}
+
+	if limit == 0 {
+		return nil
+	}
+
+	return newResponseCapture(limit)
+}
+
+// Write capture data, it never returns error
+func (r *responseCapture) Write(b []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.size += int64(len(b))
+
+	if remaining := r.limit - len(r.buf); remaining > 0 {
+		if len(b) > remaining {
+			r.buf = append(r.buf, b[:remaining]...)
+		} else {
+			r.buf = append(r.buf, b...)
+		}
+	}
+
+	return len(b), nil
+}
+
+// finish mark the response stream as complete
+func (r *responseCapture) finish() {
+	if r == nil {
+		return
+	}
+
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
+
+// wait until the response stream is complete or timeout is reached
+func (r *responseCapture) wait(timeout time.Duration) bool {
+	select {
+	case <-r.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// captured returns captured data up to n bytes and total size of the stream
+func (r *responseCapture) captured(n int) ([]byte, int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.buf) < n {
+		n = len(r.buf)
+	}
+
+	return r.buf[:n], r.size
+}
+
+// compareResponse compare target and mirror response up to compareBytes of
+// the mirror and report the result
+func compareResponse(id uint64, mc config.MirrorConfig, primary, mirror *responseCapture) {
+	if !primary.wait(mirrorFlushTimeout) {
+		log.Debug().
+			Uint64("conn_id", id).
+			Str("host", mc.Host).
+			Str("port", mc.Port).
+			Msg("target response is not complete, skip comparing mirror response")
+		return
+	}
+
+	p, pSize := primary.captured(mc.CompareBytes)
+	m, mSize := mirror.captured(mc.CompareBytes)
+
+	mirrorCompared.With(prometheus.Labels{"host": mc.Host, "port": mc.Port}).Inc()
+
+	offset := firstDiff(p, m)
+	if offset == -1 && pSize == mSize {
+		return
+	}
+
+	mirrorMismatch.With(prometheus.Labels{"host": mc.Host, "port": mc.Port}).Inc()
+
+	log.Warn().
+		Uint64("conn_id", id).
+		Str("host", mc.Host).
+		Str("port", mc.Port).
+		Int64("target_bytes", pSize).
+		Int64("mirror_bytes", mSize).
+		Int("offset", offset).
+		Msg("mirror response doesn't match target response")
+}
+
+// firstDiff returns offset of the first different byte, -1 if a and b are equal
+func firstDiff(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFirstDiff(t *testing.T) {
+	tests := []struct {
+		Name     string
+		A        []byte
+		B        []byte
+		Expected int
+	}{
+		{
+			Name:     "Test equal data",
+			A:        []byte("hello"),
+			B:        []byte("hello"),
+			Expected: -1,
+		},
+		{
+			Name:     "Test different data",
+			A:        []byte("hello"),
+			B:        []byte("hallo"),
+			Expected: 1,
+		},
+		{
+			Name:     "Test shorter data",
+			A:        []byte("hello"),
+			B:        []byte("hel"),
+			Expected: 3,
+		},
+		{
+			Name:     "Test empty data",
+			A:        []byte{},
+			B:        []byte("hello"),
+			Expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			if got := firstDiff(tt.A, tt.B); got != tt.Expected {
+				t.Fatalf("got %v, want %v", got, tt.Expected)
+			}
+		})
+	}
+}
+
+func TestResponseCapture(t *testing.T) {
+	r := newResponseCapture(4)
+	r.Write([]byte("hel"))
+	r.Write([]byte("lo"))
+	r.Write([]byte("world"))
+
+	b, size := r.captured(10)
+	if !bytes.Equal(b, []byte("hell")) {
+		t.Fatalf("got %v, want %v", b, []byte("hell"))
+	}
+
+	if size != 10 {
+		t.Fatalf("got %v, want %v", size, 10)
+	}
+
+	if r.wait(10 * time.Millisecond) {
+		t.Fatalf("capture must not be finished")
+	}
+
+	r.finish()
+	r.finish()
+
+	if !r.wait(10 * time.Millisecond) {
+		t.Fatalf("capture must be finished")
+	}
+}
+
+func TestNewPrimaryCapture(t *testing.T) {
+	mirrors := []config.MirrorConfig{
+		{Mode: config.MirrorModeCompare, CompareBytes: 10},
+		{CompareBytes: 100},
+		{Mode: config.MirrorModeCompare, CompareBytes: 20},
+	}
+
+	r := newPrimaryCapture(mirrors)
+	if r == nil || r.limit != 20 {
+		t.Fatalf("capture limit must be 20")
+	}
+
+	if newPrimaryCapture(mirrors[1:2]) != nil {
+		t.Fatalf("capture must be nil without mirror in compare mode")
+	}
+
+	t.Run("test capture is nil when compare mirror is not sampled", func(t *testing.T) {
+		c := config.ServerConfig{
+			Mirrors: []config.MirrorConfig{
+				{Percentage: 100},
+				{Mode: config.MirrorModeCompare, CompareBytes: 10, Percentage: 0},
+			},
+		}
+
+		sampled := sampleMirrors(c)
+		if len(sampled) != 1 {
+			t.Fatalf("got %v mirrors, want %v", len(sampled), 1)
+		}
+
+		if newPrimaryCapture(sampled) != nil {
+			t.Fatalf("capture must be nil")
+		}
+	})
+}
+
+func TestProxyWithCompareMirror(t *testing.T) {
+	var wg sync.WaitGroup
+
+	backend := testhelper.RunTestServerWithReply(&wg, []byte("hello"))
+	mirror := testhelper.RunTestServerWithReply(&wg, []byte("hello"))
+	diffMirror := testhelper.RunTestServerWithReply(&wg, []byte("hallo"))
+
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{backend}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mirrorLabels := prometheus.Labels{
+		"host": strings.Split(mirror, ":")[0],
+		"port": strings.Split(mirror, ":")[1],
+	}
+	diffMirrorLabels := prometheus.Labels{
+		"host": strings.Split(diffMirror, ":")[0],
+		"port": strings.Split(diffMirror, ":")[1],
+	}
+
+	cfg.ServerConfigs[0].Mirrors = []config.MirrorConfig{
+		{
+			HostConfig:   config.HostConfig{Host: mirrorLabels["host"], Port: mirrorLabels["port"]},
+			Percentage:   100,
+			Mode:         config.MirrorModeCompare,
+			CompareBytes: 4096,
+		},
+		{
+			HostConfig:   config.HostConfig{Host: diffMirrorLabels["host"], Port: diffMirrorLabels["port"]},
+			Percentage:   100,
+			Mode:         config.MirrorModeCompare,
+			CompareBytes: 4096,
+		},
+	}
+
+	p := New("test-proxy")
+	go func() {
+		p.Run(cfg.ServerConfigs[0])
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	if err := SendData(cfg.ServerConfigs[0].Listener, messageByte, true); err != nil {
+		t.Fatal(err)
+	}
+
+	waitCompared := func(labels prometheus.Labels) {
+		for i := 0; i < 50; i++ {
+			if testutil.ToFloat64(mirrorCompared.With(labels)) > 0 {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("mirror response must be compared")
+	}
+
+	t.Run("test same mirror response is not reported", func(t *testing.T) {
+		waitCompared(mirrorLabels)
+
+		if got := testutil.ToFloat64(mirrorMismatch.With(mirrorLabels)); got != 0 {
+			t.Fatalf("got %v, want %v", got, 0)
+		}
+	})
+
+	t.Run("test different mirror response is reported", func(t *testing.T) {
+		waitCompared(diffMirrorLabels)
+
+		if got := testutil.ToFloat64(mirrorMismatch.With(diffMirrorLabels)); got != 1 {
+			t.Fatalf("got %v, want %v", got, 1)
+		}
+	})
+
+	p.Shutdown()
+	wg.Wait()
+}
+
+func TestCompareMirrorIncompleteRequest(t *testing.T) {
+	run := func(t *testing.T, mc config.MirrorConfig, size int, chunks int) prometheus.Labels {
+		// mirror is stalled until the whole request is sent, then it
+		// replies with a response that differs from the target response
+		addr := testhelper.RunServer(t, func(c net.Conn) {
+			defer c.Close()
+			time.Sleep(500 * time.Millisecond)
+			io.Copy(io.Discard, c)
+			c.Write([]byte("hallo"))
+		})
+
+		host, port, _ := net.SplitHostPort(addr)
+		mc.HostConfig = config.HostConfig{Host: host, Port: port}
+		mc.Mode = config.MirrorModeCompare
+		mc.CompareBytes = 4096
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		primary := newResponseCapture(4096)
+		primary.Write([]byte("hello"))
+		primary.finish()
+
+		m := newCompareMirrorWriter(dialConn(conn), mc, size, 1, primary)
+
+		chunk := make([]byte, 64*1024)
+		for i := 0; i < chunks; i++ {
+			m.Write(chunk)
+		}
+		m.Close()
+
+		return prometheus.Labels{"host": host, "port": port}
+	}
+
+	wait := func(t *testing.T, labels prometheus.Labels) {
+		for i := 0; i < 50; i++ {
+			if testutil.ToFloat64(mirrorIncomplete.With(labels)) > 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if got := testutil.ToFloat64(mirrorIncomplete.With(labels)); got != 1 {
+			t.Fatalf("got %v, want %v", got, 1)
+		}
+
+		if got := testutil.ToFloat64(mirrorMismatch.With(labels)); got != 0 {
+			t.Fatalf("got %v mismatch, want %v", got, 0)
+		}
+	}
+
+	t.Run("test stalled mirror with dropped data is not compared", func(t *testing.T) {
+		labels := run(t, config.MirrorConfig{}, 1, 512)
+		wait(t, labels)
+	})
+
+	t.Run("test mirror capped by max bytes is not compared", func(t *testing.T) {
+		labels := run(t, config.MirrorConfig{MaxBytes: 1024}, mirrorBufferSize, 2)
+		wait(t, labels)
+	})
+}
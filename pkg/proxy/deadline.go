@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+)
+
+// idleConn extend connection deadline on every read and write, so the
+// connection is only closed when it is idle longer than idle timeout or
+// when it reach the absolute deadline set by timeout
+type idleConn struct {
+	net.Conn
+	idle     time.Duration
+	deadline time.Time
+}
+
+// setDeadline set connection deadline based on the connection config, the
+// connection is wrapped with idleConn when idle timeout is configured
+func setDeadline(conn net.Conn, cc config.ConnectionConfig) net.Conn {
+	var deadline time.Time
+	if cc.TimeoutDuration != 0 {
+		deadline = time.Now().Add(cc.TimeoutDuration)
+	}
+
+	if cc.IdleTimeoutDuration == 0 {
+		if !deadline.IsZero() {
+			conn.SetDeadline(deadline)
+		}
+		return conn
+	}
+
+	ic := &idleConn{
+		Conn:     conn,
+		idle:     cc.IdleTimeoutDuration,
+		deadline: deadline,
+	}
+	ic.extend()
+
+	return ic
+}
+
+func (c *idleConn) extend() {
+	d := time.Now().Add(c.idle)
+	if !c.deadline.IsZero() && c.deadline.Before(d) {
+		d = c.deadline
+	}
+
+	c.Conn.SetDeadline(d)
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.extend()
+	}
+
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.extend()
+	}
+
+	return n, err
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+)
+
+func TestSetDeadline(t *testing.T) {
+	t.Run("test connection is not wrapped without idle timeout", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		conn := setDeadline(c1, config.ConnectionConfig{TimeoutDuration: time.Second})
+		if _, ok := conn.(*idleConn); ok {
+			t.Fatalf("connection must not be wrapped")
+		}
+	})
+
+	t.Run("test idle timeout is extended on activity", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		conn := setDeadline(c1, config.ConnectionConfig{IdleTimeoutDuration: 200 * time.Millisecond})
+
+		go func() {
+			for i := 0; i < 5; i++ {
+				time.Sleep(100 * time.Millisecond)
+				c2.Write([]byte("a"))
+			}
+		}()
+
+		buf := make([]byte, 1)
+		for i := 0; i < 5; i++ {
+			if _, err := conn.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err := conn.Read(buf)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("got %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	})
+
+	t.Run("test idle timeout can't exceed timeout", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		conn := setDeadline(c1, config.ConnectionConfig{
+			TimeoutDuration:     250 * time.Millisecond,
+			IdleTimeoutDuration: 200 * time.Millisecond,
+		})
+
+		go func() {
+			for i := 0; i < 5; i++ {
+				time.Sleep(100 * time.Millisecond)
+				c2.Write([]byte("a"))
+			}
+		}()
+
+		buf := make([]byte, 1)
+		var err error
+		for i := 0; i < 5; i++ {
+			if _, err = conn.Read(buf); err != nil {
+				break
+			}
+		}
+
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("got %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	})
+}
+
+func TestNewDial(t *testing.T) {
+	d := newDial(config.ConnectionConfig{})
+	if d.Timeout != defaultConnectTimeout {
+		t.Fatalf("got %v, want %v", d.Timeout, defaultConnectTimeout)
+	}
+
+	d = newDial(config.ConnectionConfig{ConnectTimeoutDuration: time.Second})
+	if d.Timeout != time.Second {
+		t.Fatalf("got %v, want %v", d.Timeout, time.Second)
+	}
+}
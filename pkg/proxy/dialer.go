@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"crypto/tls"
+	goerrors "errors"
 	"io"
 	"math/rand"
 	"net"
@@ -19,87 +20,224 @@ import (
 var (
 	upstreamDialErr = metrics.AddCounterVecMultiLabels("octo_upstream_dial_error", "total dial error when calling an upstream")
 	mirrorDialErr   = metrics.AddCounterVecMultiLabels("octo_mirror_dial_error", "total dial error when calling an mirror upstream")
+
+	upstreamSANReject = metrics.AddCounterVecMultiLabels("octo_upstream_san_rejected_total", "total upstream connection rejected because server certificate doesn't match subjectAltNames")
+	upstreamNoTarget  = metrics.AddCounterVec("octo_upstream_no_available_targets_total", "total connection that can't be forwarded because every target is unhealthy or ejected")
 )
 
-func newDial() *net.Dialer {
+// errNoAvailableTargets is returned when every target is unhealthy or ejected
+var errNoAvailableTargets = errors.New("targets", "no available targets")
+
+// defaultConnectTimeout is used when connect timeout is not configured
+const defaultConnectTimeout = 5 * time.Second
+
+func newDial(cc config.ConnectionConfig) *net.Dialer {
+	timeout := cc.ConnectTimeoutDuration
+	if timeout == 0 {
+		timeout = defaultConnectTimeout
+	}
+
 	return &net.Dialer{
-		Timeout: 5 * time.Second,
+		Timeout: timeout,
 	}
 }
 
 func dialTarget(hc config.HostConfig) (net.Conn, error) {
-	d := newDial()
+	return dialTargetWithHeader(hc, nil)
+}
+
+// dialTargetWithHeader dial target and send PROXY protocol header with the
+// downstream client information when it is configured in the target
+func dialTargetWithHeader(hc config.HostConfig, h *proxyHeader) (net.Conn, error) {
+	conn, err := dialHost(hc, h)
+	if goerrors.Is(err, errSANNotAllowed) {
+		upstreamSANReject.With(prometheus.Labels{"host": hc.Host, "port": hc.Port}).Inc()
+	}
+
+	return conn, err
+}
+
+func dialHost(hc config.HostConfig, h *proxyHeader) (net.Conn, error) {
+	d := newDial(hc.ConnectionConfig)
+
+	var tlsConf *tls.Config
 
 	if hc.IsSimple() || hc.IsMutual() {
-		tlsConf, err := getTLSConfig(hc.TLSConfig)
+		ptls, err := getTLSConfig(hc.TLSConfig)
 		if err != nil {
 			return nil, err
 		}
+		tlsConf = ptls.Config
+
+		if !hc.TLSConfig.SessionTicket.Disabled {
+			tlsConf.ClientSessionCache = clientSessionCache(hc)
+		}
 
 		log.Debug().
 			Str("host", hc.Host).
 			Str("port", hc.Port).
 			Msg("called tls target")
+	}
 
-		return tls.DialWithDialer(d, "tcp", net.JoinHostPort(hc.Host, hc.Port), tlsConf.Config)
+	if hc.ProxyProtocol.Version != "" {
+		return dialWithProxyHeader(d, hc, tlsConf, h.encode(hc.ProxyProtocol.Version))
 	}
 
-	return d.Dial("tcp", net.JoinHostPort(hc.Host, hc.Port))
+	if tlsConf != nil {
+		return tls.DialWithDialer(d, hc.Network(), hc.Address(), tlsConf)
+	}
+
+	return d.Dial(hc.Network(), hc.Address())
 }
 
-func dialTargets(hcs []config.HostConfig) (net.Conn, config.HostConfig, error) {
-	tConf := &config.HostConfig{}
+// dialWithProxyHeader write PROXY protocol header right after the connection
+// is established, tls handshake is done after the header is sent
+func dialWithProxyHeader(d *net.Dialer, hc config.HostConfig, tlsConf *tls.Config, header []byte) (net.Conn, error) {
+	conn, err := d.Dial(hc.Network(), hc.Address())
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Timeout != 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if tlsConf != nil {
+		if tlsConf.ServerName == "" && !hc.IsUnix() {
+			tlsConf = tlsConf.Clone()
+			tlsConf.ServerName = hc.Host
+		}
+
+		tc := tls.Client(conn, tlsConf)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
 
-	for _, hc := range hcs {
-		*tConf = hc
-		c, err := dialTarget(hc)
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// dialTargets dial target picked by the load balancer, the next target is
+// tried when dial is failed. The target is acquired while it's dialed, so
+// connections picked concurrently see the pending connection, the returned
+// target must be released by the caller
+func (g *targetGroup) dialTargets(h *proxyHeader) (net.Conn, *Target, error) {
+	targets := g.balancer.Next()
+	if len(targets) == 0 {
+		return nil, nil, errNoAvailableTargets
+	}
+
+	var tConf *Target
+
+	for _, target := range targets {
+		tConf = target
+		target.acquire()
+		c, err := dialTargetWithHeader(target.HostConfig, h)
 		if err == nil {
-			if !timeoutIsZero(hc) {
-				c.SetDeadline(time.Now().Add(hc.TimeoutDuration))
-			}
-			return c, *tConf, nil
+			return setDeadline(c, target.ConnectionConfig), tConf, nil
 		}
-		log.Debug().Msgf("[targets] [%s:%s] dial error %v", hc.Host, hc.Port, err)
+		target.release()
+		g.outlier.failure(target)
+		log.Debug().Msgf("[targets] [%s:%s] dial error %v", target.Host, target.Port, err)
 	}
 
-	return nil, *tConf, errors.New("targets", "no backends could be reached")
+	return nil, tConf, errors.New("targets", "no backends could be reached")
 }
 
-func getTargets(c config.ServerConfig) ([]net.Conn, io.Writer, config.HostConfig, error) {
-	targets := c.Targets
+// countDialError count dial error under the last target that was tried, or
+// under the server when no target is available
+func countDialError(name string, tc *Target, err error) {
+	if goerrors.Is(err, errNoAvailableTargets) {
+		upstreamNoTarget.With(prometheus.Labels{"name": name}).Inc()
+		return
+	}
 
-	rand.Shuffle(len(targets), func(i, j int) {
-		targets[i], targets[j] = targets[j], targets[i]
-	})
+	upstreamDialErr.With(prometheus.Labels{"host": tc.Host, "port": tc.Port}).Inc()
+}
 
-	t, tc, err := dialTargets(targets)
+// getTargets dial target and start the sampled mirrors, mirrors are dialed in
+// the background so the target connection never waits for them. The response
+// of mirrors in compare mode is compared with the target response captured in
+// primary
+func (p *Proxy) getTargets(c config.ServerConfig, g *targetGroup, h *proxyHeader, id uint64, mirrors []config.MirrorConfig, primary *responseCapture) ([]io.Closer, io.Writer, *Target, error) {
+	t, tc, err := g.dialTargets(h)
 	if err != nil {
-		upstreamDialErr.With(prometheus.Labels{"host": tc.Host, "port": tc.Port}).Inc()
-		return nil, nil, config.HostConfig{}, errors.New(c.Name, err.Error())
+		countDialError(c.Name, tc, err)
+		return nil, nil, nil, errors.New(c.Name, err.Error())
 	}
 
-	var m net.Conn
+	// errors of the target connection are checked by outlier detection
+	oc := &outlierConn{Conn: t}
 
-	if !reflect.DeepEqual(config.HostConfig{}, c.Mirror) {
-		m, err = dialTarget(c.Mirror)
+	conns := []io.Closer{oc}
+	writers := []io.Writer{oc}
+
+	for _, mc := range mirrors {
+		dial := mirrorDial(mc, h)
+
+		var mw *mirrorWriter
+		if mc.IsCompare() && primary != nil {
+			mw = newCompareMirrorWriter(dial, mc, mirrorBufferSize, id, primary)
+		} else {
+			mw = newMirrorWriter(dial, mc, mirrorBufferSize)
+		}
+
+		conns = append(conns, mw)
+		writers = append(writers, mw)
+	}
+
+	return conns, io.MultiWriter(writers...), tc, nil
+}
+
+// mirrorDial returns function to dial the mirror with the downstream client
+// information
+func mirrorDial(mc config.MirrorConfig, h *proxyHeader) mirrorDialer {
+	return func() (net.Conn, error) {
+		m, err := dialTargetWithHeader(mc.HostConfig, h)
 		if err != nil {
-			mirrorDialErr.With(prometheus.Labels{"host": c.Mirror.Host, "port": c.Mirror.Port}).Inc()
-			log.Warn().
-				Err(err).
-				Str("host", c.Mirror.Host).
-				Str("port", c.Mirror.Port).
-				Msg("can't dial mirror backend")
+			return nil, err
 		}
-		if m != nil {
-			if !timeoutIsZero(c.Mirror) {
-				m.SetDeadline(time.Now().Add(c.Mirror.TimeoutDuration))
-			}
+
+		return setDeadline(m, mc.ConnectionConfig), nil
+	}
+}
+
+// sampleMirrors returns mirrors of the server that mirror the connection,
+// every mirror is sampled by its percentage
+func sampleMirrors(c config.ServerConfig) []config.MirrorConfig {
+	mirrors := []config.MirrorConfig{}
+
+	for _, mc := range getMirrors(c) {
+		if mc.Percentage < 100 && rand.Intn(100) >= mc.Percentage {
+			continue
 		}
+
+		mirrors = append(mirrors, mc)
 	}
 
-	if m == nil {
-		return []net.Conn{t}, io.MultiWriter(t), tc, nil
+	return mirrors
+}
+
+// getMirrors returns all mirrors configured in server, the mirror configured
+// in `mirror` will mirror all connections
+func getMirrors(c config.ServerConfig) []config.MirrorConfig {
+	mirrors := []config.MirrorConfig{}
+
+	if !reflect.DeepEqual(config.HostConfig{}, c.Mirror) {
+		mirrors = append(mirrors, config.MirrorConfig{
+			HostConfig: c.Mirror,
+			Percentage: 100,
+		})
 	}
 
-	return []net.Conn{t, m}, io.MultiWriter(t, m), tc, nil
+	return append(mirrors, c.Mirrors...)
 }
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	goerrors "errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	upstreamHealthy = metrics.AddGaugeVecMultiLabels("octo_upstream_healthy", "health status of upstream, 1 if healthy and 0 if unhealthy")
+)
+
+// healthCheckers count running health checkers of every upstream, health
+// status of the upstream is removed when none of them is running anymore
+var healthCheckers = struct {
+	sync.Mutex
+	m map[string]int
+}{m: make(map[string]int)}
+
+// maxExpectSize is maximum size of response read when looking for the expected payload
+const maxExpectSize = 4096
+
+// healthChecker hold health check state of a target
+type healthChecker struct {
+	target    *Target
+	successes int
+	failures  int
+}
+
+// runHealthChecks start health check for every target that has health check
+// configured, health checks will be stopped when context is canceled
+func (p *Proxy) runHealthChecks(ctx context.Context, targets []*Target) {
+	for _, t := range targets {
+		if !t.HealthCheck.IsEnabled() {
+			continue
+		}
+
+		hc := &healthChecker{target: t}
+
+		p.Wg.Add(1)
+		go func() {
+			hc.run(ctx)
+			p.Wg.Done()
+		}()
+	}
+}
+
+func (h *healthChecker) run(ctx context.Context) {
+	labels := prometheus.Labels{"host": h.target.Host, "port": h.target.Port}
+
+	healthCheckers.Lock()
+	healthCheckers.m[h.target.Address()]++
+	healthCheckers.Unlock()
+
+	// status of removed target is not exposed anymore
+	defer func() {
+		healthCheckers.Lock()
+		defer healthCheckers.Unlock()
+
+		healthCheckers.m[h.target.Address()]--
+		if healthCheckers.m[h.target.Address()] == 0 {
+			delete(healthCheckers.m, h.target.Address())
+			upstreamHealthy.Delete(labels)
+		}
+	}()
+
+	// target reused after update keeps its health status
+	healthy := 0.0
+	if h.target.isHealthy() {
+		healthy = 1
+	}
+	upstreamHealthy.With(labels).Set(healthy)
+
+	// new target is probed right away, so dead target is removed from
+	// the balancer without waiting for the first interval
+	if atomic.CompareAndSwapInt32(&h.target.probed, 0, 1) {
+		h.initial(probe(h.target.HostConfig))
+	}
+
+	ticker := time.NewTicker(h.target.HealthCheck.IntervalDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.check(probe(h.target.HostConfig))
+		}
+	}
+}
+
+// initial set health status of the target from its first probe, the
+// threshold is not used because the target hasn't been checked before
+func (h *healthChecker) initial(err error) {
+	t := h.target
+
+	if err == nil {
+		h.successes = 1
+		return
+	}
+
+	h.failures = 1
+	t.setHealthy(false)
+	upstreamHealthy.With(prometheus.Labels{"host": t.Host, "port": t.Port}).Set(0)
+
+	log.Warn().
+		Err(err).
+		Str("host", t.Host).
+		Str("port", t.Port).
+		Msg("target marked as unhealthy")
+}
+
+// check update target health status based on probe result, the status will
+// only be changed when the threshold is reached
+func (h *healthChecker) check(err error) {
+	t := h.target
+
+	if err != nil {
+		h.successes = 0
+		h.failures++
+
+		log.Debug().
+			Err(err).
+			Str("host", t.Host).
+			Str("port", t.Port).
+			Msg("health check failed")
+
+		if t.isHealthy() && h.failures >= t.HealthCheck.UnhealthyThreshold {
+			t.setHealthy(false)
+			upstreamHealthy.With(prometheus.Labels{"host": t.Host, "port": t.Port}).Set(0)
+
+			log.Warn().
+				Err(err).
+				Str("host", t.Host).
+				Str("port", t.Port).
+				Msg("target marked as unhealthy")
+		}
+
+		return
+	}
+
+	h.failures = 0
+	h.successes++
+
+	if !t.isHealthy() && h.successes >= t.HealthCheck.HealthyThreshold {
+		t.setHealthy(true)
+		upstreamHealthy.With(prometheus.Labels{"host": t.Host, "port": t.Port}).Set(1)
+
+		log.Info().
+			Str("host", t.Host).
+			Str("port", t.Port).
+			Msg("target marked as healthy")
+	}
+}
+
+// probe check target by opening tcp connection or doing tls handshake, then
+// optionally send http request or payload to the target and check the response
+func probe(hc config.HostConfig) error {
+	conn, err := probeDial(hc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(hc.HealthCheck.TimeoutDuration))
+
+	if hc.HealthCheck.Type == config.HealthCheckHTTP {
+		return probeHTTP(conn, hc)
+	}
+
+	if hc.HealthCheck.Send != "" || hc.HealthCheck.Expect != "" {
+		return probePayload(conn, hc.HealthCheck)
+	}
+
+	return nil
+}
+
+// probeDial open connection to the target, tls is used when health check
+// type is tls or when http health check is configured on tls target
+func probeDial(hc config.HostConfig) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout: hc.HealthCheck.TimeoutDuration,
+	}
+
+	useTLS := hc.HealthCheck.Type == config.HealthCheckTLS ||
+		(hc.HealthCheck.Type == config.HealthCheckHTTP && (hc.IsSimple() || hc.IsMutual()))
+
+	var tlsConf *tls.Config
+
+	if useTLS {
+		ptls, err := getTLSConfig(hc.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf = ptls.Config
+	}
+
+	// health check doesn't have downstream client, so LOCAL or UNKNOWN
+	// header is sent
+	if hc.ProxyProtocol.Version != "" {
+		var h *proxyHeader
+		return dialWithProxyHeader(d, hc, tlsConf, h.encode(hc.ProxyProtocol.Version))
+	}
+
+	if tlsConf != nil {
+		return tls.DialWithDialer(d, hc.Network(), hc.Address(), tlsConf)
+	}
+
+	return d.Dial(hc.Network(), hc.Address())
+}
+
+// probeHTTP send http request and check if the response status code is expected
+func probeHTTP(conn net.Conn, hc config.HostConfig) error {
+	hcc := hc.HealthCheck.HTTP
+
+	host := net.JoinHostPort(hc.Host, hc.Port)
+	if hc.IsUnix() {
+		host = "localhost"
+	}
+
+	req, err := http.NewRequest(hcc.Method, "http://"+host+hcc.Path, nil)
+	if err != nil {
+		return err
+	}
+
+	if hcc.Host != "" {
+		req.Host = hcc.Host
+	}
+	req.Close = true
+	req.Header.Set("User-Agent", "octo-proxy")
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for _, status := range hcc.ExpectedStatus {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+}
+
+// probePayload send payload to the target and wait until the expected
+// response is received
+func probePayload(conn net.Conn, hc config.HealthCheckConfig) error {
+	if hc.Send != "" {
+		if _, err := conn.Write([]byte(hc.Send)); err != nil {
+			return err
+		}
+	}
+
+	if hc.Expect == "" {
+		return nil
+	}
+
+	expect := []byte(hc.Expect)
+	buf := make([]byte, 0, maxExpectSize)
+	b := make([]byte, 512)
+
+	for len(buf) < maxExpectSize {
+		n, err := conn.Read(b)
+		buf = append(buf, b[:n]...)
+
+		if bytes.Contains(buf, expect) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("expected response not received: %v", err)
+		}
+	}
+
+	return goerrors.New("expected response not received")
+}
@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHealthCheckerThreshold(t *testing.T) {
+	target := &Target{
+		HostConfig: config.HostConfig{
+			Host: "127.0.0.1",
+			Port: "8001",
+			HealthCheck: config.HealthCheckConfig{
+				HealthyThreshold:   2,
+				UnhealthyThreshold: 3,
+			},
+		},
+	}
+	hc := &healthChecker{target: target}
+
+	t.Run("test target still healthy before reaching unhealthy threshold", func(t *testing.T) {
+		hc.check(errors.New("connection refused"))
+		hc.check(errors.New("connection refused"))
+
+		if !target.isHealthy() {
+			t.Fatalf("target must be healthy")
+		}
+	})
+
+	t.Run("test target is unhealthy after reaching unhealthy threshold", func(t *testing.T) {
+		hc.check(errors.New("connection refused"))
+
+		if target.isHealthy() {
+			t.Fatalf("target must be unhealthy")
+		}
+	})
+
+	t.Run("test target is healthy after reaching healthy threshold", func(t *testing.T) {
+		hc.check(nil)
+		if target.isHealthy() {
+			t.Fatalf("target must be unhealthy")
+		}
+
+		hc.check(nil)
+		if !target.isHealthy() {
+			t.Fatalf("target must be healthy")
+		}
+	})
+}
+
+func TestProbe(t *testing.T) {
+	var wg sync.WaitGroup
+	backend := testhelper.RunTestServerWithResponse(&wg, 1)
+
+	tlsBackend := RunTestTLSServer(&wg, config.TLSConfig{
+		Cert: "../testdata/cert.pem",
+		Key:  "../testdata/cert-key.pem",
+	}, make(chan []byte, 1))
+
+	redisBackend := testhelper.RunTestServerWithReply(&wg, []byte("+PONG\r\n"))
+	wrongBackend := testhelper.RunTestServerWithReply(&wg, []byte("-ERR\r\n"))
+
+	httpBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Host != "octo.local" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer httpBackend.Close()
+	httpAddr := strings.TrimPrefix(httpBackend.URL, "http://")
+
+	tests := []struct {
+		Name        string
+		Config      config.HostConfig
+		expectedErr string
+	}{
+		{
+			Name: "Test http probe",
+			Config: config.HostConfig{
+				Host: strings.Split(httpAddr, ":")[0],
+				Port: strings.Split(httpAddr, ":")[1],
+				HealthCheck: config.HealthCheckConfig{
+					Type:            config.HealthCheckHTTP,
+					TimeoutDuration: 1 * time.Second,
+					HTTP: config.HTTPHealthCheckConfig{
+						Method:         "GET",
+						Path:           "/healthz",
+						Host:           "octo.local",
+						ExpectedStatus: []int{200, 204},
+					},
+				},
+			},
+		},
+		{
+			Name: "Test http probe with unexpected status",
+			Config: config.HostConfig{
+				Host: strings.Split(httpAddr, ":")[0],
+				Port: strings.Split(httpAddr, ":")[1],
+				HealthCheck: config.HealthCheckConfig{
+					Type:            config.HealthCheckHTTP,
+					TimeoutDuration: 1 * time.Second,
+					HTTP: config.HTTPHealthCheckConfig{
+						Method:         "GET",
+						Path:           "/",
+						ExpectedStatus: []int{200},
+					},
+				},
+			},
+			expectedErr: "unexpected status code 503",
+		},
+		{
+			Name: "Test send and expect probe",
+			Config: config.HostConfig{
+				Host: strings.Split(redisBackend, ":")[0],
+				Port: strings.Split(redisBackend, ":")[1],
+				HealthCheck: config.HealthCheckConfig{
+					Type:            config.HealthCheckTCP,
+					TimeoutDuration: 1 * time.Second,
+					Send:            "PING\r\n",
+					Expect:          "+PONG",
+				},
+			},
+		},
+		{
+			Name: "Test send and expect probe with unexpected response",
+			Config: config.HostConfig{
+				Host: strings.Split(wrongBackend, ":")[0],
+				Port: strings.Split(wrongBackend, ":")[1],
+				HealthCheck: config.HealthCheckConfig{
+					Type:            config.HealthCheckTCP,
+					TimeoutDuration: 1 * time.Second,
+					Send:            "PING\r\n",
+					Expect:          "+PONG",
+				},
+			},
+			expectedErr: "expected response not received",
+		},
+		{
+			Name: "Test tcp probe",
+			Config: config.HostConfig{
+				Host: strings.Split(backend, ":")[0],
+				Port: strings.Split(backend, ":")[1],
+				HealthCheck: config.HealthCheckConfig{
+					Type:            config.HealthCheckTCP,
+					TimeoutDuration: 1 * time.Second,
+				},
+			},
+		},
+		{
+			Name: "Test tcp probe to unreachable target",
+			Config: config.HostConfig{
+				Host: "127.0.0.1",
+				Port: "10",
+				HealthCheck: config.HealthCheckConfig{
+					Type:            config.HealthCheckTCP,
+					TimeoutDuration: 1 * time.Second,
+				},
+			},
+			expectedErr: "connection refused",
+		},
+		{
+			Name: "Test tls probe",
+			Config: config.HostConfig{
+				Host: strings.Split(tlsBackend, ":")[0],
+				Port: strings.Split(tlsBackend, ":")[1],
+				TLSConfig: config.TLSConfig{
+					Mode:   "simple",
+					CaCert: "../testdata/ca-cert.pem",
+				},
+				HealthCheck: config.HealthCheckConfig{
+					Type:            config.HealthCheckTLS,
+					TimeoutDuration: 1 * time.Second,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			err := probe(tt.Config)
+			if err != nil {
+				if tt.expectedErr == "" || !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Fatalf("got %v, want %v", err, tt.expectedErr)
+				}
+				return
+			}
+
+			if tt.expectedErr != "" {
+				t.Fatalf("got nil, want %v", tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestHealthCheckRemoveTargetFromBalancer(t *testing.T) {
+	hcs := []config.HostConfig{
+		{
+			Host: "127.0.0.1",
+			Port: "10",
+			HealthCheck: config.HealthCheckConfig{
+				Type:               config.HealthCheckTCP,
+				IntervalDuration:   100 * time.Millisecond,
+				TimeoutDuration:    100 * time.Millisecond,
+				HealthyThreshold:   1,
+				UnhealthyThreshold: 1,
+			},
+		},
+		{
+			Host: "127.0.0.1",
+			Port: "8002",
+		},
+	}
+
+	p := New("test-proxy")
+	b := newBalancer(config.LoadBalancerRoundRobin, hcs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.runHealthChecks(ctx, b.Targets())
+
+	time.Sleep(500 * time.Millisecond)
+
+	t.Run("test unhealthy target is not returned by balancer", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			ts := b.Next()
+			if len(ts) != 1 {
+				t.Fatalf("got %v, want 1", len(ts))
+			}
+
+			if ts[0].Port != "8002" {
+				t.Fatalf("got %v, want 8002", ts[0].Port)
+			}
+		}
+	})
+
+	cancel()
+	p.Wg.Wait()
+}
+
+func TestHealthCheckFirstProbe(t *testing.T) {
+	hcs := []config.HostConfig{
+		{
+			Host: "127.0.0.1",
+			Port: "10",
+			HealthCheck: config.HealthCheckConfig{
+				Type:               config.HealthCheckTCP,
+				IntervalDuration:   time.Hour,
+				TimeoutDuration:    100 * time.Millisecond,
+				HealthyThreshold:   2,
+				UnhealthyThreshold: 3,
+			},
+		},
+	}
+
+	p := New("test-proxy")
+	b := newBalancer(config.LoadBalancerRoundRobin, hcs)
+	target := b.Targets()[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.runHealthChecks(ctx, b.Targets())
+
+	t.Run("test new target is probed before the first interval", func(t *testing.T) {
+		for i := 0; i < 50 && target.isHealthy(); i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		if target.isHealthy() {
+			t.Fatalf("target must be unhealthy")
+		}
+	})
+
+	cancel()
+	p.Wg.Wait()
+
+	t.Run("test health status is removed when health check is stopped", func(t *testing.T) {
+		if upstreamHealthy.Delete(prometheus.Labels{"host": "127.0.0.1", "port": "10"}) {
+			t.Fatalf("health status must be removed")
+		}
+	})
+}
+
+func TestNoAvailableTargets(t *testing.T) {
+	c := config.ServerConfig{
+		Name: "test-no-targets",
+		Targets: []config.HostConfig{
+			{
+				Host: "127.0.0.1",
+				Port: "8002",
+			},
+		},
+	}
+
+	targets := newTargets(c.Targets)
+	targets[0].setHealthy(false)
+
+	p := New(c.Name)
+
+	_, _, _, err := p.getTargets(c, newTargetGroup(c, targets), nil, 0, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "no available targets") {
+		t.Fatalf("got %v, want no available targets error", err)
+	}
+
+	t.Run("test error is counted under the server name", func(t *testing.T) {
+		if got := testutil.ToFloat64(upstreamNoTarget.With(prometheus.Labels{"name": c.Name})); got != 1 {
+			t.Fatalf("got %v, want %v", got, 1)
+		}
+
+		if got := testutil.ToFloat64(upstreamDialErr.With(prometheus.Labels{"host": "", "port": ""})); got != 0 {
+			t.Fatalf("got %v, want %v", got, 0)
+		}
+	})
+}
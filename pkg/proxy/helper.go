@@ -27,10 +27,6 @@ func errCopy(err error, tConf config.HostConfig) error {
 	return nil
 }
 
-func timeoutIsZero(c config.HostConfig) bool {
-	return c.ConnectionConfig.TimeoutDuration == 0
-}
-
 func getCACertPool(c config.TLSConfig) (*x509.CertPool, error) {
 	cacert, err := os.ReadFile(c.CaCert)
 	if err != nil {
@@ -73,6 +69,16 @@ func getCACRL(c config.TLSConfig) (*x509.RevocationList, error) {
 	return x509.ParseRevocationList(b.Bytes)
 }
 
+// parseCRL parse CRL in PEM or DER format, CRL served by http distribution
+// point is usually in DER format
+func parseCRL(raw []byte) (*x509.RevocationList, error) {
+	if b, _ := pem.Decode(raw); b != nil {
+		raw = b.Bytes
+	}
+
+	return x509.ParseRevocationList(raw)
+}
+
 func getCertKeyPair(c config.TLSConfig) (tls.Certificate, error) {
 	pcert, err := os.ReadFile(c.Cert)
 	if err != nil {
@@ -89,5 +95,11 @@ func getCertKeyPair(c config.TLSConfig) (tls.Certificate, error) {
 		return tls.Certificate{}, errors.New("tlsConfig", "can't parse public & private key pair "+err.Error())
 	}
 
+	// leaf is parsed once, so it doesn't need to be parsed on every handshake
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
 	return cert, nil
 }
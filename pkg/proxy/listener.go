@@ -0,0 +1,498 @@
+package proxy
+
+import (
+	goerrors "errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	reuseport "github.com/kavu/go_reuseport"
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/upgrade"
+)
+
+// listen create tcp listener with SO_REUSEPORT or unix domain socket listener
+func listen(hc config.HostConfig) (net.Listener, error) {
+	l, publish, err := bindListener(hc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := publish(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	commitListener(l)
+
+	return l, nil
+}
+
+// bindListener create the listener without replacing socket file used by the
+// running listener, the socket file is replaced when publish is called. This
+// lets the caller bind every listener before stopping the current ones
+func bindListener(hc config.HostConfig) (net.Listener, func() error, error) {
+	// listener passed by the previous process on upgrade is already
+	// published
+	l, err := upgrade.Listener(hc.Network(), hc.Address())
+	if err != nil || l != nil {
+		if l != nil && hc.IsAbstract() {
+			l = addAbstract(hc.Unix, l.(*net.UnixListener))
+		} else if l != nil && hc.IsUnix() {
+			l = addUnix(hc.Unix, l)
+		}
+		return l, func() error { return nil }, err
+	}
+
+	if !hc.IsUnix() {
+		l, err := reuseport.Listen("tcp", hc.Address())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return l, func() error { return nil }, nil
+	}
+
+	return bindUnix(hc)
+}
+
+// bindUnix create unix domain socket listener on a temporary file next to the
+// socket path, publish rename it to the socket path so the running listener is
+// replaced atomically. The replaced socket file is restored when the listener
+// is closed before it's committed. Socket file that left by previous process is
+// replaced, but socket that is accepting connections is only replaced when
+// it's published by this process. The socket file is removed when the listener
+// is closed, unless it's replaced by another listener or passed to the new
+// process on upgrade. Abstract socket can't be
+// bound twice, so it's bound directly or shared with the running listener
+func bindUnix(hc config.HostConfig) (net.Listener, func() error, error) {
+	if hc.IsAbstract() {
+		l, err := listenAbstract(hc.Unix)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return l, func() error { return nil }, nil
+	}
+
+	if err := checkStaleSocket(hc.Unix); err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkSocketInUse(hc.Unix); err != nil {
+		return nil, nil, err
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", hc.Unix, os.Getpid())
+	if err := removeStaleSocket(tmp); err != nil {
+		return nil, nil, err
+	}
+
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := setSocketPermission(tmp, hc.Socket); err != nil {
+		l.Close()
+		os.Remove(tmp)
+		return nil, nil, err
+	}
+
+	ul := &unixListener{Listener: l, path: hc.Unix, tmp: tmp}
+
+	return ul, ul.publish, nil
+}
+
+// unixListener remove the temporary socket file when it's closed before the
+// socket file is published, and restore the replaced socket file when it's
+// closed before the listener is committed
+type unixListener struct {
+	net.Listener
+	path      string
+	tmp       string
+	prev      string
+	fi        os.FileInfo
+	published bool
+	handoff   bool
+	sync.Mutex
+}
+
+// unixListeners hold unix socket listeners that are published in this
+// process, keyed by the socket path
+var unixListeners = struct {
+	sync.Mutex
+	m map[string][]*unixListener
+}{m: make(map[string][]*unixListener)}
+
+// addUnix register unix socket listener passed by the previous process on
+// upgrade
+func addUnix(path string, l net.Listener) net.Listener {
+	ul := &unixListener{Listener: l, path: path, published: true}
+
+	if fi, err := os.Stat(path); err == nil {
+		ul.register(fi)
+	}
+
+	return ul
+}
+
+// register mark socket file as published by the listener
+func (l *unixListener) register(fi os.FileInfo) {
+	unixListeners.Lock()
+	defer unixListeners.Unlock()
+
+	l.fi = fi
+	unixListeners.m[l.path] = append(unixListeners.m[l.path], l)
+}
+
+func (l *unixListener) unregister() {
+	unixListeners.Lock()
+	defer unixListeners.Unlock()
+
+	listeners := unixListeners.m[l.path]
+	for i, ul := range listeners {
+		if ul == l {
+			listeners = append(listeners[:i], listeners[i+1:]...)
+			break
+		}
+	}
+
+	if len(listeners) == 0 {
+		delete(unixListeners.m, l.path)
+	} else {
+		unixListeners.m[l.path] = listeners
+	}
+}
+
+// isPublished returns true when the socket file is published by a listener
+// in this process
+func isPublished(path string, fi os.FileInfo) bool {
+	unixListeners.Lock()
+	defer unixListeners.Unlock()
+
+	for _, l := range unixListeners.m[path] {
+		if os.SameFile(l.fi, fi) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// File returns copy of the socket file
+func (l *unixListener) File() (*os.File, error) {
+	return l.Listener.(*net.UnixListener).File()
+}
+
+// publish rename the temporary socket file to the socket path, the replaced
+// socket file is linked next to it until the listener is committed
+func (l *unixListener) publish() error {
+	l.Lock()
+	defer l.Unlock()
+
+	prev := fmt.Sprintf("%s.%d.prev", l.path, os.Getpid())
+	if err := removeStaleSocket(prev); err != nil {
+		return err
+	}
+
+	if err := os.Link(l.path, prev); err == nil {
+		l.prev = prev
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(l.tmp, l.path); err != nil {
+		l.removePrev()
+		return err
+	}
+
+	l.published = true
+
+	if fi, err := os.Stat(l.path); err == nil {
+		l.register(fi)
+	}
+
+	return nil
+}
+
+// commit remove the replaced socket file, it can't be restored after that
+func (l *unixListener) commit() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.removePrev()
+}
+
+func (l *unixListener) removePrev() {
+	if l.prev != "" {
+		os.Remove(l.prev)
+		l.prev = ""
+	}
+}
+
+// keep mark the listener as passed to the new process, so its socket file is
+// not removed when it's closed
+func (l *unixListener) keep() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.handoff = true
+}
+
+func (l *unixListener) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	switch {
+	case !l.published:
+		os.Remove(l.tmp)
+	case l.prev != "":
+		// listener is closed before it's committed, so the running
+		// listener gets its socket file back
+		os.Rename(l.prev, l.path)
+		l.prev = ""
+	case !l.handoff && l.fi != nil:
+		// socket file is removed unless it's replaced by the listener of
+		// the restarted server
+		if fi, err := os.Stat(l.path); err == nil && os.SameFile(fi, l.fi) {
+			os.Remove(l.path)
+		}
+	}
+
+	if l.fi != nil {
+		l.unregister()
+	}
+
+	return l.Listener.Close()
+}
+
+// commitListener commit the published listener, so the replaced socket file
+// is not restored when the listener is closed
+func commitListener(l net.Listener) {
+	if ul, ok := l.(*unixListener); ok {
+		ul.commit()
+	}
+}
+
+// abstractListeners hold abstract unix socket listeners that are open in this
+// process, keyed by the socket name
+var abstractListeners = struct {
+	sync.Mutex
+	m map[string][]*abstractListener
+}{m: make(map[string][]*abstractListener)}
+
+// abstractListener is abstract unix socket listener that can share its socket
+// with the listener of the restarted server, the socket is kept until every
+// listener that use it is closed
+type abstractListener struct {
+	*net.UnixListener
+	name string
+}
+
+// listenAbstract create abstract unix socket listener, the socket of the
+// running listener with the same name is used when it exists
+func listenAbstract(name string) (net.Listener, error) {
+	abstractListeners.Lock()
+	defer abstractListeners.Unlock()
+
+	var l net.Listener
+	var err error
+
+	if running := abstractListeners.m[name]; len(running) > 0 {
+		l, err = dupListener(running[0])
+	} else {
+		l, err = net.Listen("unix", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	al := &abstractListener{UnixListener: l.(*net.UnixListener), name: name}
+	abstractListeners.m[name] = append(abstractListeners.m[name], al)
+
+	return al, nil
+}
+
+// addAbstract register abstract unix socket listener passed by the previous
+// process on upgrade
+func addAbstract(name string, l *net.UnixListener) *abstractListener {
+	abstractListeners.Lock()
+	defer abstractListeners.Unlock()
+
+	al := &abstractListener{UnixListener: l, name: name}
+	abstractListeners.m[name] = append(abstractListeners.m[name], al)
+
+	return al
+}
+
+// dupListener create new listener that use the same socket
+func dupListener(l upgrade.Filer) (net.Listener, error) {
+	f, err := l.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return net.FileListener(f)
+}
+
+func (l *abstractListener) Close() error {
+	abstractListeners.Lock()
+	listeners := abstractListeners.m[l.name]
+	for i, al := range listeners {
+		if al == l {
+			listeners = append(listeners[:i], listeners[i+1:]...)
+			break
+		}
+	}
+
+	if len(listeners) == 0 {
+		delete(abstractListeners.m, l.name)
+	} else {
+		abstractListeners.m[l.name] = listeners
+	}
+	abstractListeners.Unlock()
+
+	return l.UnixListener.Close()
+}
+
+// listenPacket create udp listener with SO_REUSEPORT, or use the socket
+// passed by systemd or by the previous process on upgrade
+func listenPacket(c config.ServerConfig) (net.PacketConn, error) {
+	if c.Listener.SocketActivation {
+		return activatedPacketConn(c.Name)
+	}
+
+	pc, err := upgrade.PacketConn(config.ProtocolUDP, c.Listener.Address())
+	if err != nil || pc != nil {
+		return pc, err
+	}
+
+	return reuseport.ListenPacket(config.ProtocolUDP, c.Listener.Address())
+}
+
+// checkStaleSocket returns error when the file exists and is not a socket
+func checkStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s already exists and is not a socket", path)
+	}
+
+	return nil
+}
+
+// checkSocketInUse returns error when the socket file is accepting
+// connections and is not published by this process, so socket of another
+// service is not replaced
+func checkSocketInUse(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if isPublished(path, fi) {
+		return nil
+	}
+
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		// nobody is listening on the socket left by previous process
+		if goerrors.Is(err, syscall.ECONNREFUSED) {
+			return nil
+		}
+		return err
+	}
+	c.Close()
+
+	return fmt.Errorf("%s is used by another process", path)
+}
+
+// removeStaleSocket remove existing socket file, it returns error when the
+// file is not a socket
+func removeStaleSocket(path string) error {
+	if err := checkStaleSocket(path); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// setSocketPermission set file mode and ownership of socket file
+func setSocketPermission(path string, sc config.SocketConfig) error {
+	if sc.Mode != "" {
+		if err := os.Chmod(path, sc.FileMode); err != nil {
+			return err
+		}
+	}
+
+	if sc.User == "" && sc.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+
+	if sc.User != "" {
+		id, err := lookupID(sc.User, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+
+	if sc.Group != "" {
+		id, err := lookupID(sc.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+// lookupID returns numeric id of user or group, name can be the id itself
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(id)
+}
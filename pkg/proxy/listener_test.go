@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+)
+
+func TestListenUnix(t *testing.T) {
+	t.Run("test socket file mode is set", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "octo.sock")
+
+		l, err := listen(config.HostConfig{
+			Unix: path,
+			Socket: config.SocketConfig{
+				Mode:     "0600",
+				FileMode: 0600,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm() != 0600 {
+			t.Fatalf("got %v, want %v", fi.Mode().Perm(), os.FileMode(0600))
+		}
+	})
+
+	t.Run("test stale socket file is removed", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "octo.sock")
+
+		old, err := listen(config.HostConfig{Unix: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := listen(config.HostConfig{Unix: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		// socket file must not be removed by the old listener
+		old.Close()
+
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test existing file is not removed", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "octo.sock")
+		if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := listen(config.HostConfig{Unix: path}); err == nil {
+			t.Fatalf("listen must return error")
+		}
+	})
+
+	t.Run("test socket file is replaced when listener is published", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "octo.sock")
+
+		old, err := listen(config.HostConfig{Unix: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer old.Close()
+
+		l, publish, err := bindUnix(config.HostConfig{Unix: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// connection goes to the old listener until the new one is published
+		go func() {
+			c, err := net.Dial("unix", path)
+			if err == nil {
+				c.Close()
+			}
+		}()
+
+		old.(*unixListener).Listener.(*net.UnixListener).SetDeadline(time.Now().Add(time.Second))
+		c, err := old.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		if err := publish(); err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		go func() {
+			c, err := net.Dial("unix", path)
+			if err == nil {
+				c.Close()
+			}
+		}()
+
+		l.(*unixListener).Listener.(*net.UnixListener).SetDeadline(time.Now().Add(time.Second))
+		c, err = l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	})
+
+	t.Run("test replaced socket file is restored when listener is not committed", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "octo.sock")
+
+		old, err := listen(config.HostConfig{Unix: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer old.Close()
+
+		l, publish, err := bindUnix(config.HostConfig{Unix: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := publish(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		go func() {
+			c, err := net.Dial("unix", path)
+			if err == nil {
+				c.Close()
+			}
+		}()
+
+		old.(*unixListener).Listener.(*net.UnixListener).SetDeadline(time.Now().Add(time.Second))
+		c, err := old.Accept()
+		if err != nil {
+			t.Fatalf("connection must go to the old listener: %v", err)
+		}
+		c.Close()
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != 1 {
+			t.Fatalf("got %v files, want %v", len(files), 1)
+		}
+	})
+
+	t.Run("test socket of another process is not replaced", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "octo.sock")
+
+		other, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+
+		if _, err := listen(config.HostConfig{Unix: path}); err == nil {
+			t.Fatalf("listen must return error")
+		}
+	})
+
+	t.Run("test socket left by previous process is replaced", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "octo.sock")
+
+		other, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.(*net.UnixListener).SetUnlinkOnClose(false)
+		other.Close()
+
+		l, err := listen(config.HostConfig{Unix: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	})
+
+	t.Run("test socket file is removed when listener is closed", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "octo.sock")
+
+		l, err := listen(config.HostConfig{Unix: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("socket file must be removed, got %v", err)
+		}
+	})
+
+	t.Run("test socket file is kept when listener is passed to new process", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "octo.sock")
+
+		l, err := listen(config.HostConfig{Unix: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.(*unixListener).keep()
+		l.Close()
+
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test unpublished socket file is removed", func(t *testing.T) {
+		dir := t.TempDir()
+
+		l, _, err := bindUnix(config.HostConfig{Unix: filepath.Join(dir, "octo.sock")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != 0 {
+			t.Fatalf("got %v files, want %v", len(files), 0)
+		}
+	})
+
+	t.Run("test abstract socket", func(t *testing.T) {
+		l, err := listen(config.HostConfig{Unix: "@octo-proxy-test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		c, err := net.Dial("unix", "@octo-proxy-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	})
+
+	t.Run("test abstract socket is shared with the running listener", func(t *testing.T) {
+		name := "@octo-proxy-test-shared"
+
+		old, err := listen(config.HostConfig{Unix: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := listen(config.HostConfig{Unix: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// socket is kept open by the new listener
+		old.Close()
+
+		go func() {
+			c, err := net.Dial("unix", name)
+			if err == nil {
+				c.Close()
+			}
+		}()
+
+		l.(*abstractListener).SetDeadline(time.Now().Add(time.Second))
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		l.Close()
+
+		if _, err := net.Dial("unix", name); err == nil {
+			t.Fatalf("socket must be closed after every listener is closed")
+		}
+
+		// name can be bound again after the socket is closed
+		l, err = listen(config.HostConfig{Unix: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	})
+}
+
+func TestProxyRestartWithAbstractSocket(t *testing.T) {
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{testhelper.RunEchoServer(t)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cfg.ServerConfigs[0]
+	c.Listener.Host, c.Listener.Port = "", ""
+	c.Listener.Unix = "@octo-proxy-test-restart"
+
+	old := New(c.Name)
+	if err := old.Listen(c); err != nil {
+		t.Fatal(err)
+	}
+	go old.Serve()
+
+	// server is restarted when the listener settings are changed on reload
+	c.Listener.TimeoutDuration = 10 * time.Second
+
+	p := New(c.Name)
+	if err := p.Listen(c); err != nil {
+		t.Fatalf("listener must be created while the old one is running: %v", err)
+	}
+	old.Shutdown()
+
+	go p.Serve()
+	defer p.Shutdown()
+
+	conn, err := net.Dial("unix", c.Listener.Unix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	echo(t, conn)
+}
+
+func TestProxyWithUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	listenerPath := filepath.Join(dir, "listener.sock")
+	targetPath := filepath.Join(dir, "target.sock")
+
+	target, err := net.Listen("unix", targetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	result := make(chan []byte, 1)
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		buf := make([]byte, len(messageByte))
+		c.Read(buf)
+		result <- buf
+	}()
+
+	c := config.ServerConfig{
+		Name: "test-proxy",
+		Listener: config.HostConfig{
+			Unix: listenerPath,
+		},
+		Targets: []config.HostConfig{
+			{
+				Unix: targetPath,
+			},
+		},
+	}
+
+	p := New("test-proxy")
+	go func() {
+		p.Run(c)
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	if err := SendData(c.Listener, messageByte, false); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("test message received is same", func(t *testing.T) {
+		select {
+		case res := <-result:
+			if !bytes.Equal(res, messageByte) {
+				t.Fatalf("got %v, want %v", res, messageByte)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("target must receive the data")
+		}
+	})
+
+	p.Shutdown()
+}
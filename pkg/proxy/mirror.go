@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	mirrorDropped = metrics.AddCounterVecMultiLabels("octo_mirror_dropped_total", "total data chunk dropped because mirror upstream can't keep up")
+)
+
+const (
+	// mirrorBufferSize is number of data chunk buffered for every mirror connection
+	mirrorBufferSize = 64
+	// mirrorFlushTimeout is maximum time to flush buffered data after mirror is closed
+	mirrorFlushTimeout = 5 * time.Second
+)
+
+// mirrorDialer dial the mirror backend
+type mirrorDialer func() (net.Conn, error)
+
+// mirrorWriter write data to mirror asynchronously, data is dropped when the
+// buffer is full so slow mirror never affect the primary connection. The
+// mirror is dialed in the background and data is buffered until the mirror is
+// connected. The response from the mirror is drained and discarded, or
+// compared with the target response when the mirror is running in compare mode.
+type mirrorWriter struct {
+	conn    net.Conn
+	dial    mirrorDialer
+	ready   chan struct{}
+	mc      config.MirrorConfig
+	buf     chan []byte
+	written int64
+	dropped uint64
+	capped  int32
+	failed  int32
+	closed  bool
+	id      uint64
+	primary *responseCapture
+	sync.RWMutex
+}
+
+func newMirrorWriter(dial mirrorDialer, mc config.MirrorConfig, size int) *mirrorWriter {
+	return startMirrorWriter(&mirrorWriter{
+		dial: dial,
+		mc:   mc,
+		buf:  make(chan []byte, size),
+	})
+}
+
+// newCompareMirrorWriter returns mirrorWriter that compare the mirror response
+// with the target response captured in primary
+func newCompareMirrorWriter(dial mirrorDialer, mc config.MirrorConfig, size int, id uint64, primary *responseCapture) *mirrorWriter {
+	return startMirrorWriter(&mirrorWriter{
+		dial:    dial,
+		mc:      mc,
+		buf:     make(chan []byte, size),
+		id:      id,
+		primary: primary,
+	})
+}
+
+func startMirrorWriter(m *mirrorWriter) *mirrorWriter {
+	m.ready = make(chan struct{})
+
+	go m.run()
+	go m.drain()
+
+	return m
+}
+
+func (m *mirrorWriter) isCompare() bool {
+	return m.primary != nil && m.mc.IsCompare()
+}
+
+// Write copy and queue data to be written to the mirror, it never returns error.
+// Data that exceed the configured max bytes is silently discarded.
+func (m *mirrorWriter) Write(b []byte) (int, error) {
+	n := int64(len(b))
+	if m.mc.MaxBytes > 0 {
+		if m.written >= m.mc.MaxBytes {
+			if n > 0 {
+				atomic.StoreInt32(&m.capped, 1)
+			}
+			return len(b), nil
+		}
+
+		if n > m.mc.MaxBytes-m.written {
+			n = m.mc.MaxBytes - m.written
+			atomic.StoreInt32(&m.capped, 1)
+		}
+	}
+
+	data := make([]byte, n)
+	copy(data, b)
+
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.closed {
+		return len(b), nil
+	}
+
+	select {
+	case m.buf <- data:
+		m.written += n
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+		mirrorDropped.With(prometheus.Labels{"host": m.mc.Host, "port": m.mc.Port}).Inc()
+	}
+
+	return len(b), nil
+}
+
+// Close stop accepting new data and close the mirror connection after the
+// buffered data is flushed or flush timeout is reached
+func (m *mirrorWriter) Close() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	m.closed = true
+	close(m.buf)
+	time.AfterFunc(mirrorFlushTimeout, func() {
+		if conn := m.connected(); conn != nil {
+			conn.Close()
+		}
+	})
+
+	return nil
+}
+
+// connected wait until dialing the mirror is finished and returns the mirror
+// connection, nil is returned when the mirror can't be dialed
+func (m *mirrorWriter) connected() net.Conn {
+	<-m.ready
+	return m.conn
+}
+
+// connect dial the mirror, data written to the mirror is discarded when the
+// mirror can't be dialed
+func (m *mirrorWriter) connect() bool {
+	conn, err := m.dial()
+	if err == nil {
+		m.conn = conn
+		close(m.ready)
+		return true
+	}
+
+	atomic.StoreInt32(&m.failed, 1)
+	close(m.ready)
+
+	mirrorDialErr.With(prometheus.Labels{"host": m.mc.Host, "port": m.mc.Port}).Inc()
+	log.Warn().
+		Err(err).
+		Str("host", m.mc.Host).
+		Str("port", m.mc.Port).
+		Msg("can't dial mirror backend")
+
+	for range m.buf {
+	}
+
+	return false
+}
+
+func (m *mirrorWriter) run() {
+	if !m.connect() {
+		return
+	}
+
+	var failed bool
+
+	for data := range m.buf {
+		if failed {
+			continue
+		}
+
+		if _, err := m.conn.Write(data); err != nil {
+			failed = true
+			atomic.StoreInt32(&m.failed, 1)
+
+			log.Debug().
+				Err(err).
+				Str("host", m.mc.Host).
+				Str("port", m.mc.Port).
+				Msg("failed to write to mirror backend")
+
+			m.conn.Close()
+		}
+	}
+
+	// keep reading the response, the connection is closed by drain
+	if m.isCompare() && !failed {
+		closeWrite(m.conn)
+		return
+	}
+
+	m.conn.Close()
+}
+
+// drain read and discard the response from mirror, in compare mode the
+// response is captured and compared with the target response
+func (m *mirrorWriter) drain() {
+	conn := m.connected()
+	if conn == nil {
+		return
+	}
+
+	if !m.isCompare() {
+		io.Copy(io.Discard, conn)
+		return
+	}
+
+	defer conn.Close()
+
+	capture := newResponseCapture(m.mc.CompareBytes)
+	io.Copy(capture, conn)
+
+	if atomic.LoadInt32(&m.failed) == 1 {
+		return
+	}
+
+	// mirror that doesn't receive the whole request can't be compared with
+	// the target
+	if atomic.LoadUint64(&m.dropped) > 0 || atomic.LoadInt32(&m.capped) == 1 {
+		mirrorIncomplete.With(prometheus.Labels{"host": m.mc.Host, "port": m.mc.Port}).Inc()
+
+		log.Debug().
+			Uint64("conn_id", m.id).
+			Str("host", m.mc.Host).
+			Str("port", m.mc.Port).
+			Msg("mirror request is not complete, skip comparing mirror response")
+		return
+	}
+
+	compareResponse(m.id, m.mc, m.primary, capture)
+}
+
+// closeWrite shut down the writing side of the connection if supported,
+// otherwise the connection is closed
+func closeWrite(conn net.Conn) {
+	if ic, ok := conn.(*idleConn); ok {
+		conn = ic.Conn
+	}
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+
+	conn.Close()
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+)
+
+// dialConn returns mirrorDialer that returns the given connection
+func dialConn(conn net.Conn) mirrorDialer {
+	return func() (net.Conn, error) {
+		return conn, nil
+	}
+}
+
+func TestMirrorWriter(t *testing.T) {
+	t.Run("test data is flushed to mirror after closed", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+
+		m := newMirrorWriter(dialConn(c1), config.MirrorConfig{}, mirrorBufferSize)
+
+		go func() {
+			m.Write([]byte("hel"))
+			m.Write([]byte("lo"))
+			m.Close()
+		}()
+
+		b, err := io.ReadAll(c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, messageByte) {
+			t.Fatalf("got %v, want %v", b, messageByte)
+		}
+	})
+
+	t.Run("test data is capped by max bytes", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+
+		m := newMirrorWriter(dialConn(c1), config.MirrorConfig{MaxBytes: 3}, mirrorBufferSize)
+
+		go func() {
+			m.Write([]byte("he"))
+			m.Write([]byte("llo"))
+			m.Write([]byte("world"))
+			m.Close()
+		}()
+
+		b, err := io.ReadAll(c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, []byte("hel")) {
+			t.Fatalf("got %v, want %v", b, []byte("hel"))
+		}
+	})
+
+	t.Run("test write after closed", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+
+		m := newMirrorWriter(dialConn(c1), config.MirrorConfig{}, mirrorBufferSize)
+		m.Close()
+
+		n, err := m.Write(messageByte)
+		if n != len(messageByte) || err != nil {
+			t.Fatalf("got %v %v, want %v nil", n, err, len(messageByte))
+		}
+	})
+
+	t.Run("test data is dropped when mirror is slow", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+
+		m := newMirrorWriter(dialConn(c1), config.MirrorConfig{}, 1)
+		defer m.Close()
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 10; i++ {
+				n, err := m.Write(messageByte)
+				if n != len(messageByte) || err != nil {
+					t.Errorf("got %v %v, want %v nil", n, err, len(messageByte))
+				}
+			}
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("write to mirror must not block")
+		}
+
+		if atomic.LoadUint64(&m.dropped) == 0 {
+			t.Fatalf("data must be dropped")
+		}
+	})
+
+	t.Run("test write doesn't wait for mirror to be dialed", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+
+		dialed := make(chan struct{})
+		m := newMirrorWriter(func() (net.Conn, error) {
+			<-dialed
+			return c1, nil
+		}, config.MirrorConfig{}, mirrorBufferSize)
+
+		m.Write([]byte("hel"))
+		m.Write([]byte("lo"))
+		m.Close()
+		close(dialed)
+
+		b, err := io.ReadAll(c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, messageByte) {
+			t.Fatalf("got %v, want %v", b, messageByte)
+		}
+	})
+
+	t.Run("test data is discarded when mirror can't be dialed", func(t *testing.T) {
+		m := newMirrorWriter(func() (net.Conn, error) {
+			return nil, io.ErrClosedPipe
+		}, config.MirrorConfig{}, mirrorBufferSize)
+
+		n, err := m.Write(messageByte)
+		if n != len(messageByte) || err != nil {
+			t.Fatalf("got %v %v, want %v nil", n, err, len(messageByte))
+		}
+		m.Close()
+
+		if conn := m.connected(); conn != nil {
+			t.Fatalf("got %v, want nil connection", conn)
+		}
+	})
+}
+
+func TestGetMirrors(t *testing.T) {
+	mirror := config.HostConfig{Host: "127.0.0.1", Port: "8001"}
+	mirrors := []config.MirrorConfig{
+		{
+			HostConfig: config.HostConfig{Host: "127.0.0.1", Port: "8002"},
+			Percentage: 5,
+		},
+	}
+
+	tests := []struct {
+		Name     string
+		Config   config.ServerConfig
+		Expected []config.MirrorConfig
+	}{
+		{
+			Name:     "Test without mirror",
+			Config:   config.ServerConfig{},
+			Expected: []config.MirrorConfig{},
+		},
+		{
+			Name:   "Test with single mirror",
+			Config: config.ServerConfig{Mirror: mirror},
+			Expected: []config.MirrorConfig{
+				{HostConfig: mirror, Percentage: 100},
+			},
+		},
+		{
+			Name:   "Test with single mirror and multiple mirrors",
+			Config: config.ServerConfig{Mirror: mirror, Mirrors: mirrors},
+			Expected: []config.MirrorConfig{
+				{HostConfig: mirror, Percentage: 100},
+				mirrors[0],
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			m := getMirrors(tt.Config)
+			if !reflect.DeepEqual(m, tt.Expected) {
+				t.Fatalf("got %v, want %v", m, tt.Expected)
+			}
+		})
+	}
+}
+
+func TestProxyWithMultipleMirrors(t *testing.T) {
+	var wg sync.WaitGroup
+	result := make(chan []byte)
+	mirrorResult := make(chan []byte)
+	cappedMirrorResult := make(chan []byte)
+
+	// start target server
+	backend := testhelper.RunTestServer(&wg, result)
+	mirror := testhelper.RunTestServer(&wg, mirrorResult)
+	cappedMirror := testhelper.RunTestServer(&wg, cappedMirrorResult)
+
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{backend}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerConfigs[0].Mirrors = []config.MirrorConfig{
+		{
+			HostConfig: config.HostConfig{
+				Host: strings.Split(mirror, ":")[0],
+				Port: strings.Split(mirror, ":")[1],
+			},
+			Percentage: 100,
+		},
+		{
+			HostConfig: config.HostConfig{
+				Host: strings.Split(cappedMirror, ":")[0],
+				Port: strings.Split(cappedMirror, ":")[1],
+			},
+			Percentage: 100,
+			MaxBytes:   3,
+		},
+	}
+
+	p := New("test-proxy")
+	go func() {
+		p.Run(cfg.ServerConfigs[0])
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	if err := SendData(cfg.ServerConfigs[0].Listener, messageByte, false); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("test message received is same", func(t *testing.T) {
+		res := <-result
+		if !bytes.Equal(res, messageByte) {
+			t.Fatalf("got %v, want %v", res, messageByte)
+		}
+	})
+
+	t.Run("test message received is same in mirror server", func(t *testing.T) {
+		res := <-mirrorResult
+		if !bytes.Equal(res, messageByte) {
+			t.Fatalf("got %v, want %v", res, messageByte)
+		}
+	})
+
+	t.Run("test message received is capped in mirror server", func(t *testing.T) {
+		res := <-cappedMirrorResult
+		if !bytes.Equal(res, []byte("hel\x00\x00")) {
+			t.Fatalf("got %v, want %v", res, []byte("hel"))
+		}
+	})
+
+	p.Shutdown()
+}
+
+func TestProxyWithStalledMirror(t *testing.T) {
+	// start target server that read all of the data
+	result := make(chan int64, 1)
+	target := testhelper.RunServer(t, func(c net.Conn) {
+		defer c.Close()
+
+		n, _ := io.Copy(io.Discard, c)
+		result <- n
+	})
+
+	// start mirror server that never read the data
+	stalled := make(chan struct{})
+	defer close(stalled)
+
+	mirror := testhelper.RunServer(t, func(c net.Conn) {
+		defer c.Close()
+		<-stalled
+	})
+
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{target}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerConfigs[0].Mirror = config.HostConfig{
+		Host: strings.Split(mirror, ":")[0],
+		Port: strings.Split(mirror, ":")[1],
+	}
+
+	p := New("test-proxy")
+	go func() {
+		p.Run(cfg.ServerConfigs[0])
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	// send large data, so the mirror can't receive all of the data
+	message := bytes.Repeat([]byte("x"), 16*1024*1024)
+	if err := SendData(cfg.ServerConfigs[0].Listener, message, false); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("test target receive data even when mirror is stalled", func(t *testing.T) {
+		select {
+		case n := <-result:
+			if n != int64(len(message)) {
+				t.Fatalf("got %v, want %v", n, len(message))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("target must receive the data")
+		}
+	})
+
+	p.Shutdown()
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	goerrors "errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	upstreamEjected    = metrics.AddGaugeVecMultiLabels("octo_upstream_ejected", "ejection status of upstream, 1 if ejected by outlier detection and 0 if not")
+	upstreamEjectTotal = metrics.AddCounterVecMultiLabels("octo_upstream_ejection_total", "total upstream ejection by outlier detection")
+)
+
+// outlierDetector eject targets that failed consecutively from the balancer
+// for a backoff period, a nil outlierDetector is valid and does nothing
+type outlierDetector struct {
+	sync.Mutex
+	config  config.OutlierDetectionConfig
+	targets []*Target
+}
+
+// outlierState hold outlier detection state of a target
+type outlierState struct {
+	failures     int
+	ejections    int
+	ejectedUntil int64
+}
+
+func newOutlierDetector(c config.OutlierDetectionConfig, targets []*Target) *outlierDetector {
+	if !c.IsEnabled() {
+		return nil
+	}
+
+	return &outlierDetector{
+		config:  c,
+		targets: targets,
+	}
+}
+
+func (t *Target) isEjected() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&t.outlier.ejectedUntil)
+}
+
+// success reset consecutive failures of the target
+func (o *outlierDetector) success(t *Target) {
+	if o == nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	t.outlier.failures = 0
+	if !t.isEjected() {
+		t.outlier.ejections = 0
+	}
+}
+
+// failure record failure of the target and eject the target when the
+// consecutive failures reach the threshold
+func (o *outlierDetector) failure(t *Target) {
+	if o == nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	if t.isEjected() {
+		return
+	}
+
+	t.outlier.failures++
+	if t.outlier.failures < o.config.ConsecutiveFailures {
+		return
+	}
+
+	if !o.canEject() {
+		log.Warn().
+			Str("host", t.Host).
+			Str("port", t.Port).
+			Int("max-ejection-percent", o.config.MaxEjectionPercent).
+			Msg("target not ejected because max ejection percent is reached")
+		return
+	}
+
+	t.outlier.failures = 0
+	t.outlier.ejections++
+
+	d := time.Duration(t.outlier.ejections) * o.config.BaseEjectionTimeDuration
+	if d > o.config.MaxEjectionTimeDuration {
+		d = o.config.MaxEjectionTimeDuration
+	}
+
+	atomic.StoreInt64(&t.outlier.ejectedUntil, time.Now().Add(d).UnixNano())
+
+	upstreamEjected.With(prometheus.Labels{"host": t.Host, "port": t.Port}).Set(1)
+	upstreamEjectTotal.With(prometheus.Labels{"host": t.Host, "port": t.Port}).Inc()
+
+	log.Warn().
+		Str("host", t.Host).
+		Str("port", t.Port).
+		Dur("duration", d).
+		Int("ejections", t.outlier.ejections).
+		Msg("target ejected by outlier detection")
+
+	time.AfterFunc(d, func() {
+		upstreamEjected.With(prometheus.Labels{"host": t.Host, "port": t.Port}).Set(0)
+
+		log.Info().
+			Str("host", t.Host).
+			Str("port", t.Port).
+			Msg("ejected target returned to rotation")
+	})
+}
+
+// canEject check if one more target can be ejected without exceeding max
+// ejection percent, at least one target can be ejected when there is more
+// than one target and the last target will never be ejected
+func (o *outlierDetector) canEject() bool {
+	ejected := 0
+	for _, t := range o.targets {
+		if t.isEjected() {
+			ejected++
+		}
+	}
+
+	max := len(o.targets) * o.config.MaxEjectionPercent / 100
+	if max < 1 {
+		max = 1
+	}
+
+	if max > len(o.targets)-1 {
+		max = len(o.targets) - 1
+	}
+
+	return ejected < max
+}
+
+// outlierConn record errors returned by the target connection. Only read or
+// write errors before the target sends any response are target failures,
+// errors on the client side, deadline errors and errors after the connection
+// is closed are not counted by outlier detection
+type outlierConn struct {
+	net.Conn
+	received int64
+	failed   int32
+}
+
+func (c *outlierConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.received, int64(n))
+	}
+	if err != nil && err != io.EOF {
+		c.fail(err)
+	}
+
+	return n, err
+}
+
+func (c *outlierConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.fail(err)
+	}
+
+	return n, err
+}
+
+func (c *outlierConn) fail(err error) {
+	if goerrors.Is(err, net.ErrClosed) || isTimeout(err) {
+		return
+	}
+
+	if atomic.LoadInt64(&c.received) > 0 {
+		return
+	}
+
+	atomic.StoreInt32(&c.failed, 1)
+}
+
+// hasFailed returns true when the target failed before sending any response
+func (c *outlierConn) hasFailed() bool {
+	return atomic.LoadInt32(&c.failed) == 1
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return goerrors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+)
+
+func TestOutlierDetector(t *testing.T) {
+	b := newBalancer(config.LoadBalancerRoundRobin, balancerTargets)
+	o := newOutlierDetector(config.OutlierDetectionConfig{
+		ConsecutiveFailures:      3,
+		MaxEjectionPercent:       50,
+		BaseEjectionTimeDuration: 200 * time.Millisecond,
+		MaxEjectionTimeDuration:  300 * time.Millisecond,
+	}, b.Targets())
+
+	target := b.Targets()[0]
+
+	t.Run("test target is not ejected before reaching consecutive failures", func(t *testing.T) {
+		o.failure(target)
+		o.failure(target)
+		o.success(target)
+		o.failure(target)
+		o.failure(target)
+
+		if target.isEjected() {
+			t.Fatalf("target must not be ejected")
+		}
+	})
+
+	t.Run("test target is ejected after reaching consecutive failures", func(t *testing.T) {
+		o.failure(target)
+
+		if !target.isEjected() {
+			t.Fatalf("target must be ejected")
+		}
+
+		for _, ts := range b.Next() {
+			if ts == target {
+				t.Fatalf("ejected target must not be returned by balancer")
+			}
+		}
+	})
+
+	t.Run("test max ejection percent", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			o.failure(b.Targets()[1])
+		}
+
+		if b.Targets()[1].isEjected() {
+			t.Fatalf("target must not be ejected when max ejection percent is reached")
+		}
+	})
+
+	t.Run("test ejected target returned after ejection time", func(t *testing.T) {
+		time.Sleep(250 * time.Millisecond)
+
+		if target.isEjected() {
+			t.Fatalf("target must not be ejected")
+		}
+
+		if len(b.Next()) != len(balancerTargets) {
+			t.Fatalf("got %v, want %v", len(b.Next()), len(balancerTargets))
+		}
+	})
+
+	t.Run("test ejection time is increased and capped", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			o.failure(target)
+		}
+
+		if target.outlier.ejections != 2 {
+			t.Fatalf("got %v, want 2", target.outlier.ejections)
+		}
+
+		until := time.Unix(0, target.outlier.ejectedUntil)
+		if time.Until(until) > 300*time.Millisecond {
+			t.Fatalf("ejection time must be capped by max ejection time")
+		}
+	})
+}
+
+func TestOutlierDetectorNeverEjectLastTarget(t *testing.T) {
+	b := newBalancer(config.LoadBalancerRoundRobin, balancerTargets[:1])
+	o := newOutlierDetector(config.OutlierDetectionConfig{
+		ConsecutiveFailures:      1,
+		MaxEjectionPercent:       100,
+		BaseEjectionTimeDuration: time.Second,
+		MaxEjectionTimeDuration:  time.Second,
+	}, b.Targets())
+
+	o.failure(b.Targets()[0])
+
+	if b.Targets()[0].isEjected() {
+		t.Fatalf("last target must not be ejected")
+	}
+}
+
+func TestNilOutlierDetector(t *testing.T) {
+	o := newOutlierDetector(config.OutlierDetectionConfig{}, nil)
+	if o != nil {
+		t.Fatalf("outlier detector must be nil when not configured")
+	}
+
+	// must not panic
+	o.failure(&Target{})
+	o.success(&Target{})
+}
+
+type errConn struct {
+	net.Conn
+	n   int
+	err error
+}
+
+func (c *errConn) Read(b []byte) (int, error) {
+	return c.n, c.err
+}
+
+func TestOutlierConn(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Reads    []*errConn
+		expected bool
+	}{
+		{
+			Name:     "test target reset before response is failure",
+			Reads:    []*errConn{{err: syscall.ECONNRESET}},
+			expected: true,
+		},
+		{
+			Name:     "test target reset after response is not failure",
+			Reads:    []*errConn{{n: 1}, {err: syscall.ECONNRESET}},
+			expected: false,
+		},
+		{
+			Name:     "test deadline is not failure",
+			Reads:    []*errConn{{err: os.ErrDeadlineExceeded}},
+			expected: false,
+		},
+		{
+			Name:     "test closed connection is not failure",
+			Reads:    []*errConn{{err: net.ErrClosed}},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			oc := &outlierConn{}
+
+			for _, r := range tt.Reads {
+				oc.Conn = r
+				oc.Read(make([]byte, 1))
+			}
+
+			if oc.hasFailed() != tt.expected {
+				t.Fatalf("got %v, want %v", oc.hasFailed(), tt.expected)
+			}
+		})
+	}
+}
+
+// resetConn close the connection with RST
+func resetConn(c net.Conn) {
+	c.(*net.TCPConn).SetLinger(0)
+	c.Close()
+}
+
+func TestProxyOutlierDetection(t *testing.T) {
+	run := func(t *testing.T, backend func(net.Conn), client func(net.Conn)) []*Target {
+		targets := []string{testhelper.RunServer(t, backend), testhelper.RunServer(t, backend)}
+
+		cfg, err := config.GenerateConfig("127.0.0.1:9000", targets, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.ServerConfigs[0].OutlierDetection = config.OutlierDetectionConfig{
+			ConsecutiveFailures:      1,
+			MaxEjectionPercent:       50,
+			BaseEjectionTimeDuration: time.Minute,
+			MaxEjectionTimeDuration:  time.Minute,
+		}
+
+		p := New("test-proxy")
+		go p.Run(cfg.ServerConfigs[0])
+		defer p.Shutdown()
+
+		time.Sleep(500 * time.Millisecond)
+
+		for i := 0; i < 4; i++ {
+			conn, err := net.Dial("tcp", "127.0.0.1:9000")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client(conn)
+		}
+
+		time.Sleep(500 * time.Millisecond)
+
+		return p.state.Load().balancer.Targets()
+	}
+
+	t.Run("test client reset doesn't eject target", func(t *testing.T) {
+		// target reads the request and never responds
+		targets := run(t, func(c net.Conn) {
+			defer c.Close()
+			c.Read(make([]byte, 1024))
+			c.Read(make([]byte, 1024))
+		}, func(c net.Conn) {
+			c.Write(messageByte)
+			time.Sleep(100 * time.Millisecond)
+			resetConn(c)
+		})
+
+		for _, target := range targets {
+			if target.isEjected() {
+				t.Fatalf("target %s must not be ejected", target.Address())
+			}
+		}
+	})
+
+	t.Run("test target reset eject target", func(t *testing.T) {
+		targets := run(t, func(c net.Conn) {
+			resetConn(c)
+		}, func(c net.Conn) {
+			defer c.Close()
+			c.Write(messageByte)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			c.Read(make([]byte, 1024))
+		})
+
+		ejected := 0
+		for _, target := range targets {
+			if target.isEjected() {
+				ejected++
+			}
+		}
+
+		if ejected != 1 {
+			t.Fatalf("got %v ejected targets, want %v", ejected, 1)
+		}
+	})
+}
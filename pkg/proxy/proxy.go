@@ -3,15 +3,17 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
+	goerrors "errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	reuseport "github.com/kavu/go_reuseport"
 	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/errors"
 	"github.com/nothinux/octo-proxy/pkg/metrics"
+	"github.com/nothinux/octo-proxy/pkg/upgrade"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 )
@@ -20,21 +22,47 @@ var (
 	downstreamConnActive = metrics.AddGaugeVec("octo_downstream_conn_active", "current active connection in downstream")
 	downstreamConnTotal  = metrics.AddCounterVec("octo_downstream_conn_total", "total downstream connection")
 	downstreamConnErr    = metrics.AddCounterVec("octo_downstream_conn_error", "total downsream connection error. include tcp and tls")
+	downstreamSANReject  = metrics.AddCounterVec("octo_downstream_san_rejected_total", "total downstream connection rejected because client certificate doesn't match subjectAltNames")
+	downstreamTLSResumed = metrics.AddCounterVec("octo_downstream_tls_resumed_total", "total downstream tls connection that resumed previous session")
+	downstreamConnDrain  = metrics.AddCounterVec("octo_downstream_conn_drained_total", "total downstream connection finished during drain period on shutdown")
+	downstreamConnKilled = metrics.AddCounterVec("octo_downstream_conn_killed_total", "total downstream connection closed forcefully after drain timeout")
 
 	upstreamConnActive = metrics.AddGaugeVecMultiLabels("octo_upstream_conn_active", "current active connection in upstreamn")
 	upstreamConnTotal  = metrics.AddCounterVecMultiLabels("octo_upstream_conn_total", "total upstream connection")
 	upstreamConnErr    = metrics.AddCounterVecMultiLabels("octo_upstream_conn_error", "total upstream connection error. include tcp and tls")
 )
 
+// defaultDrainTimeout is used when drain timeout is not configured
+const defaultDrainTimeout = 30 * time.Second
+
 // Proxy hold running proxy data
 type Proxy struct {
-	Name     string
-	Listener net.Listener
-	Quit     context.CancelFunc
-	Wg       sync.WaitGroup
+	Name       string
+	Listener   net.Listener
+	PacketConn net.PacketConn
+	Quit       context.CancelFunc
+	Wg         sync.WaitGroup
+	state      atomic.Pointer[proxyState]
+	connID     uint64
+	active     int64
+	killed     int64
+	kill       context.CancelFunc
+	serve      func() error
+	publish    func() error
+	file       upgrade.Filer
 	sync.Mutex
 }
 
+// proxyState hold server configuration and targets used for new connections,
+// it's replaced on update while the listener keeps running
+type proxyState struct {
+	conf   config.ServerConfig
+	routes []*sniRoute
+	ctx    context.Context
+	stop   context.CancelFunc
+	*targetGroup
+}
+
 // New initialize new proxy
 func New(name string) *Proxy {
 	return &Proxy{
@@ -42,62 +70,366 @@ func New(name string) *Proxy {
 	}
 }
 
-// Run initialize tcp or tls listener
-func (p *Proxy) Run(c config.ServerConfig) {
+// Run initialize tcp, tls or udp listener and serve connections until the
+// proxy is shut down
+func (p *Proxy) Run(c config.ServerConfig) error {
+	if err := p.Listen(c); err != nil {
+		return err
+	}
+
+	return p.Serve()
+}
+
+// Listen bind the listener and load tls configuration of the server, an
+// error is returned without changing the running proxy when one of them
+// failed. The socket file of the running listener is not replaced until
+// Publish is called, and connections are not accepted until Serve is called
+func (p *Proxy) Listen(c config.ServerConfig) error {
+	s, err := p.newState(c, nil)
+	if err != nil {
+		return errors.New(c.Name, "failed to get target TLS config: "+err.Error())
+	}
+
+	if c.IsUDP() {
+		pc, err := listenPacket(c)
+		if err != nil {
+			return errors.New(c.Name, "failed to listen: "+err.Error())
+		}
+
+		p.start(s, func(ctx, killCtx context.Context) error {
+			p.runUDP(ctx, c, pc)
+			return nil
+		})
+
+		p.Lock()
+		p.PacketConn = pc
+		p.file, _ = pc.(upgrade.Filer)
+		p.Unlock()
+
+		return nil
+	}
+
+	var reloader *tlsReloader
+
+	tc := c.Listener.TLSConfig
+	if tc.IsSimple() || tc.IsMutual() {
+		reloader, err = newTLSReloader(c.Name, tc)
+		if err != nil {
+			return errors.New(c.Name, "failed to get TLS config: "+err.Error())
+		}
+	}
+
+	var l net.Listener
+
+	publish := func() error { return nil }
+
+	if c.Listener.SocketActivation {
+		l, err = activatedListener(c.Name)
+	} else {
+		l, publish, err = bindListener(c.Listener)
+	}
+	if err != nil {
+		return errors.New(c.Name, "failed to listen: "+err.Error())
+	}
+	bound := l
+	file, _ := l.(upgrade.Filer)
+
+	// PROXY protocol header is read before tls handshake
+	if c.Listener.ProxyProtocol.Enabled {
+		l = newProxyProtoListener(l, c.Listener.ProxyProtocol)
+	}
+
+	if reloader != nil {
+		l = tls.NewListener(l, reloader.listenerConfig())
+	}
+
+	p.start(s, func(ctx, killCtx context.Context) error {
+		commitListener(bound)
+
+		p.logServer(c)
+
+		if reloader != nil {
+			p.Wg.Add(1)
+			go func() {
+				defer p.Wg.Done()
+				reloader.watch(ctx)
+			}()
+		}
+
+		p.handleConn(ctx, killCtx, c)
+		return nil
+	})
+
+	p.Lock()
+	p.Listener = l
+	p.publish = publish
+	p.file = file
+	p.Unlock()
+
+	return nil
+}
+
+// Publish replace the socket file of the running listener with the listener
+// created by Listen. The replaced socket file is restored when the proxy is
+// shut down before it's served. Serve publish the listener when it's not
+// published yet
+func (p *Proxy) Publish() error {
+	p.Lock()
+	publish := p.publish
+	p.publish = nil
+	p.Unlock()
+
+	if publish == nil {
+		return nil
+	}
+
+	if err := publish(); err != nil {
+		return errors.New(p.Name, "failed to listen: "+err.Error())
+	}
+
+	return nil
+}
+
+// ListenerFile returns copy of the listener file, so the listener can be
+// passed to the new process on upgrade
+func (p *Proxy) ListenerFile() (*upgrade.File, error) {
 	p.Lock()
+	file := p.file
+	p.Unlock()
+
+	if file == nil {
+		return nil, errors.New(p.Name, "listener is not created")
+	}
+
+	c := p.Config()
+
+	if c.Listener.SocketActivation {
+		return upgrade.NewFile(activationNetwork, c.Name, file)
+	}
+
+	network := c.Listener.Network()
+	if c.IsUDP() {
+		network = config.ProtocolUDP
+	}
+
+	return upgrade.NewFile(network, c.Listener.Address(), file)
+}
+
+// Handoff mark the listener as passed to the new process on upgrade, so the
+// socket file is not removed when the proxy is shut down
+func (p *Proxy) Handoff() {
+	p.Lock()
+	defer p.Unlock()
+
+	if ul, ok := p.file.(*unixListener); ok {
+		ul.keep()
+	}
+}
+
+// start set state of the proxy and prepare the function that will be run by
+// Serve
+func (p *Proxy) start(s *proxyState, serve func(ctx, killCtx context.Context) error) {
+	p.Lock()
+	defer p.Unlock()
+
 	if p.Quit != nil {
 		p.Quit()
 	}
+	if p.kill != nil {
+		p.kill()
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	p.Quit = cancel
+
+	// killCtx is canceled when connections are not finished after drain
+	// timeout
+	killCtx, kill := context.WithCancel(context.Background())
+	p.kill = kill
+
+	p.setState(s)
+	p.serve = func() error {
+		return serve(ctx, killCtx)
+	}
+}
+
+// Serve accept connections on the listener created by Listen until the proxy
+// is shut down
+func (p *Proxy) Serve() error {
+	p.Lock()
+	serve := p.serve
+	p.serve = nil
 	p.Unlock()
 
-	l, err := reuseport.Listen("tcp", net.JoinHostPort(c.Listener.Host, c.Listener.Port))
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to listen")
+	if serve == nil {
+		return errors.New(p.Name, "listener is not created")
+	}
+
+	if err := p.Publish(); err != nil {
+		return err
 	}
 
+	return serve()
+}
+
+func (p *Proxy) logServer(c config.ServerConfig) {
 	ts := []string{}
 
 	for _, target := range c.Targets {
-		ts = append(ts, fmt.Sprintf("%s:%s", target.Host, target.Port))
+		ts = append(ts, target.Address())
 	}
 
-	log.Info().
-		Str("name", c.Name).
-		Str("host", c.Listener.Host).
-		Str("port", c.Listener.Port).
-		Strs("targets", ts).
-		Msg("running server")
+	ev := log.Info().Str("name", c.Name)
+	if c.Listener.SocketActivation {
+		ev = ev.Str("socket", c.Name)
+	} else if c.Listener.IsUnix() {
+		ev = ev.Str("unix", c.Listener.Unix)
+	} else {
+		ev = ev.Str("host", c.Listener.Host).Str("port", c.Listener.Port)
+	}
+	ev.Strs("targets", ts).Msg("running server")
 
 	tc := c.Listener.TLSConfig
 	if tc.IsSimple() || tc.IsMutual() {
-		tlsConf, err := getTLSConfig(tc)
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to get TLS config")
-		}
+		log.Info().
+			Str("name", c.Name).
+			Str("mode", tc.Mode).
+			Msg("running in TLS mode")
+	} else if tc.IsPassthrough() {
+		log.Info().
+			Str("name", c.Name).
+			Str("mode", tc.Mode).
+			Int("routes", len(c.Routes)).
+			Msg("running in TLS passthrough mode")
+	}
+}
 
-		tlsListen := tls.NewListener(l, tlsConf.Config)
+// Config returns the server configuration used by the proxy
+func (p *Proxy) Config() config.ServerConfig {
+	if s := p.state.Load(); s != nil {
+		return s.conf
+	}
+
+	return config.ServerConfig{}
+}
+
+// Update replace targets, routes, mirrors, load balancer and outlier
+// detection of the running proxy without closing the listener. The listener
+// configuration must not be changed. Targets that are not changed keep their
+// health and connection state, and connections that are already forwarded
+// keep using their targets
+func (p *Proxy) Update(c config.ServerConfig) error {
+	apply, _, err := p.PrepareUpdate(c)
+	if err != nil {
+		return err
+	}
+
+	apply()
+	return nil
+}
+
+// PrepareUpdate build targets of the new configuration and load their tls
+// configuration, an error is returned without changing the running proxy
+// when one of them failed. The new configuration is applied when apply is
+// called, discard must be called instead when it's not applied
+func (p *Proxy) PrepareUpdate(c config.ServerConfig) (apply func(), discard func(), err error) {
+	s, err := p.newState(c, p.state.Load())
+	if err != nil {
+		return nil, nil, errors.New(c.Name, "failed to get target TLS config: "+err.Error())
+	}
+
+	return func() {
 		p.Lock()
-		p.Listener = tlsListen
-		p.Unlock()
+		defer p.Unlock()
+
+		p.setState(s)
 
 		log.Info().
 			Str("name", c.Name).
-			Str("mode", c.Listener.TLSConfig.Mode).
-			Msg("running in TLS mode")
-	} else {
-		p.Lock()
-		p.Listener = l
-		p.Unlock()
+			Msg("server targets updated")
+	}, s.stop, nil
+}
+
+// newState build target groups for the server and load tls configuration of
+// targets and mirrors, targets of the previous state are reused when they are
+// not changed. Health checks are started when the state is set
+func (p *Proxy) newState(c config.ServerConfig, prev *proxyState) (*proxyState, error) {
+	if err := checkTargetsTLS(c); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pool := &targetPool{}
+	if prev != nil {
+		pool.add(prev.balancer.Targets())
+		for _, r := range prev.routes {
+			pool.add(r.group.balancer.Targets())
+		}
+	}
+
+	s := &proxyState{
+		conf:        c,
+		ctx:         ctx,
+		stop:        cancel,
+		targetGroup: newTargetGroup(c, pool.take(c.Targets)),
 	}
 
-	p.handleConn(ctx, c)
+	for _, r := range c.Routes {
+		s.routes = append(s.routes, &sniRoute{
+			sni:   r.SNI,
+			group: newTargetGroup(c, pool.take(r.Targets)),
+		})
+	}
+
+	return s, nil
+}
+
+// checkTargetsTLS load tls configuration of targets and mirrors of the
+// server, so invalid certificates are found before the server is changed
+func checkTargetsTLS(c config.ServerConfig) error {
+	hcs := append([]config.HostConfig{}, c.Targets...)
+	for _, r := range c.Routes {
+		hcs = append(hcs, r.Targets...)
+	}
+	for _, mc := range getMirrors(c) {
+		hcs = append(hcs, mc.HostConfig)
+	}
+
+	for _, hc := range hcs {
+		if !hc.IsSimple() && !hc.IsMutual() {
+			continue
+		}
+
+		if _, err := getTLSConfig(hc.TLSConfig); err != nil {
+			return errors.New(hc.Address(), err.Error())
+		}
+	}
+
+	return nil
 }
 
-// handleConn accept incoming connection and forward it
-func (p *Proxy) handleConn(ctx context.Context, c config.ServerConfig) {
+// setState replace the current state, stop health checks of the previous
+// state and start health checks of the new state. Cached crl and ocsp
+// responses are refreshed while a state that use them is set
+func (p *Proxy) setState(s *proxyState) {
+	if prev := p.state.Swap(s); prev != nil {
+		prev.stop()
+	}
+
+	p.runHealthChecks(s.ctx, s.balancer.Targets())
+	for _, r := range s.routes {
+		p.runHealthChecks(s.ctx, r.group.balancer.Targets())
+	}
+
+	if usesRevocation(s.conf) {
+		startRevocationRefresh(s.ctx)
+	}
+}
+
+// handleConn accept incoming connection and forward it, the connection is
+// closed when killCtx is canceled
+func (p *Proxy) handleConn(ctx, killCtx context.Context, c config.ServerConfig) {
 	for {
 		srcConn, err := p.Listener.Accept()
 		if err != nil {
@@ -110,86 +442,255 @@ func (p *Proxy) handleConn(ctx context.Context, c config.ServerConfig) {
 					Str("name", c.Name).
 					Msg("connection error")
 				downstreamConnErr.With(prometheus.Labels{"name": p.Name}).Inc()
+				continue
 			}
 		}
 
 		downstreamConnActive.With(prometheus.Labels{"name": p.Name}).Inc()
 		downstreamConnTotal.With(prometheus.Labels{"name": p.Name}).Inc()
 
-		if !timeoutIsZero(c.Listener) {
-			srcConn.SetDeadline(time.Now().Add(c.Listener.TimeoutDuration))
-		}
-
-		if err := isTLSConn(srcConn); err != nil {
-			log.Error().Err(err).Msg("connection error")
-			srcConn.Close()
-			downstreamConnErr.With(prometheus.Labels{"name": p.Name}).Inc()
-			continue
-		}
+		// tls handshake and PROXY protocol header is handled outside the
+		// accept loop, so slow clients can't block new connections
+		atomic.AddInt64(&p.active, 1)
 
 		p.Wg.Add(1)
 		go func() {
-			p.forwardConn(ctx, c, srcConn)
-			p.Wg.Done()
-			downstreamConnActive.With(prometheus.Labels{"name": p.Name}).Dec()
+			defer p.Wg.Done()
+			defer atomic.AddInt64(&p.active, -1)
+			defer downstreamConnActive.With(prometheus.Labels{"name": p.Name}).Dec()
+
+			done := make(chan struct{})
+			defer close(done)
+
+			go p.killConn(killCtx, done, srcConn)
+
+			if err := readProxyProto(srcConn); err != nil {
+				log.Error().Err(err).Msg("connection error")
+				srcConn.Close()
+				downstreamConnErr.With(prometheus.Labels{"name": p.Name}).Inc()
+				return
+			}
+
+			s := p.state.Load()
+			g := s.targetGroup
+
+			if c.Listener.TLSConfig.IsPassthrough() {
+				serverName, peeked, err := peekClientHello(srcConn)
+				if err != nil {
+					log.Error().
+						Err(err).
+						Str("client", srcConn.RemoteAddr().String()).
+						Msg("failed to read tls client hello")
+					srcConn.Close()
+					downstreamConnErr.With(prometheus.Labels{"name": p.Name}).Inc()
+					return
+				}
+
+				srcConn = peeked
+				g = s.route(serverName)
+
+				log.Debug().
+					Str("name", c.Name).
+					Str("sni", serverName).
+					Msg("routing tls passthrough connection")
+			}
+
+			conn := setDeadline(srcConn, c.Listener.ConnectionConfig)
+
+			if err := isTLSConn(srcConn); err != nil {
+				log.Error().
+					Err(err).
+					Str("client", srcConn.RemoteAddr().String()).
+					Msg("connection error")
+				srcConn.Close()
+				downstreamConnErr.With(prometheus.Labels{"name": p.Name}).Inc()
+				if goerrors.Is(err, errSANNotAllowed) {
+					downstreamSANReject.With(prometheus.Labels{"name": p.Name}).Inc()
+				}
+				return
+			}
+
+			if tc, ok := srcConn.(*tls.Conn); ok && tc.ConnectionState().DidResume {
+				downstreamTLSResumed.With(prometheus.Labels{"name": p.Name}).Inc()
+			}
+
+			p.forwardConn(s.conf, g, conn)
 		}()
 	}
 }
 
-// forwardConn forward source connection to rarget or destination
-func (p *Proxy) forwardConn(ctx context.Context, c config.ServerConfig, srcConn net.Conn) {
-	targetConn, targetWr, tConf, err := getTargets(c)
+// killConn close the connection when killCtx is canceled before the
+// connection is done
+func (p *Proxy) killConn(killCtx context.Context, done chan struct{}, conn net.Conn) {
+	select {
+	case <-killCtx.Done():
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		atomic.AddInt64(&p.killed, 1)
+
+		// underlying connection is closed, so closing tls connection
+		// doesn't wait for pending handshake or write
+		if tc, ok := conn.(*tls.Conn); ok {
+			tc.NetConn().Close()
+			return
+		}
+		conn.Close()
+	case <-done:
+	}
+}
+
+// forwardConn forward source connection to target in the target group
+func (p *Proxy) forwardConn(c config.ServerConfig, g *targetGroup, srcConn net.Conn) {
+	id := atomic.AddUint64(&p.connID, 1)
+
+	// target response is only captured when a mirror in compare mode is
+	// sampled for the connection
+	mirrors := sampleMirrors(c)
+	primary := newPrimaryCapture(mirrors)
+	defer primary.finish()
+
+	targetConn, targetWr, tConf, err := p.getTargets(c, g, newProxyHeader(srcConn), id, mirrors, primary)
 	if err != nil {
 		log.Error().
 			Err(err).
 			Str("name", c.Name).
+			Str("client", srcConn.RemoteAddr().String()).
 			Msg("failed to get targets")
 		srcConn.Close()
 		return
 	}
 
-	// Close long-lived connections to targets that have no timeout configured forcefully on shutdown.
-	if timeoutIsZero(tConf) {
-		p.Wg.Add(1)
-		go func() {
-			<-ctx.Done()
-			closeConn(targetConn)
-
-			p.Wg.Done()
-		}()
-	}
-
 	defer srcConn.Close()
 	defer closeConn(targetConn)
 	defer upstreamConnActive.With(prometheus.Labels{"host": tConf.Host, "port": tConf.Port}).Dec()
+	defer tConf.release()
+
+	oc := targetConn[0].(*outlierConn)
+	done := make(chan struct{})
 
 	p.Wg.Add(1)
 	go func() {
+		defer p.Wg.Done()
+		defer close(done)
 		defer srcConn.Close()
 		defer closeConn(targetConn)
 
-		_, err := io.Copy(srcConn, targetConn[0])
-		errCopy(err, tConf)
+		var dst io.Writer = srcConn
+		if primary != nil {
+			dst = io.MultiWriter(srcConn, primary)
+		}
 
-		p.Wg.Done()
+		_, err := io.Copy(dst, oc)
+		primary.finish()
+		errCopy(err, tConf.HostConfig)
 	}()
 
 	upstreamConnActive.With(prometheus.Labels{"host": tConf.Host, "port": tConf.Port}).Inc()
 	upstreamConnTotal.With(prometheus.Labels{"host": tConf.Host, "port": tConf.Port}).Inc()
 
 	_, err = io.Copy(targetWr, srcConn)
-	errCopy(err, tConf)
+	errCopy(err, tConf.HostConfig)
+
+	// outlier detection is updated after both sides are finished, so
+	// errors of the target are not missed
+	srcConn.Close()
+	closeConn(targetConn)
+	<-done
+
+	if oc.hasFailed() {
+		g.outlier.failure(tConf)
+		return
+	}
+
+	g.outlier.success(tConf)
 }
 
+// Shutdown stop accepting new connections and wait for in-flight
+// connections to finish until the drain timeout, the remaining connections
+// are closed forcefully after that
 func (p *Proxy) Shutdown() {
 	p.Lock()
+	// in-flight connections are counted before the listener is closed,
+	// udp sessions are closed as soon as the listener is closed
+	inflight := atomic.LoadInt64(&p.active)
 	if p.Quit != nil {
 		p.Quit()
 		p.Quit = nil
 	}
+	p.serve = nil
+	if s := p.state.Load(); s != nil {
+		s.stop()
+	}
 	if p.Listener != nil {
 		p.Listener.Close()
 	}
-	p.Wg.Wait()
+	if p.PacketConn != nil {
+		p.PacketConn.Close()
+	}
+	kill := p.kill
+	p.kill = nil
 	p.Unlock()
+
+	timeout := drainTimeout(p.Config())
+
+	done := make(chan struct{})
+	go func() {
+		p.Wg.Wait()
+		close(done)
+	}()
+
+	if inflight > 0 {
+		log.Info().
+			Str("name", p.Name).
+			Int64("connections", inflight).
+			Dur("timeout", timeout).
+			Msg("draining connections")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		if kill != nil {
+			kill()
+		}
+		<-done
+	}
+
+	killed := atomic.SwapInt64(&p.killed, 0)
+
+	if kill != nil {
+		kill()
+	}
+
+	if inflight == 0 {
+		return
+	}
+
+	drained := inflight - killed
+	if drained < 0 {
+		drained = 0
+	}
+
+	downstreamConnDrain.With(prometheus.Labels{"name": p.Name}).Add(float64(drained))
+	downstreamConnKilled.With(prometheus.Labels{"name": p.Name}).Add(float64(killed))
+
+	log.Info().
+		Str("name", p.Name).
+		Int64("drained", drained).
+		Int64("killed", killed).
+		Msg("connections drained")
+}
+
+// drainTimeout returns drain timeout of the server, default drain timeout is
+// used when it's not configured
+func drainTimeout(c config.ServerConfig) time.Duration {
+	if c.DrainTimeout == "" {
+		return defaultDrainTimeout
+	}
+
+	return c.DrainDuration
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"log"
+	"net"
 	"strings"
 	"sync"
 	"syscall"
@@ -13,6 +14,8 @@ import (
 
 	"github.com/nothinux/octo-proxy/pkg/config"
 	"github.com/nothinux/octo-proxy/pkg/testhelper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var (
@@ -418,7 +421,8 @@ func TestProxyWithMutualTLSWithConfiguredCRLWithRevokedServerCert(t *testing.T)
 	p.Shutdown()
 }
 
-func TestProxyMutualTLSWhenClientUsingInvalidCertificate(t *testing.T) {
+// client certificate doesn't need to have the client ip address
+func TestProxyMutualTLSWhenClientCertificateWithoutClientIP(t *testing.T) {
 	var wg sync.WaitGroup
 	result := make(chan []byte)
 
@@ -456,13 +460,78 @@ func TestProxyMutualTLSWhenClientUsingInvalidCertificate(t *testing.T) {
 			Key:    "../testdata/localhost-key.pem",
 		},
 	}
+	if err := SendData(hc, messageByte, false); err != nil {
+		t.Fatal(err)
+	}
 
 	// check data received by test server
-	t.Run("test get response from octo-proxy", func(t *testing.T) {
-		if err := SendData(hc, messageByte, true); err != nil {
-			if !strings.Contains(err.Error(), "tls: bad certificate") {
-				t.Fatalf("got %v, want response contain tls: bad certificate", err)
-			}
+	t.Run("test message received is same", func(t *testing.T) {
+		res := <-result
+
+		r := bytes.Compare(messageByte, res)
+		if r != 0 {
+			t.Fatalf("got %v, want %v", res, messageByte)
+		}
+	})
+
+	// shutdown octo-proxy
+	p.Shutdown()
+}
+
+func TestProxyMutualTLSWhenClientNotAllowedBySubjectAltNames(t *testing.T) {
+	var wg sync.WaitGroup
+	result := make(chan []byte)
+
+	// start target server
+	backend := testhelper.RunTestServer(&wg, result)
+
+	// prepare configuration for octo proxy
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{backend}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerConfigs[0].Listener.TLSConfig = config.TLSConfig{
+		Mode:   "mutual",
+		Cert:   "../testdata/cert.pem",
+		Key:    "../testdata/cert-key.pem",
+		CaCert: "../testdata/ca-cert.pem",
+		Role:   config.Role{Server: true},
+		SubjectAltName: config.SubjectAltName{
+			DNS: []string{"*.example.com"},
+		},
+	}
+
+	p := New("test-proxy-san")
+	go func() {
+		p.Run(cfg.ServerConfigs[0])
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	// send data to octo-proxy
+	hc := config.HostConfig{
+		Host: "127.0.0.1",
+		Port: "9000",
+		TLSConfig: config.TLSConfig{
+			Mode:   "mutual",
+			CaCert: "../testdata/ca-cert.pem",
+			Cert:   "../testdata/client.pem",
+			Key:    "../testdata/client-key.pem",
+		},
+	}
+
+	t.Run("test client certificate is rejected", func(t *testing.T) {
+		if err := SendData(hc, messageByte, true); err == nil {
+			t.Fatalf("client certificate must be rejected")
+		}
+
+		labels := prometheus.Labels{"name": "test-proxy-san"}
+		for i := 0; i < 10 && testutil.ToFloat64(downstreamSANReject.With(labels)) == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if got := testutil.ToFloat64(downstreamSANReject.With(labels)); got != 1 {
+			t.Fatalf("got %v, want %v", got, 1)
 		}
 	})
 
@@ -890,6 +959,8 @@ func TestProxyWithZeroTimeout(t *testing.T) {
 	}
 	// set timeout for target
 	cfg.ServerConfigs[0].Targets[0].TimeoutDuration = 0 * time.Second
+	// close connection without waiting on shutdown
+	cfg.ServerConfigs[0].DrainTimeout = "0"
 
 	p := New("test-proxy")
 	go func() {
@@ -944,3 +1015,341 @@ func TestProxyWithZeroTimeout(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestProxyWithIdleTimeout(t *testing.T) {
+	var wg sync.WaitGroup
+	result := make(chan []byte, 1)
+
+	// start target server that never send response
+	backend := testhelper.RunTestServer(&wg, result)
+
+	// start octo proxy
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{backend}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// set idle timeout for listener
+	cfg.ServerConfigs[0].Listener.IdleTimeoutDuration = 500 * time.Millisecond
+
+	p := New("test-proxy")
+	go func() {
+		p.Run(cfg.ServerConfigs[0])
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	t.Run("test idle connection is closed", func(t *testing.T) {
+		d, err := dialTarget(cfg.ServerConfigs[0].Listener)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		if _, err := d.Write(messageByte); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+
+		buf := make([]byte, 5)
+		_, err = d.Read(buf)
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("got %v, want %v", err, io.EOF)
+		}
+
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("connection must be closed by idle timeout")
+		}
+	})
+
+	// shutdown octo-proxy
+	p.Shutdown()
+}
+
+func TestProxyUpdate(t *testing.T) {
+	var wg sync.WaitGroup
+	resultA := make(chan []byte)
+	resultB := make(chan []byte)
+
+	backendA := testhelper.RunTestServer(&wg, resultA)
+	backendB := testhelper.RunTestServer(&wg, resultB)
+
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{backendA}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New("test-proxy-update")
+	go func() {
+		p.Run(cfg.ServerConfigs[0])
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	p.Lock()
+	l := p.Listener
+	p.Unlock()
+
+	// connection opened before update keeps using the previous target
+	conn, err := dialTarget(cfg.ServerConfigs[0].Listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait until the connection is forwarded to the target
+	time.Sleep(100 * time.Millisecond)
+
+	updated, err := config.GenerateConfig("127.0.0.1:9000", []string{backendB}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Update(updated.ServerConfigs[0])
+
+	t.Run("test listener is not changed", func(t *testing.T) {
+		p.Lock()
+		defer p.Unlock()
+
+		if p.Listener != l {
+			t.Fatalf("listener must not be changed")
+		}
+	})
+
+	t.Run("test existing connection use the previous target", func(t *testing.T) {
+		if _, err := conn.Write(messageByte); err != nil {
+			t.Fatal(err)
+		}
+
+		if res := <-resultA; !bytes.Equal(res, messageByte) {
+			t.Fatalf("got %v, want %v", res, messageByte)
+		}
+	})
+
+	t.Run("test new connection use the updated target", func(t *testing.T) {
+		if err := SendData(cfg.ServerConfigs[0].Listener, messageByte, false); err != nil {
+			t.Fatal(err)
+		}
+
+		if res := <-resultB; !bytes.Equal(res, messageByte) {
+			t.Fatalf("got %v, want %v", res, messageByte)
+		}
+	})
+
+	t.Run("test config is updated", func(t *testing.T) {
+		if got := p.Config().Targets[0].Address(); got != backendB {
+			t.Fatalf("got %v, want %v", got, backendB)
+		}
+	})
+
+	conn.Close()
+	p.Shutdown()
+}
+
+func TestProxyListenError(t *testing.T) {
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{"127.0.0.1:80"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("test tls certificate can't be loaded", func(t *testing.T) {
+		c := cfg.ServerConfigs[0]
+		c.Listener.TLSConfig = config.TLSConfig{
+			Mode: "simple",
+			Cert: "../testdata/notfound.pem",
+			Key:  "../testdata/cert-key.pem",
+		}
+
+		p := New("test-proxy")
+
+		err := p.Run(c)
+		if err == nil || !strings.Contains(err.Error(), "failed to get TLS config") {
+			t.Fatalf("got %v, want failed to get TLS config error", err)
+		}
+
+		// listener must not be bound when tls config is invalid
+		l, err := net.Listen("tcp", "127.0.0.1:9000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	})
+
+	t.Run("test port is already used", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:9000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		p := New("test-proxy")
+
+		err = p.Run(cfg.ServerConfigs[0])
+		if err == nil || !strings.Contains(err.Error(), "failed to listen") {
+			t.Fatalf("got %v, want failed to listen error", err)
+		}
+	})
+
+	t.Run("test proxy is not served after shutdown", func(t *testing.T) {
+		p := New("test-proxy")
+
+		if err := p.Listen(cfg.ServerConfigs[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		p.Shutdown()
+
+		if err := p.Serve(); err == nil {
+			t.Fatalf("Serve must return error")
+		}
+
+		if _, err := net.DialTimeout("tcp", "127.0.0.1:9000", time.Second); err == nil {
+			t.Fatalf("listener must be closed")
+		}
+	})
+}
+
+func TestProxyListenerFile(t *testing.T) {
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{"127.0.0.1:80"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New("test-proxy")
+
+	if _, err := p.ListenerFile(); err == nil {
+		t.Fatalf("ListenerFile must return error before listen")
+	}
+
+	if err := p.Listen(cfg.ServerConfigs[0]); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	f, err := p.ListenerFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.File.Close()
+
+	if f.Network != "tcp" || f.Address != "127.0.0.1:9000" {
+		t.Fatalf("got %v://%v, want %v", f.Network, f.Address, "tcp://127.0.0.1:9000")
+	}
+
+	// the copy keeps the socket open after the listener is closed
+	l, err := net.FileListener(f.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if l.Addr().String() != "127.0.0.1:9000" {
+		t.Fatalf("got %v, want %v", l.Addr(), "127.0.0.1:9000")
+	}
+}
+
+func TestProxyShutdownDrain(t *testing.T) {
+	backend := testhelper.RunEchoServer(t)
+
+	run := func(t *testing.T, name, drainTimeout string) (*Proxy, net.Conn) {
+		cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{backend}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := time.ParseDuration(drainTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.ServerConfigs[0].DrainTimeout = drainTimeout
+		cfg.ServerConfigs[0].DrainDuration = d
+
+		p := New(name)
+		go func() {
+			p.Run(cfg.ServerConfigs[0])
+		}()
+
+		time.Sleep(500 * time.Millisecond)
+
+		conn, err := net.Dial("tcp", "127.0.0.1:9000")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		echo(t, conn)
+
+		return p, conn
+	}
+
+	t.Run("test in-flight connection is drained", func(t *testing.T) {
+		p, conn := run(t, "test-proxy-drain", "5s")
+
+		done := make(chan struct{})
+		go func() {
+			p.Shutdown()
+			close(done)
+		}()
+
+		time.Sleep(200 * time.Millisecond)
+
+		if _, err := net.DialTimeout("tcp", "127.0.0.1:9000", time.Second); err == nil {
+			t.Fatalf("new connection must be rejected while draining")
+		}
+
+		// in-flight connection keeps working until it's closed
+		echo(t, conn)
+		conn.Close()
+
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("shutdown must return after connection is finished")
+		}
+
+		labels := prometheus.Labels{"name": "test-proxy-drain"}
+		if got := testutil.ToFloat64(downstreamConnDrain.With(labels)); got != 1 {
+			t.Fatalf("got %v drained connection, want %v", got, 1)
+		}
+
+		if got := testutil.ToFloat64(downstreamConnKilled.With(labels)); got != 0 {
+			t.Fatalf("got %v killed connection, want %v", got, 0)
+		}
+	})
+
+	t.Run("test connection is killed after drain timeout", func(t *testing.T) {
+		p, conn := run(t, "test-proxy-kill", "200ms")
+		defer conn.Close()
+
+		start := time.Now()
+		p.Shutdown()
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("shutdown took %v, must return after drain timeout", elapsed)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("connection must be closed")
+		}
+
+		labels := prometheus.Labels{"name": "test-proxy-kill"}
+		if got := testutil.ToFloat64(downstreamConnKilled.With(labels)); got != 1 {
+			t.Fatalf("got %v killed connection, want %v", got, 1)
+		}
+	})
+}
+
+func echo(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write(messageByte); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(messageByte))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if !bytes.Equal(buf, messageByte) {
+		t.Fatalf("got %s, want %s", buf, messageByte)
+	}
+}
@@ -0,0 +1,486 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+)
+
+var (
+	// proxyProtoV1Prefix is the beginning of PROXY protocol v1 header
+	proxyProtoV1Prefix = []byte("PROXY ")
+	// proxyProtoV2Signature is the beginning of PROXY protocol v2 header
+	proxyProtoV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// proxyProtoV1MaxLength is maximum length of PROXY protocol v1 header including CRLF
+	proxyProtoV1MaxLength = 107
+
+	proxyProtoV2Local = 0x0
+	proxyProtoV2Proxy = 0x1
+
+	proxyProtoV2TCP4 = 0x11
+	proxyProtoV2UDP4 = 0x12
+	proxyProtoV2TCP6 = 0x21
+	proxyProtoV2UDP6 = 0x22
+)
+
+// proxyProtoListener wrap accepted connections to read PROXY protocol header
+type proxyProtoListener struct {
+	net.Listener
+	config config.ProxyProtocolConfig
+}
+
+func newProxyProtoListener(l net.Listener, c config.ProxyProtocolConfig) net.Listener {
+	return &proxyProtoListener{
+		Listener: l,
+		config:   c,
+	}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtoConn{
+		Conn:   c,
+		r:      bufio.NewReader(c),
+		config: l.config,
+	}, nil
+}
+
+// proxyProtoConn read PROXY protocol header on the first Read, RemoteAddr or
+// LocalAddr call, so the header is never read in the accept loop. Connections
+// from untrusted sources are passed through without reading the header.
+type proxyProtoConn struct {
+	net.Conn
+	r            *bufio.Reader
+	config       config.ProxyProtocolConfig
+	once         sync.Once
+	err          error
+	remote       net.Addr
+	local        net.Addr
+	readDeadline time.Time
+	mu           sync.Mutex
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns client address sent in PROXY protocol header
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns destination address sent in PROXY protocol header
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtoConn) readHeader() {
+	if !c.config.IsTrusted(addrIP(c.Conn.RemoteAddr())) {
+		return
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(c.config.TimeoutDuration))
+
+	c.remote, c.local, c.err = readProxyProtoHeader(c.r)
+	if c.err != nil {
+		c.err = fmt.Errorf("failed to read proxy protocol header from %s: %w", c.Conn.RemoteAddr(), c.err)
+	}
+
+	// restore read deadline set before the header is read
+	c.mu.Lock()
+	c.Conn.SetReadDeadline(c.readDeadline)
+	c.mu.Unlock()
+}
+
+// readProxyProto read PROXY protocol header of plain connection, tls
+// connection read the header during tls handshake
+func readProxyProto(nc net.Conn) error {
+	if c, ok := nc.(*proxyProtoConn); ok {
+		c.once.Do(c.readHeader)
+		return c.err
+	}
+
+	return nil
+}
+
+// readProxyProtoHeader read PROXY protocol v1 or v2 header, nil address is
+// returned when the header doesn't carry the client address
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV1Prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(sig, proxyProtoV1Prefix) {
+		return readProxyProtoV1(r)
+	}
+
+	sig, err = r.Peek(len(proxyProtoV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(sig, proxyProtoV2Signature) {
+		return readProxyProtoV2(r)
+	}
+
+	return nil, nil, fmt.Errorf("invalid signature")
+}
+
+// readProxyProtoV1 read header in format
+// PROXY TCP4|TCP6|UNKNOWN <src ip> <dst ip> <src port> <dst port>\r\n
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+
+	for len(line) < proxyProtoV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("v1 header is too long")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) < 2 {
+		return nil, nil, fmt.Errorf("invalid v1 header")
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid v1 header")
+	}
+
+	src, err := parseProxyProtoV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dst, err := parseProxyProtoV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyProtoV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 address %s", host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 port %s", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyProtoV2 read binary header, TLVs are skipped
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	if header[12]>>4 != 0x2 {
+		return nil, nil, fmt.Errorf("not supported v2 version")
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case proxyProtoV2Local:
+		return nil, nil, nil
+	case proxyProtoV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("not supported v2 command")
+	}
+
+	var ipLen int
+	switch header[13] {
+	case proxyProtoV2TCP4, proxyProtoV2UDP4:
+		ipLen = net.IPv4len
+	case proxyProtoV2TCP6, proxyProtoV2UDP6:
+		ipLen = net.IPv6len
+	default:
+		// address family is not supported, e.g. unix socket
+		return nil, nil, nil
+	}
+
+	if len(payload) < ipLen*2+4 {
+		return nil, nil, fmt.Errorf("v2 address is too short")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[ipLen*2:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : ipLen*2]),
+		Port: int(binary.BigEndian.Uint16(payload[ipLen*2+2:])),
+	}
+
+	return src, dst, nil
+}
+
+// addrIP returns ip address of tcp address, nil is returned for other address
+func addrIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+
+	return nil
+}
+
+const (
+	proxyProtoV2Unspec = 0x00
+
+	proxyProtoV2TypeALPN      = 0x01
+	proxyProtoV2TypeAuthority = 0x02
+	proxyProtoV2TypeSSL       = 0x20
+	proxyProtoV2SubtypeSSLVer = 0x21
+	proxyProtoV2SubtypeSSLCN  = 0x22
+
+	proxyProtoV2ClientSSL      = 0x01
+	proxyProtoV2ClientCertConn = 0x02
+)
+
+// proxyHeader hold downstream client information sent to targets in
+// PROXY protocol header
+type proxyHeader struct {
+	src        net.Addr
+	dst        net.Addr
+	tls        bool
+	tlsVersion string
+	alpn       string
+	sni        string
+	cn         string
+	verified   bool
+}
+
+// newProxyHeader returns client information of downstream connection, tls
+// information is only available when the listener terminates tls
+func newProxyHeader(conn net.Conn) *proxyHeader {
+	h := &proxyHeader{
+		src: conn.RemoteAddr(),
+		dst: conn.LocalAddr(),
+	}
+
+	if ic, ok := conn.(*idleConn); ok {
+		conn = ic.Conn
+	}
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+
+		h.tls = true
+		h.tlsVersion = sslVersionName(cs.Version)
+		h.alpn = cs.NegotiatedProtocol
+		h.sni = cs.ServerName
+
+		if len(cs.VerifiedChains) > 0 {
+			h.cn = cs.PeerCertificates[0].Subject.CommonName
+			h.verified = true
+		}
+	}
+
+	return h
+}
+
+// sslVersionName returns tls version in the form used by HAProxy, like
+// TLSv1.3
+func sslVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return tls.VersionName(v)
+	}
+}
+
+// encode returns PROXY protocol header, nil header or header without tcp
+// address is encoded as LOCAL command in v2 and UNKNOWN in v1
+func (h *proxyHeader) encode(version string) []byte {
+	var src, dst *net.TCPAddr
+	if h != nil {
+		src, _ = h.src.(*net.TCPAddr)
+		dst, _ = h.dst.(*net.TCPAddr)
+	}
+
+	if version == config.ProxyProtocolV1 {
+		return encodeProxyProtoV1(src, dst)
+	}
+
+	if h == nil {
+		return encodeProxyProtoV2(proxyProtoV2Local, proxyProtoV2Unspec, nil)
+	}
+
+	var family byte = proxyProtoV2Unspec
+	var addr []byte
+
+	if src != nil && dst != nil {
+		if src.IP.To4() != nil && dst.IP.To4() != nil {
+			family = proxyProtoV2TCP4
+			addr = append(addr, src.IP.To4()...)
+			addr = append(addr, dst.IP.To4()...)
+		} else {
+			family = proxyProtoV2TCP6
+			addr = append(addr, src.IP.To16()...)
+			addr = append(addr, dst.IP.To16()...)
+		}
+
+		addr = binary.BigEndian.AppendUint16(addr, uint16(src.Port))
+		addr = binary.BigEndian.AppendUint16(addr, uint16(dst.Port))
+	}
+
+	return encodeProxyProtoV2(proxyProtoV2Proxy, family, append(addr, h.tlvs()...))
+}
+
+// tlvs returns ALPN, authority and SSL TLVs of tls connection
+func (h *proxyHeader) tlvs() []byte {
+	if !h.tls {
+		return nil
+	}
+
+	var b []byte
+
+	if h.alpn != "" {
+		b = appendTLV(b, proxyProtoV2TypeALPN, []byte(h.alpn))
+	}
+
+	if h.sni != "" {
+		b = appendTLV(b, proxyProtoV2TypeAuthority, []byte(h.sni))
+	}
+
+	client := byte(proxyProtoV2ClientSSL)
+	if h.cn != "" {
+		client |= proxyProtoV2ClientCertConn
+	}
+
+	// client flags followed by verify result, zero means the client
+	// certificate is verified, it's non-zero when the client didn't send
+	// a certificate
+	var verify uint32 = 1
+	if h.verified {
+		verify = 0
+	}
+
+	ssl := binary.BigEndian.AppendUint32([]byte{client}, verify)
+	ssl = appendTLV(ssl, proxyProtoV2SubtypeSSLVer, []byte(h.tlsVersion))
+	if h.cn != "" {
+		ssl = appendTLV(ssl, proxyProtoV2SubtypeSSLCN, []byte(h.cn))
+	}
+
+	return appendTLV(b, proxyProtoV2TypeSSL, ssl)
+}
+
+func appendTLV(b []byte, t byte, v []byte) []byte {
+	b = append(b, t)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+
+	return append(b, v...)
+}
+
+func encodeProxyProtoV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port))
+	}
+
+	// both addresses must be ipv6, ipv4 address is written as ipv4-mapped
+	// ipv6 address when the families are different
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(src.IP), ipv6String(dst.IP), src.Port, dst.Port))
+}
+
+// ipv6String returns ip in ipv6 format, ipv4 address is formatted as
+// ipv4-mapped ipv6 address
+func ipv6String(ip net.IP) string {
+	addr, ok := netip.AddrFromSlice(ip.To16())
+	if !ok {
+		return ip.String()
+	}
+
+	return addr.String()
+}
+
+func encodeProxyProtoV2(cmd, family byte, payload []byte) []byte {
+	b := append([]byte{}, proxyProtoV2Signature...)
+	b = append(b, 0x20|cmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+
+	return append(b, payload...)
+}
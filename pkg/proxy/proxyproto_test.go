@@ -0,0 +1,471 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+)
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	v4 := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x30, 0x39, 0x01, 0xbb}
+
+	tests := []struct {
+		Name           string
+		Header         []byte
+		ExpectedRemote string
+		ExpectedLocal  string
+		ExpectedErr    bool
+	}{
+		{
+			Name:           "Test v1 tcp4 header",
+			Header:         []byte("PROXY TCP4 192.168.1.1 192.168.1.2 56324 443\r\n"),
+			ExpectedRemote: "192.168.1.1:56324",
+			ExpectedLocal:  "192.168.1.2:443",
+		},
+		{
+			Name:           "Test v1 tcp6 header",
+			Header:         []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			ExpectedRemote: "[2001:db8::1]:56324",
+			ExpectedLocal:  "[2001:db8::2]:443",
+		},
+		{
+			Name:   "Test v1 unknown header",
+			Header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			Name:        "Test v1 invalid header",
+			Header:      []byte("PROXY TCP4 192.168.1.1\r\n"),
+			ExpectedErr: true,
+		},
+		{
+			Name:           "Test v2 tcp4 header",
+			Header:         encodeProxyProtoV2(proxyProtoV2Proxy, proxyProtoV2TCP4, v4),
+			ExpectedRemote: "10.0.0.1:12345",
+			ExpectedLocal:  "10.0.0.2:443",
+		},
+		{
+			Name:           "Test v2 tcp4 header with tlv",
+			Header:         encodeProxyProtoV2(proxyProtoV2Proxy, proxyProtoV2TCP4, append(v4, 0x04, 0x00, 0x01, 0x00)),
+			ExpectedRemote: "10.0.0.1:12345",
+			ExpectedLocal:  "10.0.0.2:443",
+		},
+		{
+			Name:   "Test v2 local header",
+			Header: encodeProxyProtoV2(proxyProtoV2Local, 0, nil),
+		},
+		{
+			Name:        "Test v2 short address",
+			Header:      encodeProxyProtoV2(proxyProtoV2Proxy, proxyProtoV2TCP4, v4[:4]),
+			ExpectedErr: true,
+		},
+		{
+			Name:        "Test without header",
+			Header:      []byte("GET / HTTP/1.1\r\n\r\n"),
+			ExpectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tt.Header, messageByte...)))
+
+			remote, local, err := readProxyProtoHeader(r)
+			if tt.ExpectedErr {
+				if err == nil {
+					t.Fatalf("got nil, want error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.ExpectedRemote != "" && remote.String() != tt.ExpectedRemote {
+				t.Fatalf("got %v, want %v", remote, tt.ExpectedRemote)
+			}
+
+			if tt.ExpectedLocal != "" && local.String() != tt.ExpectedLocal {
+				t.Fatalf("got %v, want %v", local, tt.ExpectedLocal)
+			}
+
+			if tt.ExpectedRemote == "" && remote != nil {
+				t.Fatalf("got %v, want nil", remote)
+			}
+
+			// data after header must be kept
+			b, _ := io.ReadAll(r)
+			if !bytes.Equal(b, messageByte) {
+				t.Fatalf("got %v, want %v", b, messageByte)
+			}
+		})
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	run := func(t *testing.T, c config.ProxyProtocolConfig, data []byte) (net.Conn, []byte, error) {
+		l, err := net.Listen("tcp", "127.0.0.1:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		pl := newProxyProtoListener(l, c)
+
+		go func() {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+
+			c.Write(data)
+			time.Sleep(500 * time.Millisecond)
+		}()
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		buf := make([]byte, len(messageByte))
+		_, err = io.ReadFull(conn, buf)
+
+		return conn, buf, err
+	}
+
+	header := []byte("PROXY TCP4 192.168.1.1 192.168.1.2 56324 443\r\n")
+
+	t.Run("test client address from trusted source", func(t *testing.T) {
+		conn, b, err := run(t, config.ProxyProtocolConfig{TimeoutDuration: time.Second}, append(header, messageByte...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if conn.RemoteAddr().String() != "192.168.1.1:56324" {
+			t.Fatalf("got %v, want %v", conn.RemoteAddr(), "192.168.1.1:56324")
+		}
+
+		if !bytes.Equal(b, messageByte) {
+			t.Fatalf("got %v, want %v", b, messageByte)
+		}
+	})
+
+	t.Run("test header from untrusted source is not parsed", func(t *testing.T) {
+		_, n, _ := net.ParseCIDR("10.0.0.0/8")
+		c := config.ProxyProtocolConfig{
+			TimeoutDuration: time.Second,
+			TrustedNetworks: []*net.IPNet{n},
+		}
+
+		conn, b, err := run(t, c, messageByte)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if addrIP(conn.RemoteAddr()).String() != "127.0.0.1" {
+			t.Fatalf("got %v, want %v", conn.RemoteAddr(), "127.0.0.1")
+		}
+
+		if !bytes.Equal(b, messageByte) {
+			t.Fatalf("got %v, want %v", b, messageByte)
+		}
+	})
+
+	t.Run("test trusted source without header", func(t *testing.T) {
+		_, _, err := run(t, config.ProxyProtocolConfig{TimeoutDuration: time.Second}, messageByte)
+		if err == nil {
+			t.Fatalf("got nil, want error")
+		}
+	})
+
+	t.Run("test header read timeout", func(t *testing.T) {
+		_, _, err := run(t, config.ProxyProtocolConfig{TimeoutDuration: 100 * time.Millisecond}, []byte("PROXY "))
+		if err == nil {
+			t.Fatalf("got nil, want error")
+		}
+	})
+}
+
+func TestProxyWithProxyProtocol(t *testing.T) {
+	var wg sync.WaitGroup
+	result := make(chan []byte)
+
+	backend := testhelper.RunTestServer(&wg, result)
+
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{backend}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerConfigs[0].Listener.ProxyProtocol = config.ProxyProtocolConfig{
+		Enabled:         true,
+		TimeoutDuration: time.Second,
+	}
+
+	p := New("test-proxy")
+	go func() {
+		p.Run(cfg.ServerConfigs[0])
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	message := append(encodeProxyProtoV2(proxyProtoV2Proxy, proxyProtoV2TCP4, []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x30, 0x39, 0x01, 0xbb}), messageByte...)
+	if err := SendData(cfg.ServerConfigs[0].Listener, message, false); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("test header is not forwarded to target", func(t *testing.T) {
+		res := <-result
+		if !bytes.Equal(res, messageByte) {
+			t.Fatalf("got %v, want %v", res, messageByte)
+		}
+	})
+
+	p.Shutdown()
+}
+
+func TestProxyHeaderEncode(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	tests := []struct {
+		Name           string
+		Header         *proxyHeader
+		Version        string
+		ExpectedRemote string
+		ExpectedLocal  string
+		ExpectedHeader string
+	}{
+		{
+			Name:           "Test v1 tcp4 header",
+			Header:         &proxyHeader{src: src, dst: dst},
+			Version:        config.ProxyProtocolV1,
+			ExpectedRemote: "192.168.1.1:56324",
+			ExpectedLocal:  "192.168.1.2:443",
+		},
+		{
+			Name:           "Test v1 tcp6 header",
+			Header:         &proxyHeader{src: src6, dst: dst6},
+			Version:        config.ProxyProtocolV1,
+			ExpectedRemote: "[2001:db8::1]:56324",
+			ExpectedLocal:  "[2001:db8::2]:443",
+		},
+		{
+			Name:           "Test v1 header with tcp4 client and tcp6 listener",
+			Header:         &proxyHeader{src: src, dst: dst6},
+			Version:        config.ProxyProtocolV1,
+			ExpectedRemote: "192.168.1.1:56324",
+			ExpectedLocal:  "[2001:db8::2]:443",
+			ExpectedHeader: "PROXY TCP6 ::ffff:192.168.1.1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			Name:    "Test v1 header without client",
+			Version: config.ProxyProtocolV1,
+		},
+		{
+			Name:           "Test v2 tcp4 header",
+			Header:         &proxyHeader{src: src, dst: dst},
+			Version:        config.ProxyProtocolV2,
+			ExpectedRemote: "192.168.1.1:56324",
+			ExpectedLocal:  "192.168.1.2:443",
+		},
+		{
+			Name:           "Test v2 tcp6 header",
+			Header:         &proxyHeader{src: src6, dst: dst6},
+			Version:        config.ProxyProtocolV2,
+			ExpectedRemote: "[2001:db8::1]:56324",
+			ExpectedLocal:  "[2001:db8::2]:443",
+		},
+		{
+			Name:    "Test v2 header without client",
+			Version: config.ProxyProtocolV2,
+		},
+		{
+			Name:    "Test v2 header with unix client",
+			Header:  &proxyHeader{src: &net.UnixAddr{Name: "@", Net: "unix"}, dst: &net.UnixAddr{Name: "/run/octo.sock", Net: "unix"}},
+			Version: config.ProxyProtocolV2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			header := tt.Header.encode(tt.Version)
+			if tt.ExpectedHeader != "" && string(header) != tt.ExpectedHeader {
+				t.Fatalf("got %q, want %q", header, tt.ExpectedHeader)
+			}
+
+			r := bufio.NewReader(bytes.NewReader(header))
+
+			remote, local, err := readProxyProtoHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.ExpectedRemote == "" {
+				if remote != nil {
+					t.Fatalf("got %v, want nil", remote)
+				}
+				return
+			}
+
+			if remote.String() != tt.ExpectedRemote {
+				t.Fatalf("got %v, want %v", remote, tt.ExpectedRemote)
+			}
+
+			if local.String() != tt.ExpectedLocal {
+				t.Fatalf("got %v, want %v", local, tt.ExpectedLocal)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderTLVs(t *testing.T) {
+	h := &proxyHeader{
+		tls:        true,
+		tlsVersion: "TLSv1.3",
+		alpn:       "h2",
+		sni:        "octo.local",
+		cn:         "client",
+		verified:   true,
+	}
+
+	tlvs := parseTLVs(t, h.tlvs())
+
+	if string(tlvs[proxyProtoV2TypeALPN]) != "h2" {
+		t.Fatalf("got %s, want %s", tlvs[proxyProtoV2TypeALPN], "h2")
+	}
+
+	if string(tlvs[proxyProtoV2TypeAuthority]) != "octo.local" {
+		t.Fatalf("got %s, want %s", tlvs[proxyProtoV2TypeAuthority], "octo.local")
+	}
+
+	ssl := tlvs[proxyProtoV2TypeSSL]
+	if ssl[0] != proxyProtoV2ClientSSL|proxyProtoV2ClientCertConn {
+		t.Fatalf("got %v, want %v", ssl[0], proxyProtoV2ClientSSL|proxyProtoV2ClientCertConn)
+	}
+
+	if verify := binary.BigEndian.Uint32(ssl[1:5]); verify != 0 {
+		t.Fatalf("got %v, want %v", verify, 0)
+	}
+
+	sub := parseTLVs(t, ssl[5:])
+	if string(sub[proxyProtoV2SubtypeSSLVer]) != "TLSv1.3" {
+		t.Fatalf("got %s, want %s", sub[proxyProtoV2SubtypeSSLVer], "TLSv1.3")
+	}
+
+	if string(sub[proxyProtoV2SubtypeSSLCN]) != "client" {
+		t.Fatalf("got %s, want %s", sub[proxyProtoV2SubtypeSSLCN], "client")
+	}
+
+	// verify result is not zero when client certificate is not verified
+	ssl = parseTLVs(t, (&proxyHeader{tls: true, tlsVersion: "TLSv1.3"}).tlvs())[proxyProtoV2TypeSSL]
+	if verify := binary.BigEndian.Uint32(ssl[1:5]); verify == 0 {
+		t.Fatalf("verify must not be zero without client certificate")
+	}
+
+	if (&proxyHeader{}).tlvs() != nil {
+		t.Fatalf("tlvs must be empty without tls")
+	}
+}
+
+func TestSSLVersionName(t *testing.T) {
+	tests := []struct {
+		Version  uint16
+		Expected string
+	}{
+		{Version: tls.VersionTLS10, Expected: "TLSv1"},
+		{Version: tls.VersionTLS12, Expected: "TLSv1.2"},
+		{Version: tls.VersionTLS13, Expected: "TLSv1.3"},
+	}
+
+	for _, tt := range tests {
+		if got := sslVersionName(tt.Version); got != tt.Expected {
+			t.Fatalf("got %s, want %s", got, tt.Expected)
+		}
+	}
+}
+
+func parseTLVs(t *testing.T, b []byte) map[byte][]byte {
+	tlvs := map[byte][]byte{}
+
+	for len(b) > 0 {
+		if len(b) < 3 {
+			t.Fatalf("invalid tlv %v", b)
+		}
+
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		tlvs[b[0]] = b[3 : 3+l]
+		b = b[3+l:]
+	}
+
+	return tlvs
+}
+
+func TestProxyWithProxyProtocolTarget(t *testing.T) {
+	type result struct {
+		remote  net.Addr
+		message []byte
+	}
+	results := make(chan result, 1)
+
+	target := testhelper.RunServer(t, func(c net.Conn) {
+		defer c.Close()
+
+		r := bufio.NewReader(c)
+		remote, _, err := readProxyProtoHeader(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		buf := make([]byte, len(messageByte))
+		io.ReadFull(r, buf)
+		results <- result{remote, buf}
+	})
+
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{target}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerConfigs[0].Targets[0].ProxyProtocol.Version = config.ProxyProtocolV2
+
+	p := New("test-proxy")
+	go func() {
+		p.Run(cfg.ServerConfigs[0])
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	if err := SendData(cfg.ServerConfigs[0].Listener, messageByte, false); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("test client address is sent to target", func(t *testing.T) {
+		select {
+		case res := <-results:
+			if addrIP(res.remote).String() != "127.0.0.1" {
+				t.Fatalf("got %v, want %v", res.remote, "127.0.0.1")
+			}
+
+			if !bytes.Equal(res.message, messageByte) {
+				t.Fatalf("got %v, want %v", res.message, messageByte)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("target must receive the data")
+		}
+	})
+
+	p.Shutdown()
+}
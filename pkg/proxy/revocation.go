@@ -0,0 +1,634 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	goerrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// revocationRetryInterval is interval to retry loading crl or ocsp
+	// response after it's failed or outdated
+	revocationRetryInterval = time.Minute
+
+	// revocationRefreshInterval is interval of the background refresh of
+	// crl and ocsp responses
+	revocationRefreshInterval = 10 * time.Second
+
+	// revocationIdleTimeout is duration after crl that is not used anymore
+	// is removed from the cache
+	revocationIdleTimeout = 24 * time.Hour
+
+	// defaultOCSPCacheDuration is used when ocsp response doesn't have
+	// next update
+	defaultOCSPCacheDuration = time.Hour
+
+	// maxRevocationSize is maximum size of crl or ocsp response read from
+	// http server
+	maxRevocationSize = 10 << 20
+)
+
+var (
+	errCertificateRevoked = goerrors.New("certificate was revoked")
+	errOCSPNotFetched     = goerrors.New("ocsp response is not fetched yet")
+)
+
+// revocationRefresh hold the background refresh that is shared by every
+// server using crl or ocsp
+var revocationRefresh = struct {
+	sync.Mutex
+	users int
+	stop  context.CancelFunc
+}{}
+
+// startRevocationRefresh start refreshing cached crl and ocsp responses in
+// the background, so the tls handshake doesn't wait for the download. The
+// refresh is stopped when ctx of every caller is canceled
+func startRevocationRefresh(ctx context.Context) {
+	revocationRefresh.Lock()
+	defer revocationRefresh.Unlock()
+
+	if revocationRefresh.users == 0 {
+		rctx, cancel := context.WithCancel(context.Background())
+		revocationRefresh.stop = cancel
+
+		go runRevocationRefresh(rctx)
+	}
+	revocationRefresh.users++
+
+	context.AfterFunc(ctx, func() {
+		revocationRefresh.Lock()
+		defer revocationRefresh.Unlock()
+
+		revocationRefresh.users--
+		if revocationRefresh.users == 0 {
+			revocationRefresh.stop()
+		}
+	})
+}
+
+func runRevocationRefresh(ctx context.Context) {
+	ticker := time.NewTicker(revocationRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			refreshRevocation(now)
+		}
+	}
+}
+
+// usesRevocation returns true when the listener, targets or mirrors of the
+// server check crl or ocsp status
+func usesRevocation(c config.ServerConfig) bool {
+	tcs := []config.TLSConfig{c.Listener.TLSConfig}
+	for _, hc := range c.Targets {
+		tcs = append(tcs, hc.TLSConfig)
+	}
+	for _, r := range c.Routes {
+		for _, hc := range r.Targets {
+			tcs = append(tcs, hc.TLSConfig)
+		}
+	}
+	for _, mc := range getMirrors(c) {
+		tcs = append(tcs, mc.TLSConfig)
+	}
+
+	for _, tc := range tcs {
+		if tc.CRL != "" || tc.OCSP.Enabled || tc.OCSP.Stapling {
+			return true
+		}
+	}
+
+	return false
+}
+
+// refreshRevocation load crl and ocsp responses that need to be refreshed,
+// crl and ocsp responses that are not used anymore are removed
+func refreshRevocation(now time.Time) {
+	crlCache.Lock()
+	crls := make(map[string]*crlEntry, len(crlCache.entries))
+	for k, e := range crlCache.entries {
+		crls[k] = e
+	}
+	crlCache.Unlock()
+
+	for k, e := range crls {
+		e.Lock()
+		idle := now.Sub(e.usedAt) > revocationIdleTimeout
+		e.Unlock()
+
+		if idle {
+			crlCache.Lock()
+			delete(crlCache.entries, k)
+			crlCache.Unlock()
+			continue
+		}
+
+		e.refresh(now)
+	}
+
+	ocspCache.Lock()
+	responses := make(map[string]*ocspEntry, len(ocspCache.entries))
+	for k, e := range ocspCache.entries {
+		responses[k] = e
+	}
+	ocspCache.Unlock()
+
+	for k, e := range responses {
+		e.Lock()
+		expired := !now.Before(e.expireAt)
+		used := e.usedAt.After(e.fetchedAt)
+		e.Unlock()
+
+		if !expired {
+			continue
+		}
+
+		// response of certificate that is not seen since the last
+		// request is removed, so the cache doesn't grow when peers rotate
+		// their certificates
+		if !used {
+			ocspCache.Lock()
+			delete(ocspCache.entries, k)
+			ocspCache.Unlock()
+			continue
+		}
+
+		e.refresh(now)
+	}
+}
+
+type crlEntry struct {
+	sync.Mutex
+	conf      config.TLSConfig
+	crl       *x509.RevocationList
+	modTime   time.Time
+	refreshAt time.Time
+	usedAt    time.Time
+}
+
+var crlCache = struct {
+	sync.Mutex
+	entries map[string]*crlEntry
+}{entries: make(map[string]*crlEntry)}
+
+// crlKey returns cache key of the crl, crl that is used with different refresh
+// intervals is cached separately so each one is refreshed at its own interval
+func crlKey(c config.TLSConfig) string {
+	return c.CRL + "|" + c.CRLRefreshDuration.String()
+}
+
+func getCRLEntry(c config.TLSConfig) *crlEntry {
+	crlCache.Lock()
+	e, ok := crlCache.entries[crlKey(c)]
+	if !ok {
+		e = &crlEntry{conf: c}
+		crlCache.entries[crlKey(c)] = e
+	}
+	crlCache.Unlock()
+
+	e.Lock()
+	e.usedAt = time.Now()
+	e.Unlock()
+
+	return e
+}
+
+// getRevocationList returns crl loaded from file or http distribution point.
+// The crl is loaded again when the refresh interval is passed, when it's
+// outdated, or when the file is changed. The previous crl is kept when the
+// crl can't be loaded
+func getRevocationList(c config.TLSConfig) (*x509.RevocationList, error) {
+	return getCRLEntry(c).refresh(time.Now())
+}
+
+// cachedRevocationList returns the current crl without loading it again, the
+// crl is refreshed in the background. It's used in the tls handshake
+func cachedRevocationList(c config.TLSConfig) (*x509.RevocationList, error) {
+	e := getCRLEntry(c)
+
+	e.Lock()
+	crl := e.crl
+	e.Unlock()
+
+	if crl != nil {
+		return crl, nil
+	}
+
+	return e.refresh(time.Now())
+}
+
+func (e *crlEntry) refresh(now time.Time) (*x509.RevocationList, error) {
+	e.Lock()
+	c, current, modTime, refreshAt := e.conf, e.crl, e.modTime, e.refreshAt
+	e.Unlock()
+
+	var newModTime time.Time
+	if !c.IsCRLURL() {
+		fi, err := os.Stat(c.CRL)
+		if err != nil && current == nil {
+			return nil, err
+		}
+
+		if err == nil {
+			newModTime = fi.ModTime()
+		}
+	}
+
+	if current != nil && now.Before(refreshAt) && newModTime.Equal(modTime) {
+		return current, nil
+	}
+
+	// the crl is loaded without holding the lock, so the current crl can
+	// be used while it's downloaded
+	crl, err := loadRevocationList(c)
+
+	e.Lock()
+	defer e.Unlock()
+
+	if err != nil {
+		if e.crl == nil {
+			return nil, err
+		}
+
+		log.Warn().
+			Err(err).
+			Str("crl", c.CRL).
+			Msg("failed to refresh crl, keep using the current crl")
+
+		e.refreshAt = now.Add(revocationRetryInterval)
+		return e.crl, nil
+	}
+
+	e.crl = crl
+	e.modTime = newModTime
+	e.refreshAt = now.Add(c.CRLRefreshDuration)
+
+	// crl that will be outdated before the next refresh is loaded again
+	// when it's outdated, the distribution point may publish it late, so
+	// it's retried periodically
+	if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(e.refreshAt) {
+		e.refreshAt = crl.NextUpdate
+		if e.refreshAt.Before(now) {
+			e.refreshAt = now.Add(revocationRetryInterval)
+		}
+	}
+
+	return crl, nil
+}
+
+func loadRevocationList(c config.TLSConfig) (*x509.RevocationList, error) {
+	if !c.IsCRLURL() {
+		return getCACRL(c)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Get(c.CRL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download crl, got status %d", resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxRevocationSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCRL(raw)
+}
+
+type ocspEntry struct {
+	sync.Mutex
+	cert      *x509.Certificate
+	issuer    *x509.Certificate
+	conf      config.OCSPConfig
+	resp      *ocsp.Response
+	raw       []byte
+	err       error
+	fetching  bool
+	fetchedAt time.Time
+	expireAt  time.Time
+	usedAt    time.Time
+}
+
+var ocspCache = struct {
+	sync.Mutex
+	entries map[string]*ocspEntry
+}{entries: make(map[string]*ocspEntry)}
+
+// getOCSPEntry returns cached ocsp entry of the certificate, the entry is
+// created when the certificate is seen for the first time
+func getOCSPEntry(cert, issuer *x509.Certificate, c config.OCSPConfig) *ocspEntry {
+	h := sha256.Sum256(issuer.Raw)
+	key := hex.EncodeToString(h[:]) + ":" + cert.SerialNumber.String()
+
+	ocspCache.Lock()
+	e, ok := ocspCache.entries[key]
+	if !ok {
+		e = &ocspEntry{cert: cert, issuer: issuer}
+		ocspCache.entries[key] = e
+	}
+	ocspCache.Unlock()
+
+	e.Lock()
+	e.conf = c
+	e.usedAt = time.Now()
+	e.Unlock()
+
+	return e
+}
+
+// getOCSPResponse returns ocsp response of the certificate, the responder is
+// only called the first time the certificate is seen. The response is
+// refreshed in the background after its next update, failed request is
+// retried after a minute. Response of certificate that is not used anymore is
+// removed after it's expired
+func getOCSPResponse(cert, issuer *x509.Certificate, c config.OCSPConfig) (*ocsp.Response, []byte, error) {
+	e := getOCSPEntry(cert, issuer, c)
+
+	e.Lock()
+	defer e.Unlock()
+
+	if e.fetchedAt.IsZero() {
+		resp, raw, err := fetchOCSPResponse(cert, issuer, c)
+		e.set(resp, raw, err, time.Now())
+	}
+
+	return e.resp, e.raw, e.err
+}
+
+// cachedOCSPResponse returns ocsp response of the certificate without waiting
+// for the responder, the response is fetched in the background when it's not
+// fetched yet. It's used to staple the response in the tls handshake
+func cachedOCSPResponse(cert, issuer *x509.Certificate, c config.OCSPConfig) ([]byte, error) {
+	e := getOCSPEntry(cert, issuer, c)
+
+	e.Lock()
+	fetched, raw, err := !e.fetchedAt.IsZero(), e.raw, e.err
+	e.Unlock()
+
+	if !fetched {
+		go e.prefetch()
+		return nil, errOCSPNotFetched
+	}
+
+	return raw, err
+}
+
+// prefetchOCSP fetch ocsp responses of the listener certificates in the
+// background, so the response can be stapled in the first handshake
+func prefetchOCSP(certs []tls.Certificate, caCert *x509.Certificate, c config.OCSPConfig) {
+	for i := range certs {
+		issuer, err := certificateIssuer(&certs[i], caCert)
+		if err != nil {
+			continue
+		}
+
+		go getOCSPEntry(certs[i].Leaf, issuer, c).prefetch()
+	}
+}
+
+// prefetch fetch ocsp response when it's not fetched yet
+func (e *ocspEntry) prefetch() {
+	e.Lock()
+	if !e.fetchedAt.IsZero() || e.fetching {
+		e.Unlock()
+		return
+	}
+	e.fetching = true
+	cert, issuer, c := e.cert, e.issuer, e.conf
+	e.Unlock()
+
+	resp, raw, err := fetchOCSPResponse(cert, issuer, c)
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.fetching = false
+	if e.fetchedAt.IsZero() {
+		e.set(resp, raw, err, time.Now())
+	}
+}
+
+func (e *ocspEntry) refresh(now time.Time) {
+	e.Lock()
+	cert, issuer, c := e.cert, e.issuer, e.conf
+	e.Unlock()
+
+	resp, raw, err := fetchOCSPResponse(cert, issuer, c)
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.set(resp, raw, err, now)
+}
+
+// set store the ocsp response and the time it's refreshed, the lock must be
+// held
+func (e *ocspEntry) set(resp *ocsp.Response, raw []byte, err error, now time.Time) {
+	e.resp, e.raw, e.err = resp, raw, err
+	e.fetchedAt = now
+
+	e.expireAt = now.Add(revocationRetryInterval)
+	if err == nil {
+		e.expireAt = resp.ThisUpdate.Add(defaultOCSPCacheDuration)
+		if !resp.NextUpdate.IsZero() {
+			e.expireAt = resp.NextUpdate
+		}
+
+		if e.expireAt.Before(now) {
+			e.expireAt = now.Add(revocationRetryInterval)
+		}
+	}
+}
+
+func fetchOCSPResponse(cert, issuer *x509.Certificate, c config.OCSPConfig) (*ocsp.Response, []byte, error) {
+	responder := c.Responder
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			return nil, nil, goerrors.New("certificate doesn't have ocsp server")
+		}
+
+		responder = cert.OCSPServer[0]
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeout := c.TimeoutDuration
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	client := &http.Client{Timeout: timeout}
+
+	resp, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("ocsp responder returned status %d", resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxRevocationSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := ocsp.ParseResponseForCert(raw, cert, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return r, raw, nil
+}
+
+// checkOCSP check ocsp status of the first certificate in the verified
+// chain, the ocsp response stapled by the peer is used when it's valid.
+// Revoked certificate is always rejected, certificate which status can't be
+// checked is only rejected when the policy is hard
+func checkOCSP(chain []*x509.Certificate, staple []byte, c config.OCSPConfig) error {
+	err := ocspStatus(chain, staple, c)
+	if err == nil || goerrors.Is(err, errCertificateRevoked) {
+		return err
+	}
+
+	if c.IsHardFail() {
+		return fmt.Errorf("failed to check ocsp status: %w", err)
+	}
+
+	log.Warn().
+		Err(err).
+		Str("cn", chain[0].Subject.CommonName).
+		Msg("failed to check ocsp status, certificate is allowed because ocsp policy is soft")
+
+	return nil
+}
+
+func ocspStatus(chain []*x509.Certificate, staple []byte, c config.OCSPConfig) error {
+	if len(chain) < 2 {
+		return goerrors.New("certificate issuer is unknown")
+	}
+
+	cert, issuer := chain[0], chain[1]
+
+	var resp *ocsp.Response
+	if len(staple) > 0 {
+		r, err := ocsp.ParseResponseForCert(staple, cert, issuer)
+		if err == nil && (r.NextUpdate.IsZero() || time.Now().Before(r.NextUpdate)) {
+			resp = r
+		}
+	}
+
+	if resp == nil {
+		var err error
+
+		resp, _, err = getOCSPResponse(cert, issuer, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w - CN:%s", errCertificateRevoked, cert.Subject.CommonName)
+	default:
+		return goerrors.New("ocsp status is unknown")
+	}
+}
+
+// stapleOCSP returns GetCertificate function that staple ocsp response to
+// the certificate selected for the client, the certificate is sent without
+// ocsp response when it's not fetched yet or can't be fetched
+func stapleOCSP(ptls *ProxyTLS, caCert *x509.Certificate, c config.OCSPConfig) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	getCertificate := ptls.GetCertificate
+	certs := ptls.Certificates
+
+	return func(h *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		var cert *tls.Certificate
+
+		if getCertificate != nil {
+			var err error
+
+			cert, err = getCertificate(h)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			if len(certs) == 0 {
+				return nil, goerrors.New("no certificate configured")
+			}
+
+			cert = &certs[0]
+		}
+
+		issuer, err := certificateIssuer(cert, caCert)
+		if err != nil {
+			log.Debug().Err(err).Msg("can't staple ocsp response")
+			return cert, nil
+		}
+
+		raw, err := cachedOCSPResponse(cert.Leaf, issuer, c)
+		if goerrors.Is(err, errOCSPNotFetched) {
+			log.Debug().Err(err).Msg("can't staple ocsp response")
+			return cert, nil
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("can't staple ocsp response")
+			return cert, nil
+		}
+
+		stapled := *cert
+		stapled.OCSPStaple = raw
+
+		return &stapled, nil
+	}
+}
+
+// certificateIssuer returns issuer of the certificate from the certificate
+// chain or caCert
+func certificateIssuer(cert *tls.Certificate, caCert *x509.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf == nil {
+		return nil, goerrors.New("certificate is not parsed")
+	}
+
+	if len(cert.Certificate) > 1 {
+		return x509.ParseCertificate(cert.Certificate[1])
+	}
+
+	if caCert != nil && cert.Leaf.CheckSignatureFrom(caCert) == nil {
+		return caCert, nil
+	}
+
+	return nil, goerrors.New("certificate issuer is unknown")
+}
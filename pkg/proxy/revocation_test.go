@@ -0,0 +1,682 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponder is ocsp responder used in tests, certificate status is
+// looked up by serial number, certificate that isn't registered is unknown
+type ocspResponder struct {
+	sync.Mutex
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+	status map[string]int
+	hits   int32
+}
+
+func newOCSPResponder(t *testing.T) (*ocspResponder, *httptest.Server) {
+	r := &ocspResponder{
+		caCert: readCertificate(t, "../testdata/ca-cert.pem"),
+		caKey:  readKeyFile(t, "../testdata/ca-key.pem"),
+		status: make(map[string]int),
+	}
+
+	s := httptest.NewServer(r)
+	t.Cleanup(s.Close)
+
+	return r, s
+}
+
+func (r *ocspResponder) setStatus(cert *x509.Certificate, status int) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.status[cert.SerialNumber.String()] = status
+}
+
+func (r *ocspResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&r.hits, 1)
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	oreq, err := ocsp.ParseRequest(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.Lock()
+	status, ok := r.status[oreq.SerialNumber.String()]
+	r.Unlock()
+	if !ok {
+		status = ocsp.Unknown
+	}
+
+	resp, err := ocsp.CreateResponse(r.caCert, r.caCert, ocsp.Response{
+		Status:       status,
+		SerialNumber: oreq.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+		RevokedAt:    time.Now().Add(-time.Minute),
+	}, r.caKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+func issueLeafCertificate(t *testing.T, cn string) *x509.Certificate {
+	cert, _ := issueCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		DNSNames:    []string{cn},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, readCertificate(t, "../testdata/ca-cert.pem"), readKeyFile(t, "../testdata/ca-key.pem"))
+
+	return cert
+}
+
+func TestCheckOCSP(t *testing.T) {
+	responder, s := newOCSPResponder(t)
+	caCert := readCertificate(t, "../testdata/ca-cert.pem")
+
+	good := issueLeafCertificate(t, "good")
+	responder.setStatus(good, ocsp.Good)
+
+	revoked := issueLeafCertificate(t, "revoked")
+	responder.setStatus(revoked, ocsp.Revoked)
+
+	unknown := issueLeafCertificate(t, "unknown")
+
+	tests := []struct {
+		Name        string
+		Cert        *x509.Certificate
+		Policy      string
+		Responder   string
+		ExpectedErr bool
+	}{
+		{
+			Name:      "test good certificate",
+			Cert:      good,
+			Policy:    config.OCSPPolicyHard,
+			Responder: s.URL,
+		},
+		{
+			Name:        "test revoked certificate with soft policy",
+			Cert:        revoked,
+			Policy:      config.OCSPPolicySoft,
+			Responder:   s.URL,
+			ExpectedErr: true,
+		},
+		{
+			Name:      "test unknown certificate with soft policy",
+			Cert:      unknown,
+			Policy:    config.OCSPPolicySoft,
+			Responder: s.URL,
+		},
+		{
+			Name:        "test unknown certificate with hard policy",
+			Cert:        unknown,
+			Policy:      config.OCSPPolicyHard,
+			Responder:   s.URL,
+			ExpectedErr: true,
+		},
+		{
+			Name:      "test responder is down with soft policy",
+			Cert:      issueLeafCertificate(t, "down-soft"),
+			Policy:    config.OCSPPolicySoft,
+			Responder: "http://127.0.0.1:1",
+		},
+		{
+			Name:        "test responder is down with hard policy",
+			Cert:        issueLeafCertificate(t, "down-hard"),
+			Policy:      config.OCSPPolicyHard,
+			Responder:   "http://127.0.0.1:1",
+			ExpectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			err := checkOCSP([]*x509.Certificate{tt.Cert, caCert}, nil, config.OCSPConfig{
+				Enabled:         true,
+				Policy:          tt.Policy,
+				Responder:       tt.Responder,
+				TimeoutDuration: time.Second,
+			})
+			if tt.ExpectedErr && err == nil {
+				t.Fatalf("checkOCSP must return error")
+			}
+
+			if !tt.ExpectedErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("test ocsp response is cached", func(t *testing.T) {
+		cert := issueLeafCertificate(t, "cached")
+		responder.setStatus(cert, ocsp.Good)
+
+		hits := atomic.LoadInt32(&responder.hits)
+		for i := 0; i < 3; i++ {
+			if err := checkOCSP([]*x509.Certificate{cert, caCert}, nil, config.OCSPConfig{
+				Enabled:   true,
+				Policy:    config.OCSPPolicyHard,
+				Responder: s.URL,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if got := atomic.LoadInt32(&responder.hits) - hits; got != 1 {
+			t.Fatalf("got %v request, want %v", got, 1)
+		}
+	})
+
+	t.Run("test stapled ocsp response is used", func(t *testing.T) {
+		cert := issueLeafCertificate(t, "stapled")
+
+		staple, err := ocsp.CreateResponse(caCert, caCert, ocsp.Response{
+			Status:       ocsp.Revoked,
+			SerialNumber: cert.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, responder.caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hits := atomic.LoadInt32(&responder.hits)
+
+		err = checkOCSP([]*x509.Certificate{cert, caCert}, staple, config.OCSPConfig{
+			Enabled:   true,
+			Policy:    config.OCSPPolicySoft,
+			Responder: s.URL,
+		})
+		if err == nil {
+			t.Fatalf("checkOCSP must return error")
+		}
+
+		if got := atomic.LoadInt32(&responder.hits) - hits; got != 0 {
+			t.Fatalf("got %v request, want %v", got, 0)
+		}
+	})
+}
+
+func TestStapleOCSP(t *testing.T) {
+	responder, s := newOCSPResponder(t)
+	responder.setStatus(readCertificate(t, "../testdata/cert.pem"), ocsp.Good)
+
+	ptls, err := getTLSConfig(config.TLSConfig{
+		Mode:   "simple",
+		Cert:   "../testdata/cert.pem",
+		Key:    "../testdata/cert-key.pem",
+		CaCert: "../testdata/ca-cert.pem",
+		OCSP: config.OCSPConfig{
+			Stapling:        true,
+			Responder:       s.URL,
+			TimeoutDuration: time.Second,
+		},
+		Role: config.Role{Server: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// response is fetched in the background when the listener is loaded
+	waitOCSPResponse(t, readCertificate(t, "../testdata/cert.pem"))
+
+	addr := testhelper.RunTLSServer(t, ptls.Config, tlsHandshake)
+
+	client, err := getTLSConfig(config.TLSConfig{
+		Mode:   "simple",
+		CaCert: "../testdata/ca-cert.pem",
+		SNI:    "localhost",
+		OCSP: config.OCSPConfig{
+			Enabled: true,
+			Policy:  config.OCSPPolicyHard,
+			// client must use the stapled response instead of the responder
+			Responder: "http://127.0.0.1:1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", addr, client.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if len(conn.ConnectionState().OCSPResponse) == 0 {
+		t.Fatalf("ocsp response must be stapled")
+	}
+}
+
+// waitOCSPResponse wait until ocsp response of the certificate is fetched
+func waitOCSPResponse(t *testing.T, cert *x509.Certificate) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ocspCache.Lock()
+		var fetched bool
+		for _, e := range ocspCache.entries {
+			e.Lock()
+			if e.cert.Equal(cert) && !e.fetchedAt.IsZero() {
+				fetched = true
+			}
+			e.Unlock()
+		}
+		ocspCache.Unlock()
+
+		if fetched {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("ocsp response must be fetched")
+}
+
+func writeCRL(t *testing.T, path string, revoked ...*x509.Certificate) []byte {
+	entries := []x509.RevocationListEntry{}
+	for _, c := range revoked {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   c.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+
+	raw, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, readCertificate(t, "../testdata/ca-cert.pem"), readKeyFile(t, "../testdata/ca-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "" {
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: raw}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return raw
+}
+
+func TestGetRevocationList(t *testing.T) {
+	cert := issueLeafCertificate(t, "crl")
+
+	t.Run("test crl is loaded again when the file changed", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "crl.pem")
+		writeCRL(t, path)
+
+		c := config.TLSConfig{
+			CRL:        path,
+			TLSOptions: config.TLSOptions{CRLRefreshDuration: time.Hour},
+		}
+
+		crl, err := getRevocationList(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(crl.RevokedCertificateEntries) != 0 {
+			t.Fatalf("got %v revoked certificate, want %v", len(crl.RevokedCertificateEntries), 0)
+		}
+
+		writeCRL(t, path, cert)
+		touchFiles(t, path)
+
+		crl, err = getRevocationList(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(crl.RevokedCertificateEntries) != 1 {
+			t.Fatalf("got %v revoked certificate, want %v", len(crl.RevokedCertificateEntries), 1)
+		}
+
+		// broken crl is ignored and the current crl is kept
+		if err := os.WriteFile(path, []byte("broken"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		touchFiles(t, path)
+
+		crl, err = getRevocationList(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(crl.RevokedCertificateEntries) != 1 {
+			t.Fatalf("got %v revoked certificate, want %v", len(crl.RevokedCertificateEntries), 1)
+		}
+	})
+
+	t.Run("test crl is downloaded from url and refreshed", func(t *testing.T) {
+		var mu sync.Mutex
+		var hits int
+		raw := writeCRL(t, "")
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			hits++
+			w.Write(raw)
+		}))
+		defer s.Close()
+
+		c := config.TLSConfig{
+			CRL:        s.URL + "/ca.crl",
+			TLSOptions: config.TLSOptions{CRLRefreshDuration: 100 * time.Millisecond},
+		}
+
+		if _, err := getRevocationList(c); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		raw = writeCRL(t, "", cert)
+		mu.Unlock()
+
+		// crl is cached until refresh interval passed
+		crl, err := getRevocationList(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(crl.RevokedCertificateEntries) != 0 {
+			t.Fatalf("got %v revoked certificate, want %v", len(crl.RevokedCertificateEntries), 0)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+
+		crl, err = getRevocationList(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(crl.RevokedCertificateEntries) != 1 {
+			t.Fatalf("got %v revoked certificate, want %v", len(crl.RevokedCertificateEntries), 1)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if hits != 2 {
+			t.Fatalf("got %v request, want %v", hits, 2)
+		}
+	})
+
+	t.Run("test crl is refreshed in the background", func(t *testing.T) {
+		var hits int32
+		var mu sync.Mutex
+		raw := writeCRL(t, "")
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			atomic.AddInt32(&hits, 1)
+			w.Write(raw)
+		}))
+		defer s.Close()
+
+		c := config.TLSConfig{
+			CRL:        s.URL + "/background.crl",
+			TLSOptions: config.TLSOptions{CRLRefreshDuration: time.Hour},
+		}
+
+		if _, err := getRevocationList(c); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		raw = writeCRL(t, "", cert)
+		mu.Unlock()
+
+		crlCache.Lock()
+		e := crlCache.entries[crlKey(c)]
+		crlCache.Unlock()
+
+		e.Lock()
+		e.refreshAt = time.Now().Add(-time.Second)
+		e.Unlock()
+
+		// crl used in the handshake is not downloaded even when it needs
+		// to be refreshed
+		crl, err := cachedRevocationList(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(crl.RevokedCertificateEntries) != 0 {
+			t.Fatalf("got %v revoked certificate, want %v", len(crl.RevokedCertificateEntries), 0)
+		}
+
+		if got := atomic.LoadInt32(&hits); got != 1 {
+			t.Fatalf("got %v request, want %v", got, 1)
+		}
+
+		refreshRevocation(time.Now())
+
+		crl, err = cachedRevocationList(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(crl.RevokedCertificateEntries) != 1 {
+			t.Fatalf("got %v revoked certificate, want %v", len(crl.RevokedCertificateEntries), 1)
+		}
+
+		if got := atomic.LoadInt32(&hits); got != 2 {
+			t.Fatalf("got %v request, want %v", got, 2)
+		}
+	})
+}
+
+func TestRefreshOCSPResponse(t *testing.T) {
+	responder, s := newOCSPResponder(t)
+	caCert := readCertificate(t, "../testdata/ca-cert.pem")
+
+	c := config.OCSPConfig{
+		Enabled:   true,
+		Policy:    config.OCSPPolicyHard,
+		Responder: s.URL,
+	}
+
+	entry := func(cert *x509.Certificate) *ocspEntry {
+		ocspCache.Lock()
+		defer ocspCache.Unlock()
+
+		for _, e := range ocspCache.entries {
+			if e.cert == cert {
+				return e
+			}
+		}
+
+		return nil
+	}
+
+	expire := func(e *ocspEntry) {
+		e.Lock()
+		e.expireAt = time.Now().Add(-time.Second)
+		e.Unlock()
+	}
+
+	t.Run("test expired response is refreshed in the background", func(t *testing.T) {
+		cert := issueLeafCertificate(t, "refreshed")
+		responder.setStatus(cert, ocsp.Good)
+
+		if err := checkOCSP([]*x509.Certificate{cert, caCert}, nil, c); err != nil {
+			t.Fatal(err)
+		}
+
+		responder.setStatus(cert, ocsp.Revoked)
+		expire(entry(cert))
+
+		hits := atomic.LoadInt32(&responder.hits)
+
+		// cached response is used in the handshake
+		if err := checkOCSP([]*x509.Certificate{cert, caCert}, nil, c); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := atomic.LoadInt32(&responder.hits) - hits; got != 0 {
+			t.Fatalf("got %v request, want %v", got, 0)
+		}
+
+		refreshRevocation(time.Now())
+
+		if err := checkOCSP([]*x509.Certificate{cert, caCert}, nil, c); !errors.Is(err, errCertificateRevoked) {
+			t.Fatalf("got %v, want %v", err, errCertificateRevoked)
+		}
+	})
+
+	t.Run("test unused response is removed after it's expired", func(t *testing.T) {
+		cert := issueLeafCertificate(t, "removed")
+		responder.setStatus(cert, ocsp.Good)
+
+		if err := checkOCSP([]*x509.Certificate{cert, caCert}, nil, c); err != nil {
+			t.Fatal(err)
+		}
+
+		expire(entry(cert))
+
+		hits := atomic.LoadInt32(&responder.hits)
+
+		refreshRevocation(time.Now())
+
+		if entry(cert) != nil {
+			t.Fatalf("unused ocsp response must be removed")
+		}
+
+		if got := atomic.LoadInt32(&responder.hits) - hits; got != 0 {
+			t.Fatalf("got %v request, want %v", got, 0)
+		}
+	})
+}
+
+func TestCachedOCSPResponse(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+	defer close(release)
+
+	cert := issueLeafCertificate(t, "cached")
+	caCert := readCertificate(t, "../testdata/ca-cert.pem")
+
+	start := time.Now()
+
+	// staple is not delayed by slow responder
+	_, err := cachedOCSPResponse(cert, caCert, config.OCSPConfig{
+		Stapling:        true,
+		Responder:       s.URL,
+		TimeoutDuration: 5 * time.Second,
+	})
+	if !errors.Is(err, errOCSPNotFetched) {
+		t.Fatalf("got %v, want %v", err, errOCSPNotFetched)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("cached ocsp response must not wait for the responder, took %v", d)
+	}
+}
+
+func TestCRLEntryRefreshInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "interval.crl")
+	writeCRL(t, path)
+
+	short := config.TLSConfig{CRL: path, TLSOptions: config.TLSOptions{CRLRefreshDuration: time.Minute}}
+	long := config.TLSConfig{CRL: path, TLSOptions: config.TLSOptions{CRLRefreshDuration: time.Hour}}
+
+	if getCRLEntry(short) == getCRLEntry(long) {
+		t.Fatalf("crl with different refresh interval must be cached separately")
+	}
+
+	// interval of the entry is not changed by the other config
+	e := getCRLEntry(short)
+	getCRLEntry(long)
+
+	e.Lock()
+	defer e.Unlock()
+
+	if e.conf.CRLRefreshDuration != time.Minute {
+		t.Fatalf("got %v, want %v", e.conf.CRLRefreshDuration, time.Minute)
+	}
+}
+
+func TestRevocationRefreshStopped(t *testing.T) {
+	users := func() int {
+		revocationRefresh.Lock()
+		defer revocationRefresh.Unlock()
+
+		return revocationRefresh.users
+	}
+
+	// proxies started by other tests may still use the refresh
+	running := users()
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	startRevocationRefresh(ctx1)
+	startRevocationRefresh(ctx2)
+
+	waitUsers := func(want int) {
+		t.Helper()
+
+		deadline := time.Now().Add(time.Second)
+		for users() != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if got := users(); got != want {
+			t.Fatalf("got %v users, want %v", got, want)
+		}
+	}
+
+	cancel1()
+	waitUsers(running + 1)
+
+	// refresh is stopped when the last caller is stopped
+	cancel2()
+	waitUsers(running)
+}
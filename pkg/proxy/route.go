@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	goerrors "errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+)
+
+// clientHelloTimeout is maximum time to wait for tls ClientHello in passthrough mode
+const clientHelloTimeout = 5 * time.Second
+
+var errClientHelloPeeked = goerrors.New("client hello peeked")
+
+// targetGroup hold targets with its own load balancer and outlier detector
+type targetGroup struct {
+	balancer Balancer
+	outlier  *outlierDetector
+}
+
+func newTargetGroup(c config.ServerConfig, targets []*Target) *targetGroup {
+	b := newBalancerWithTargets(c.LoadBalancer, targets)
+
+	return &targetGroup{
+		balancer: b,
+		outlier:  newOutlierDetector(c.OutlierDetection, b.Targets()),
+	}
+}
+
+// sniRoute route connections with matching tls server name to the target group
+type sniRoute struct {
+	sni   []string
+	group *targetGroup
+}
+
+// route returns target group for the server name, exact match is preferred
+// over wildcard match, and default target group is returned when there is
+// no matching route
+func (s *proxyState) route(serverName string) *targetGroup {
+	serverName = strings.ToLower(serverName)
+
+	for _, r := range s.routes {
+		for _, sni := range r.sni {
+			if sni == serverName {
+				return r.group
+			}
+		}
+	}
+
+	for _, r := range s.routes {
+		for _, sni := range r.sni {
+			if matchWildcard(sni, serverName) {
+				return r.group
+			}
+		}
+	}
+
+	return s.targetGroup
+}
+
+// matchWildcard returns true when server name match the wildcard pattern,
+// wildcard only match a single label, e.g. *.example.com match
+// api.example.com but not v1.api.example.com
+func matchWildcard(pattern, serverName string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+
+	i := strings.Index(serverName, ".")
+	if i <= 0 {
+		return false
+	}
+
+	return serverName[i+1:] == pattern[2:]
+}
+
+// peekClientHello read tls ClientHello without terminating tls, it returns
+// the server name and connection that replay the data that already read
+func peekClientHello(conn net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var serverName string
+
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	err := tls.Server(&peekConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = h.ServerName
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+
+	if !goerrors.Is(err, errClientHelloPeeked) {
+		return "", nil, err
+	}
+
+	return serverName, &replayConn{
+		Conn: conn,
+		r:    io.MultiReader(&buf, conn),
+	}, nil
+}
+
+// peekConn only read from the connection, the tls alert is never sent to
+// the client
+type peekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// replayConn read the peeked data before reading from the connection
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+)
+
+func TestMatchWildcard(t *testing.T) {
+	tests := []struct {
+		Name       string
+		Pattern    string
+		ServerName string
+		Expected   bool
+	}{
+		{
+			Name:       "test single label",
+			Pattern:    "*.example.com",
+			ServerName: "api.example.com",
+			Expected:   true,
+		},
+		{
+			Name:       "test multiple label",
+			Pattern:    "*.example.com",
+			ServerName: "v1.api.example.com",
+			Expected:   false,
+		},
+		{
+			Name:       "test apex domain",
+			Pattern:    "*.example.com",
+			ServerName: "example.com",
+			Expected:   false,
+		},
+		{
+			Name:       "test not wildcard pattern",
+			Pattern:    "api.example.com",
+			ServerName: "api.example.com",
+			Expected:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			if got := matchWildcard(tt.Pattern, tt.ServerName); got != tt.Expected {
+				t.Fatalf("got %v, want %v", got, tt.Expected)
+			}
+		})
+	}
+}
+
+func TestRoute(t *testing.T) {
+	defaultGroup := &targetGroup{}
+	exactGroup := &targetGroup{}
+	wildcardGroup := &targetGroup{}
+
+	s := &proxyState{
+		targetGroup: defaultGroup,
+		routes: []*sniRoute{
+			{
+				sni:   []string{"*.example.com"},
+				group: wildcardGroup,
+			},
+			{
+				sni:   []string{"api.example.com"},
+				group: exactGroup,
+			},
+		},
+	}
+
+	tests := []struct {
+		Name       string
+		ServerName string
+		Expected   *targetGroup
+	}{
+		{
+			Name:       "test exact match preferred over wildcard",
+			ServerName: "API.example.com",
+			Expected:   exactGroup,
+		},
+		{
+			Name:       "test wildcard match",
+			ServerName: "web.example.com",
+			Expected:   wildcardGroup,
+		},
+		{
+			Name:       "test default route",
+			ServerName: "example.org",
+			Expected:   defaultGroup,
+		},
+		{
+			Name:       "test default route without sni",
+			ServerName: "",
+			Expected:   defaultGroup,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			if got := s.route(tt.ServerName); got != tt.Expected {
+				t.Fatalf("got %p, want %p", got, tt.Expected)
+			}
+		})
+	}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	var sent bytes.Buffer
+	go func() {
+		tls.Client(&recordConn{Conn: client, w: &sent}, &tls.Config{
+			ServerName:         "api.example.com",
+			InsecureSkipVerify: true,
+		}).Handshake()
+	}()
+
+	serverName, conn, err := peekClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if serverName != "api.example.com" {
+		t.Fatalf("got %v, want %v", serverName, "api.example.com")
+	}
+
+	t.Run("test peeked data is replayed", func(t *testing.T) {
+		// client hello is sent in single write
+		buf := make([]byte, sent.Len())
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf, sent.Bytes()) {
+			t.Fatalf("replayed data is not same with data sent by client")
+		}
+	})
+
+	client.Close()
+}
+
+func TestProxyWithTLSPassthrough(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tC := config.TLSConfig{
+		Mode: "simple",
+		Cert: "../testdata/cert.pem",
+		Key:  "../testdata/cert-key.pem",
+	}
+
+	localhost := make(chan []byte, 1)
+	loopback := make(chan []byte, 1)
+
+	localhostBackend := RunTestTLSServer(&wg, tC, localhost)
+	loopbackBackend := RunTestTLSServer(&wg, tC, loopback)
+
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{loopbackBackend}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, _ := net.SplitHostPort(localhostBackend)
+
+	c := cfg.ServerConfigs[0]
+	c.Listener.TLSConfig = config.TLSConfig{Mode: "passthrough"}
+	c.Routes = []config.RouteConfig{
+		{
+			SNI: []string{"localhost"},
+			Targets: []config.HostConfig{
+				{
+					Host: host,
+					Port: port,
+				},
+			},
+		},
+	}
+
+	p := New("test-proxy")
+	go func() {
+		p.Run(c)
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	ca, err := os.ReadFile("../testdata/ca-cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	tests := []struct {
+		Name       string
+		ServerName string
+		Result     chan []byte
+	}{
+		{
+			Name:       "test connection routed by sni",
+			ServerName: "localhost",
+			Result:     localhost,
+		},
+		{
+			Name:       "test connection routed to default targets",
+			ServerName: "cert",
+			Result:     loopback,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", "127.0.0.1:9000", &tls.Config{
+				ServerName: tt.ServerName,
+				RootCAs:    pool,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(messageByte); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case res := <-tt.Result:
+				if !bytes.Equal(res, messageByte) {
+					t.Fatalf("got %v, want %v", res, messageByte)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("target must receive the data")
+			}
+		})
+	}
+
+	p.Shutdown()
+}
+
+// recordConn record data written to the connection
+type recordConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.w.Write(b)
+	return c.Conn.Write(b)
+}
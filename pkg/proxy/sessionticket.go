@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+)
+
+const (
+	// minTicketSecretSize is minimum size of the secret in session ticket
+	// key file
+	minTicketSecretSize = 32
+
+	// clientSessionCacheSize is number of sessions cached for every target
+	clientSessionCacheSize = 64
+)
+
+// sessionTicketKeys derive session ticket keys from the secrets in key files.
+// The key is changed every rotation interval based on the wall clock, so
+// processes that use the same key files always use the same keys without
+// talking to each other. Tickets encrypted with the previous key are still
+// accepted, and keys derived from the other files are only used to decrypt
+// tickets, so the secret can be replaced by adding the new file first
+type sessionTicketKeys struct {
+	secrets  [][]byte
+	interval time.Duration
+	epoch    int64
+}
+
+func newSessionTicketKeys(c config.SessionTicketConfig) (*sessionTicketKeys, error) {
+	k := &sessionTicketKeys{
+		interval: c.RotationIntervalDuration,
+	}
+
+	if k.interval == 0 {
+		k.interval = time.Hour
+	}
+
+	for _, f := range c.KeyFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		secret := bytes.TrimSpace(b)
+		if len(secret) < minTicketSecretSize {
+			return nil, fmt.Errorf("session ticket key file %s must have at least %d bytes", f, minTicketSecretSize)
+		}
+
+		k.secrets = append(k.secrets, secret)
+	}
+
+	return k, nil
+}
+
+// keys returns the keys for the epoch, the first key is used to encrypt new
+// tickets
+func (k *sessionTicketKeys) keys(epoch int64) [][32]byte {
+	keys := [][32]byte{}
+
+	for _, secret := range k.secrets {
+		keys = append(keys, deriveTicketKey(secret, epoch), deriveTicketKey(secret, epoch-1))
+	}
+
+	return keys
+}
+
+// rotate set the keys to tls config when the epoch is changed
+func (k *sessionTicketKeys) rotate(conf *tls.Config, now time.Time) {
+	epoch := now.UnixNano() / int64(k.interval)
+	if epoch == k.epoch {
+		return
+	}
+
+	conf.SetSessionTicketKeys(k.keys(epoch))
+	k.epoch = epoch
+}
+
+func deriveTicketKey(secret []byte, epoch int64) [32]byte {
+	var key [32]byte
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("octo-proxy session ticket key"))
+	binary.Write(mac, binary.BigEndian, epoch)
+	copy(key[:], mac.Sum(nil))
+
+	return key
+}
+
+var clientSessionCaches = struct {
+	sync.Mutex
+	caches map[string]tls.ClientSessionCache
+}{caches: make(map[string]tls.ClientSessionCache)}
+
+// clientSessionCache returns session cache of the target, the cache is kept
+// across dials so connections to the target can resume the previous session.
+// Targets with different certificates don't share the cache
+func clientSessionCache(hc config.HostConfig) tls.ClientSessionCache {
+	key := fmt.Sprintf("%s|%s|%s|%s|%s|%s", hc.Network(), hc.Address(), hc.TLSConfig.SNI, hc.TLSConfig.CaCert, hc.TLSConfig.Cert, hc.TLSConfig.Key)
+
+	clientSessionCaches.Lock()
+	defer clientSessionCaches.Unlock()
+
+	cache, ok := clientSessionCaches.caches[key]
+	if !ok {
+		cache = tls.NewLRUClientSessionCache(clientSessionCacheSize)
+		clientSessionCaches.caches[key] = cache
+	}
+
+	return cache
+}
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+)
+
+func writeTicketKey(t *testing.T, dir, name, secret string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(secret), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestSessionTicketKeys(t *testing.T) {
+	dir := t.TempDir()
+	current := writeTicketKey(t, dir, "current.key", "ad9f4c2b7e1a08d63f5c9e2b1a7d4f80\n")
+	previous := writeTicketKey(t, dir, "previous.key", "0c7e3b9a5f1d2e8c4a6b0f9d3e7c1a52\n")
+
+	c := config.SessionTicketConfig{
+		KeyFiles:                 []string{current, previous},
+		RotationIntervalDuration: time.Minute,
+	}
+
+	k1, err := newSessionTicketKeys(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k2, err := newSessionTicketKeys(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("test keys are the same with the same key files", func(t *testing.T) {
+		keys := k1.keys(10)
+		if len(keys) != 4 {
+			t.Fatalf("got %v keys, want %v", len(keys), 4)
+		}
+
+		for i, key := range k2.keys(10) {
+			if key != keys[i] {
+				t.Fatalf("key %d is different", i)
+			}
+		}
+	})
+
+	t.Run("test previous key is accepted after rotation", func(t *testing.T) {
+		if k1.keys(11)[1] != k1.keys(10)[0] {
+			t.Fatalf("previous key must be accepted")
+		}
+
+		if k1.keys(11)[0] == k1.keys(10)[0] {
+			t.Fatalf("key must be rotated")
+		}
+	})
+
+	t.Run("test keys are rotated when epoch is changed", func(t *testing.T) {
+		conf := &tls.Config{}
+		now := time.Now()
+
+		k1.rotate(conf, now)
+		epoch := k1.epoch
+
+		k1.rotate(conf, now.Add(time.Minute))
+		if k1.epoch != epoch+1 {
+			t.Fatalf("got epoch %v, want %v", k1.epoch, epoch+1)
+		}
+	})
+
+	t.Run("test key file is too short", func(t *testing.T) {
+		_, err := newSessionTicketKeys(config.SessionTicketConfig{
+			KeyFiles: []string{writeTicketKey(t, dir, "short.key", "secret")},
+		})
+		if err == nil {
+			t.Fatalf("newSessionTicketKeys must return error")
+		}
+	})
+
+	t.Run("test key file not found", func(t *testing.T) {
+		_, err := newSessionTicketKeys(config.SessionTicketConfig{
+			KeyFiles: []string{filepath.Join(dir, "notfound.key")},
+		})
+		if err == nil {
+			t.Fatalf("newSessionTicketKeys must return error")
+		}
+	})
+}
+
+// writeAfterHandshake write a message after the handshake, so the client
+// receives session ticket sent after the handshake
+func writeAfterHandshake(c net.Conn) {
+	defer c.Close()
+	if err := isTLSConn(c); err != nil {
+		return
+	}
+	c.Write([]byte("ok"))
+}
+
+func resumeSession(t *testing.T, addr string, conf *tls.Config) bool {
+	conn, err := tls.Dial("tcp", addr, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn.ConnectionState().DidResume
+}
+
+func TestSessionResumption(t *testing.T) {
+	key := writeTicketKey(t, t.TempDir(), "ticket.key", "ad9f4c2b7e1a08d63f5c9e2b1a7d4f80")
+
+	listener := config.TLSConfig{
+		Mode:   "mutual",
+		CaCert: "../testdata/ca-cert.pem",
+		Cert:   "../testdata/cert.pem",
+		Key:    "../testdata/cert-key.pem",
+		SessionTicket: config.SessionTicketConfig{
+			KeyFiles: []string{key},
+		},
+		Role: config.Role{Server: true},
+	}
+
+	newClient := func(t *testing.T) *tls.Config {
+		client, err := getTLSConfig(config.TLSConfig{
+			Mode:   "mutual",
+			CaCert: "../testdata/ca-cert.pem",
+			Cert:   "../testdata/client.pem",
+			Key:    "../testdata/client-key.pem",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client.ServerName = "localhost"
+		client.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+		return client.Config
+	}
+
+	newServer := func(t *testing.T, c config.TLSConfig) string {
+		ptls, err := getTLSConfig(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return testhelper.RunTLSServer(t, ptls.Config, writeAfterHandshake)
+	}
+
+	t.Run("test session is resumed by other listener with the same key files", func(t *testing.T) {
+		client := newClient(t)
+
+		if resumeSession(t, newServer(t, listener), client) {
+			t.Fatalf("first connection must not be resumed")
+		}
+
+		if !resumeSession(t, newServer(t, listener), client) {
+			t.Fatalf("session must be resumed")
+		}
+	})
+
+	t.Run("test session is not resumed by other listener without key files", func(t *testing.T) {
+		c := listener
+		c.SessionTicket = config.SessionTicketConfig{}
+
+		client := newClient(t)
+		resumeSession(t, newServer(t, c), client)
+
+		if resumeSession(t, newServer(t, c), client) {
+			t.Fatalf("session must not be resumed")
+		}
+	})
+
+	t.Run("test resumed client is checked by subjectAltNames", func(t *testing.T) {
+		client := newClient(t)
+		resumeSession(t, newServer(t, listener), client)
+
+		c := listener
+		c.SubjectAltName = config.SubjectAltName{DNS: []string{"other"}}
+
+		conn, err := tls.Dial("tcp", newServer(t, c), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// tls 1.3 client learns the rejection on the first read
+		if _, err := io.ReadAll(conn); err == nil {
+			t.Fatalf("resumed client must be rejected")
+		}
+	})
+
+	t.Run("test session tickets are disabled", func(t *testing.T) {
+		c := listener
+		c.SessionTicket = config.SessionTicketConfig{Disabled: true}
+
+		client := newClient(t)
+		addr := newServer(t, c)
+		resumeSession(t, addr, client)
+
+		if resumeSession(t, addr, client) {
+			t.Fatalf("session must not be resumed")
+		}
+	})
+}
+
+func TestDialTargetResumeSession(t *testing.T) {
+	ptls, err := getTLSConfig(config.TLSConfig{
+		Mode: "simple",
+		Cert: "../testdata/cert.pem",
+		Key:  "../testdata/cert-key.pem",
+		Role: config.Role{Server: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, _ := net.SplitHostPort(testhelper.RunTLSServer(t, ptls.Config, writeAfterHandshake))
+
+	dial := func(t *testing.T, hc config.HostConfig) bool {
+		conn, err := dialTarget(hc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatal(err)
+		}
+
+		return conn.(*tls.Conn).ConnectionState().DidResume
+	}
+
+	t.Run("test target session is resumed", func(t *testing.T) {
+		hc := config.HostConfig{
+			Host: host,
+			Port: port,
+			TLSConfig: config.TLSConfig{
+				Mode:   "simple",
+				CaCert: "../testdata/ca-cert.pem",
+			},
+		}
+
+		dial(t, hc)
+
+		if !dial(t, hc) {
+			t.Fatalf("session must be resumed")
+		}
+	})
+
+	t.Run("test target session cache is disabled", func(t *testing.T) {
+		hc := config.HostConfig{
+			Host: host,
+			Port: port,
+			TLSConfig: config.TLSConfig{
+				Mode:          "simple",
+				CaCert:        "../testdata/ca-cert.pem",
+				SNI:           "localhost",
+				SessionTicket: config.SessionTicketConfig{Disabled: true},
+			},
+		}
+
+		dial(t, hc)
+
+		if dial(t, hc) {
+			t.Fatalf("session must not be resumed")
+		}
+	})
+}
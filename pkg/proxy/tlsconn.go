@@ -13,9 +13,14 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// errSANNotAllowed is returned when peer certificate doesn't match any of the
+// configured subjectAltNames
+var errSANNotAllowed = goerrors.New("peer certificate subject alternative names are not allowed")
+
 type ProxyTLS struct {
 	*tls.Config
 	RevocationList *x509.RevocationList
+	ticketKeys     *sessionTicketKeys
 }
 
 type VerifyOpts struct {
@@ -45,6 +50,14 @@ func getTLSConfig(c config.TLSConfig) (*ProxyTLS, error) {
 		ptls.ServerName = c.SNI
 	}
 
+	if c.MinVersionID != 0 {
+		ptls.MinVersion = c.MinVersionID
+	}
+	ptls.MaxVersion = c.MaxVersionID
+	ptls.CipherSuites = c.CipherSuiteIDs
+	ptls.CurvePreferences = c.CurveIDs
+	ptls.NextProtos = c.ALPN
+
 	if c.CaCert != "" {
 		caPool, err = getCACertPool(c)
 		if err != nil {
@@ -68,8 +81,25 @@ func getTLSConfig(c config.TLSConfig) (*ProxyTLS, error) {
 		ptls.Certificates = []tls.Certificate{pair}
 	}
 
+	// certificate is selected by server name when certificates is configured,
+	// cert and key become the default certificate
+	if len(c.Certificates) > 0 {
+		var fallback *tls.Certificate
+		if len(ptls.Certificates) > 0 {
+			fallback = &pair
+		}
+
+		store, err := newCertStore(c.Certificates, fallback)
+		if err != nil {
+			return nil, err
+		}
+
+		ptls.Certificates = nil
+		ptls.GetCertificate = store.getCertificate
+	}
+
 	if c.CRL != "" {
-		crl, err := getCACRL(c)
+		crl, err := getRevocationList(c)
 		if err != nil {
 			return nil, err
 		}
@@ -80,36 +110,36 @@ func getTLSConfig(c config.TLSConfig) (*ProxyTLS, error) {
 
 	if c.IsMutual() {
 		if c.Role.Server {
-			ptls.GetConfigForClient = func(h *tls.ClientHelloInfo) (*tls.Config, error) {
-				return &tls.Config{
-					ClientCAs:    caPool,
-					Certificates: []tls.Certificate{pair},
-					ClientAuth:   tls.RequireAndVerifyClientCert,
-					VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-						opts := x509.VerifyOptions{
-							Roots:   caPool,
-							DNSName: strings.Split(h.Conn.RemoteAddr().String(), ":")[0],
-						}
-
-						_, err := verifiedChains[0][0].Verify(opts)
-						if err != nil {
-							return err
-						}
-
-						if crlVerification {
-							revocationOpts := VerifyOpts{
-								CaCert: caCert,
-								Cert:   verifiedChains[0][0],
-								CRL:    ptls.RevocationList,
-							}
-
-							_, err = isCertificateRevoked(revocationOpts)
-							return err
-						}
-
-						return nil
-					},
-				}, nil
+			// client certificate chain is verified by crypto/tls against
+			// caCert, including intermediates sent by the client, and the
+			// certificate must be valid for client authentication
+			ptls.ClientCAs = caPool
+			ptls.ClientAuth = tls.RequireAndVerifyClientCert
+
+			// VerifyConnection is also called on resumed sessions, unlike
+			// VerifyPeerCertificate, so resumed clients are checked again
+			ptls.VerifyConnection = func(cs tls.ConnectionState) error {
+				if len(cs.VerifiedChains) == 0 {
+					return goerrors.New("client certificate is not verified")
+				}
+
+				chain := cs.VerifiedChains[0]
+
+				if err := verifySubjectAltName(chain[0], c.SubjectAltName); err != nil {
+					return err
+				}
+
+				if crlVerification {
+					if err := checkCRL(c, caCert, chain[0]); err != nil {
+						return err
+					}
+				}
+
+				if c.OCSP.Enabled {
+					return checkOCSP(chain, nil, c.OCSP)
+				}
+
+				return nil
 			}
 		} else {
 			ptls.VerifyConnection = func(cs tls.ConnectionState) error {
@@ -127,30 +157,133 @@ func getTLSConfig(c config.TLSConfig) (*ProxyTLS, error) {
 					opts.Intermediates.AddCert(cert)
 				}
 
-				_, err := cs.PeerCertificates[0].Verify(opts)
+				chains, err := cs.PeerCertificates[0].Verify(opts)
 				if err != nil {
 					return err
 				}
 
+				if err := verifySubjectAltName(cs.PeerCertificates[0], c.SubjectAltName); err != nil {
+					return err
+				}
+
 				if crlVerification {
-					revocationOpts := VerifyOpts{
-						CaCert: caCert,
-						Cert:   cs.PeerCertificates[0],
-						CRL:    ptls.RevocationList,
+					if err := checkCRL(c, caCert, cs.PeerCertificates[0]); err != nil {
+						return err
 					}
+				}
 
-					_, err := isCertificateRevoked(revocationOpts)
-					return err
+				if c.OCSP.Enabled {
+					return checkOCSP(chains[0], cs.OCSPResponse, c.OCSP)
 				}
 
 				return nil
 			}
 		}
+	} else if c.IsSimple() && !c.Role.Server && c.OCSP.Enabled {
+		// server certificate is verified by crypto/tls, only ocsp status is
+		// checked here
+		ptls.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.VerifiedChains) == 0 {
+				return goerrors.New("server certificate is not verified")
+			}
+
+			return checkOCSP(cs.VerifiedChains[0], cs.OCSPResponse, c.OCSP)
+		}
+	}
+
+	if c.SessionTicket.Disabled {
+		ptls.SessionTicketsDisabled = true
+	}
+
+	// ticket keys are derived from key files so other processes listening on
+	// the same port can resume the session
+	if c.Role.Server && len(c.SessionTicket.KeyFiles) > 0 {
+		ptls.ticketKeys, err = newSessionTicketKeys(c.SessionTicket)
+		if err != nil {
+			return nil, err
+		}
+
+		ptls.ticketKeys.rotate(ptls.Config, time.Now())
+	}
+
+	if c.Role.Server && c.OCSP.Stapling {
+		ptls.GetCertificate = stapleOCSP(ptls, caCert, c.OCSP)
+		prefetchOCSP(ptls.Certificates, caCert, c.OCSP)
+		ptls.Certificates = nil
 	}
 
 	return ptls, nil
 }
 
+// verifySubjectAltName check if peer certificate has one of the subject
+// alternative names configured in subjectAltNames, all certificates are
+// allowed when subjectAltNames is not configured
+func verifySubjectAltName(cert *x509.Certificate, san config.SubjectAltName) error {
+	if len(san.DNS) == 0 && len(san.IPAddress) == 0 && len(san.Uri) == 0 {
+		return nil
+	}
+
+	for _, ip := range san.IPAddress {
+		for _, certIP := range cert.IPAddresses {
+			if certIP.Equal(net.ParseIP(ip)) {
+				return nil
+			}
+		}
+	}
+
+	for _, uri := range san.Uri {
+		for _, certURI := range cert.URIs {
+			if certURI.String() == uri {
+				return nil
+			}
+		}
+	}
+
+	for _, dns := range san.DNS {
+		for _, certDNS := range cert.DNSNames {
+			certDNS = strings.ToLower(certDNS)
+			if certDNS == dns || matchWildcard(dns, certDNS) {
+				return nil
+			}
+		}
+	}
+
+	uris := make([]string, 0, len(cert.URIs))
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+
+	log.Warn().
+		Str("cn", cert.Subject.CommonName).
+		Strs("dns", cert.DNSNames).
+		Strs("uri", uris).
+		Strs("ip", ips).
+		Msg("peer certificate doesn't match any of subjectAltNames")
+
+	return errSANNotAllowed
+}
+
+// checkCRL check certificate against the latest loaded crl
+func checkCRL(c config.TLSConfig, caCert *x509.Certificate, cert *x509.Certificate) error {
+	crl, err := cachedRevocationList(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = isCertificateRevoked(VerifyOpts{
+		CaCert: caCert,
+		Cert:   cert,
+		CRL:    crl,
+	})
+
+	return err
+}
+
 func isCertificateRevoked(opts VerifyOpts) (bool, error) {
 	err := opts.CRL.CheckSignatureFrom(opts.CaCert)
 	if err != nil {
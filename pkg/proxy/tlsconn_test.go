@@ -1,12 +1,28 @@
 package proxy
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewTLS(t *testing.T) {
@@ -100,3 +116,362 @@ func TestIsCertificateRevoked(t *testing.T) {
 		}
 	}
 }
+
+func TestVerifySubjectAltName(t *testing.T) {
+	spiffeID, _ := url.Parse("spiffe://example.org/ns/default/sa/web")
+
+	cert := &x509.Certificate{
+		DNSNames:    []string{"API.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:        []*url.URL{spiffeID},
+	}
+
+	tests := []struct {
+		Name      string
+		SAN       config.SubjectAltName
+		wantError error
+	}{
+		{
+			Name:      "Test subjectAltNames not configured",
+			SAN:       config.SubjectAltName{},
+			wantError: nil,
+		},
+		{
+			Name:      "Test spiffe id match",
+			SAN:       config.SubjectAltName{Uri: []string{"spiffe://example.org/ns/default/sa/web"}},
+			wantError: nil,
+		},
+		{
+			Name:      "Test spiffe id doesn't match",
+			SAN:       config.SubjectAltName{Uri: []string{"spiffe://example.org/ns/default/sa/db"}},
+			wantError: errSANNotAllowed,
+		},
+		{
+			Name:      "Test ip address match",
+			SAN:       config.SubjectAltName{IPAddress: []string{"10.0.0.1"}},
+			wantError: nil,
+		},
+		{
+			Name:      "Test dns match",
+			SAN:       config.SubjectAltName{DNS: []string{"api.example.com"}},
+			wantError: nil,
+		},
+		{
+			Name:      "Test wildcard dns match",
+			SAN:       config.SubjectAltName{DNS: []string{"*.example.com"}},
+			wantError: nil,
+		},
+		{
+			Name:      "Test wildcard dns doesn't match multiple label",
+			SAN:       config.SubjectAltName{DNS: []string{"*.org"}},
+			wantError: errSANNotAllowed,
+		},
+		{
+			Name: "Test none match",
+			SAN: config.SubjectAltName{
+				DNS:       []string{"db.example.com"},
+				IPAddress: []string{"10.0.0.2"},
+			},
+			wantError: errSANNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			err := verifySubjectAltName(cert, tt.SAN)
+			if !errors.Is(err, tt.wantError) {
+				t.Fatalf("got %v, want %v", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestDialTargetWithSubjectAltNames(t *testing.T) {
+	var wg sync.WaitGroup
+	result := make(chan []byte, 1)
+
+	backend := RunTestTLSServer(&wg, config.TLSConfig{
+		Mode:   "mutual",
+		CaCert: "../testdata/ca-cert.pem",
+		Cert:   "../testdata/cert.pem",
+		Key:    "../testdata/cert-key.pem",
+		Role: config.Role{
+			Server: true,
+		},
+	}, result)
+
+	host, port, _ := net.SplitHostPort(backend)
+
+	_, err := dialTarget(config.HostConfig{
+		Host: host,
+		Port: port,
+		TLSConfig: config.TLSConfig{
+			Mode:   "mutual",
+			CaCert: "../testdata/ca-cert.pem",
+			Cert:   "../testdata/client.pem",
+			Key:    "../testdata/client-key.pem",
+			SubjectAltName: config.SubjectAltName{
+				Uri: []string{"spiffe://example.org/ns/default/sa/web"},
+			},
+		},
+	})
+	if !errors.Is(err, errSANNotAllowed) {
+		t.Fatalf("got %v, want %v", err, errSANNotAllowed)
+	}
+
+	labels := prometheus.Labels{"host": host, "port": port}
+	if got := testutil.ToFloat64(upstreamSANReject.With(labels)); got != 1 {
+		t.Fatalf("got %v, want %v", got, 1)
+	}
+}
+
+func TestGetTLSConfigMutualServer(t *testing.T) {
+	caCert := readCertificate(t, "../testdata/ca-cert.pem")
+	caKey := readKeyFile(t, "../testdata/ca-key.pem")
+
+	intermediate, intermediateKey := issueCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, caCert, caKey)
+
+	chainCert, chainKey := issueCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "chain"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, intermediate, intermediateKey)
+
+	serverAuthCert, serverAuthKey := issueCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server-auth"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+
+	ptls, err := getTLSConfig(config.TLSConfig{
+		Mode:   "mutual",
+		CaCert: "../testdata/ca-cert.pem",
+		Cert:   "../testdata/cert.pem",
+		Key:    "../testdata/cert-key.pem",
+		Role:   config.Role{Server: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name        string
+		Network     string
+		Address     string
+		Certificate tls.Certificate
+		wantError   bool
+	}{
+		{
+			Name:        "Test client certificate without client ip",
+			Network:     "tcp",
+			Address:     "127.0.0.1:0",
+			Certificate: loadKeyPair(t, "../testdata/localhost.pem", "../testdata/localhost-key.pem"),
+			wantError:   false,
+		},
+		{
+			Name:        "Test client certificate over ipv6",
+			Network:     "tcp6",
+			Address:     "[::1]:0",
+			Certificate: loadKeyPair(t, "../testdata/client.pem", "../testdata/client-key.pem"),
+			wantError:   false,
+		},
+		{
+			Name:    "Test client certificate with intermediate",
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+			Certificate: tls.Certificate{
+				Certificate: [][]byte{chainCert.Raw, intermediate.Raw},
+				PrivateKey:  chainKey,
+			},
+			wantError: false,
+		},
+		{
+			Name:    "Test client certificate without intermediate",
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+			Certificate: tls.Certificate{
+				Certificate: [][]byte{chainCert.Raw},
+				PrivateKey:  chainKey,
+			},
+			wantError: true,
+		},
+		{
+			Name:    "Test certificate not for client authentication",
+			Network: "tcp",
+			Address: "127.0.0.1:0",
+			Certificate: tls.Certificate{
+				Certificate: [][]byte{serverAuthCert.Raw},
+				PrivateKey:  serverAuthKey,
+			},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			l, err := tls.Listen(tt.Network, tt.Address, ptls.Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			result := make(chan error, 1)
+			go func() {
+				c, err := l.Accept()
+				if err != nil {
+					result <- err
+					return
+				}
+				defer c.Close()
+
+				result <- isTLSConn(c)
+			}()
+
+			conn, err := tls.Dial(tt.Network, l.Addr().String(), &tls.Config{
+				ServerName:   "localhost",
+				Certificates: []tls.Certificate{tt.Certificate},
+				// server certificate is not verified, only client
+				// certificate verification is tested
+				InsecureSkipVerify: true,
+			})
+			if err == nil {
+				defer conn.Close()
+			}
+
+			err = <-result
+			if tt.wantError && err == nil {
+				t.Fatalf("client certificate must be rejected")
+			}
+
+			if !tt.wantError && err != nil {
+				t.Fatalf("client certificate must be accepted, got %v", err)
+			}
+		})
+	}
+
+}
+
+// issueCertificate create certificate from the template signed by parent
+func issueCertificate(t *testing.T, tmpl, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func readCertificate(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+
+	cert, err := getCACertificate(config.TLSConfig{CaCert: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func readKeyFile(t *testing.T, path string) crypto.Signer {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(b)
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func loadKeyPair(t *testing.T, cert, key string) tls.Certificate {
+	pair, err := getCertKeyPair(config.TLSConfig{Cert: cert, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pair
+}
+
+func TestGetTLSConfigWithTLSOptions(t *testing.T) {
+	server, err := getTLSConfig(config.TLSConfig{
+		Mode: "simple",
+		Cert: "../testdata/cert.pem",
+		Key:  "../testdata/cert-key.pem",
+		ALPN: []string{"h2", "http/1.1"},
+		TLSOptions: config.TLSOptions{
+			MinVersionID: tls.VersionTLS13,
+			CurveIDs:     []tls.CurveID{tls.X25519},
+		},
+		Role: config.Role{Server: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := testhelper.RunTLSServer(t, server.Config, tlsHandshake)
+
+	host, port, _ := net.SplitHostPort(addr)
+
+	t.Run("Test alpn is negotiated with target", func(t *testing.T) {
+		conn, err := dialTarget(config.HostConfig{
+			Host: host,
+			Port: port,
+			TLSConfig: config.TLSConfig{
+				Mode:   "simple",
+				CaCert: "../testdata/ca-cert.pem",
+				ALPN:   []string{"h2"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		state := conn.(*tls.Conn).ConnectionState()
+		if state.NegotiatedProtocol != "h2" {
+			t.Fatalf("got %v, want %v", state.NegotiatedProtocol, "h2")
+		}
+
+		if state.Version != tls.VersionTLS13 {
+			t.Fatalf("got %x, want %x", state.Version, tls.VersionTLS13)
+		}
+	})
+
+	t.Run("Test client with older tls version is rejected", func(t *testing.T) {
+		_, err := dialTarget(config.HostConfig{
+			Host: host,
+			Port: port,
+			TLSConfig: config.TLSConfig{
+				Mode:   "simple",
+				CaCert: "../testdata/ca-cert.pem",
+				TLSOptions: config.TLSOptions{
+					MaxVersionID: tls.VersionTLS12,
+				},
+			},
+		})
+		if err == nil {
+			t.Fatalf("handshake must be failed")
+		}
+	})
+}
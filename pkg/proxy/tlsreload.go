@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	tlsReloadTotal = metrics.AddCounterVec("octo_tls_reload_total", "total tls files reloaded by the listener")
+	tlsReloadErr   = metrics.AddCounterVec("octo_tls_reload_error_total", "total error when reloading tls files")
+	tlsCertExpiry  = metrics.AddGaugeVec("octo_tls_certificate_expiry_timestamp_seconds", "earliest expiry time of the certificates loaded by the listener")
+)
+
+// tlsReloadInterval is interval to check whether tls files are changed
+var tlsReloadInterval = 5 * time.Second
+
+type fileStat struct {
+	modTime int64
+	size    int64
+}
+
+// tlsReloader watch cert, key, caCert, crl and session ticket key files used
+// by the listener and reload them when one of the files is changed. New
+// handshakes use the latest loaded files, existing connections are not
+// affected
+type tlsReloader struct {
+	name  string
+	conf  config.TLSConfig
+	files []string
+	stats map[string]fileStat
+	ptls  atomic.Pointer[ProxyTLS]
+}
+
+func newTLSReloader(name string, c config.TLSConfig) (*tlsReloader, error) {
+	r := &tlsReloader{
+		name:  name,
+		conf:  c,
+		files: tlsFiles(c),
+	}
+	r.stats = statFiles(r.files)
+
+	ptls, err := getTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ptls.Store(ptls)
+	r.setExpiry()
+
+	return r, nil
+}
+
+// listenerConfig returns tls config for the listener, the config is picked
+// from the latest loaded files on every handshake
+func (r *tlsReloader) listenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			ptls := r.ptls.Load()
+			if ptls.GetConfigForClient != nil {
+				return ptls.GetConfigForClient(h)
+			}
+
+			return ptls.Config, nil
+		},
+	}
+}
+
+// watch check the tls files periodically until the context is canceled
+func (r *tlsReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reload()
+
+			if ptls := r.ptls.Load(); ptls.ticketKeys != nil {
+				ptls.ticketKeys.rotate(ptls.Config, time.Now())
+			}
+		}
+	}
+}
+
+// reload load the tls files when one of the files is changed, the current
+// files are kept when the new files can't be loaded
+func (r *tlsReloader) reload() {
+	stats := statFiles(r.files)
+	if statsEqual(r.stats, stats) {
+		return
+	}
+	r.stats = stats
+
+	ptls, err := getTLSConfig(r.conf)
+	if err != nil {
+		tlsReloadErr.With(prometheus.Labels{"name": r.name}).Inc()
+		log.Error().
+			Err(err).
+			Str("name", r.name).
+			Msg("failed to reload tls files, keep using the current files")
+		return
+	}
+
+	r.ptls.Store(ptls)
+	r.setExpiry()
+
+	tlsReloadTotal.With(prometheus.Labels{"name": r.name}).Inc()
+	log.Info().
+		Str("name", r.name).
+		Msg("tls files reloaded")
+}
+
+// setExpiry set expiry metric to the certificate that expire first
+func (r *tlsReloader) setExpiry() {
+	var expiry time.Time
+
+	for _, path := range certFiles(r.conf) {
+		cert, err := getCACertificate(config.TLSConfig{CaCert: path})
+		if err != nil {
+			continue
+		}
+
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+
+	if !expiry.IsZero() {
+		tlsCertExpiry.With(prometheus.Labels{"name": r.name}).Set(float64(expiry.Unix()))
+	}
+}
+
+func certFiles(c config.TLSConfig) []string {
+	files := []string{}
+	if c.Cert != "" {
+		files = append(files, c.Cert)
+	}
+
+	for _, cc := range c.Certificates {
+		files = append(files, cc.Cert)
+	}
+
+	return files
+}
+
+func tlsFiles(c config.TLSConfig) []string {
+	files := []string{}
+	for _, f := range []string{c.CaCert, c.Cert, c.Key} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+
+	// crl downloaded from url is refreshed on its own interval
+	if c.CRL != "" && !c.IsCRLURL() {
+		files = append(files, c.CRL)
+	}
+
+	for _, cc := range c.Certificates {
+		files = append(files, cc.Cert, cc.Key)
+	}
+
+	files = append(files, c.SessionTicket.KeyFiles...)
+
+	return files
+}
+
+// statFiles returns modification time and size of the files, missing file is
+// ignored, so it is reloaded when the file is created again
+func statFiles(files []string) map[string]fileStat {
+	stats := make(map[string]fileStat, len(files))
+
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+
+		stats[f] = fileStat{
+			modTime: fi.ModTime().UnixNano(),
+			size:    fi.Size(),
+		}
+	}
+
+	return stats
+}
+
+func statsEqual(a, b map[string]fileStat) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for f, s := range a {
+		if bs, ok := b[f]; !ok || bs != s {
+			return false
+		}
+	}
+
+	return true
+}
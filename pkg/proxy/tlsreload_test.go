@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+
+	copyFile(t, "../testdata/cert.pem", cert)
+	copyFile(t, "../testdata/cert-key.pem", key)
+
+	r, err := newTLSReloader("test-reload", config.TLSConfig{
+		Mode: "simple",
+		Cert: cert,
+		Key:  key,
+		Role: config.Role{Server: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := prometheus.Labels{"name": "test-reload"}
+	if testutil.ToFloat64(tlsCertExpiry.With(labels)) == 0 {
+		t.Fatalf("certificate expiry must be set")
+	}
+
+	t.Run("test files are not reloaded when not changed", func(t *testing.T) {
+		r.reload()
+
+		if got := testutil.ToFloat64(tlsReloadTotal.With(labels)); got != 0 {
+			t.Fatalf("got %v, want %v", got, 0)
+		}
+	})
+
+	t.Run("test files are reloaded when changed", func(t *testing.T) {
+		copyFile(t, "../testdata/localhost.pem", cert)
+		copyFile(t, "../testdata/localhost-key.pem", key)
+		touchFiles(t, cert, key)
+
+		r.reload()
+
+		if got := testutil.ToFloat64(tlsReloadTotal.With(labels)); got != 1 {
+			t.Fatalf("got %v, want %v", got, 1)
+		}
+
+		if !bytes.Equal(servedCertificate(t, r), readCertificate(t, "../testdata/localhost.pem").Raw) {
+			t.Fatalf("new certificate must be served")
+		}
+	})
+
+	t.Run("test current files are kept when reload failed", func(t *testing.T) {
+		copyFile(t, "../testdata/cert.pem", cert)
+		touchFiles(t, cert)
+
+		r.reload()
+
+		if got := testutil.ToFloat64(tlsReloadErr.With(labels)); got != 1 {
+			t.Fatalf("got %v, want %v", got, 1)
+		}
+
+		if !bytes.Equal(servedCertificate(t, r), readCertificate(t, "../testdata/localhost.pem").Raw) {
+			t.Fatalf("current certificate must be kept")
+		}
+	})
+}
+
+func servedCertificate(t *testing.T, r *tlsReloader) []byte {
+	c, err := r.listenerConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.Certificates[0].Certificate[0]
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(dst, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// touchFiles change modification time, so change is detected even when the
+// files are written in the same time
+func touchFiles(t *testing.T, files ...string) {
+	mtime := time.Now().Add(time.Minute)
+
+	for _, f := range files {
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
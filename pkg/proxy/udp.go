@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"context"
+	goerrors "errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultUDPIdleTimeout is used when listener idle timeout is not configured
+	defaultUDPIdleTimeout = 30 * time.Second
+	// maxDatagramSize is maximum size of udp datagram
+	maxDatagramSize = 64 * 1024
+	// udpPendingSize is number of datagrams queued while target of a new
+	// session is dialed
+	udpPendingSize = 64
+)
+
+// udpSession hold datagrams flow between a client and the selected target,
+// sessions are keyed by the client source address
+type udpSession struct {
+	client     net.Addr
+	target     net.Conn
+	tConf      *Target
+	group      *targetGroup
+	mirrors    []*mirrorWriter
+	lastActive int64
+	// ready is false while the target is dialed, datagrams received in the
+	// meantime are queued in pending. Both are guarded by udpSessions lock
+	ready   bool
+	pending [][]byte
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+// idleUntil returns time when the session is considered idle
+func (s *udpSession) idleUntil(idle time.Duration) time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive)).Add(idle)
+}
+
+// forward send datagram to the target and mirrors
+func (s *udpSession) forward(b []byte) error {
+	s.touch()
+
+	for _, m := range s.mirrors {
+		m.Write(b)
+	}
+
+	_, err := s.target.Write(b)
+	return err
+}
+
+// runUDP forward datagrams received by the udp listener
+func (p *Proxy) runUDP(ctx context.Context, c config.ServerConfig, pc net.PacketConn) {
+	log.Info().
+		Str("name", c.Name).
+		Str("host", c.Listener.Host).
+		Str("port", c.Listener.Port).
+		Str("protocol", config.ProtocolUDP).
+		Msg("running in UDP mode")
+
+	p.handlePacket(ctx, c, pc)
+}
+
+// udpSessions hold sessions of the udp listener keyed by the client address
+type udpSessions struct {
+	sync.Mutex
+	m      map[string]*udpSession
+	closed bool
+}
+
+// handlePacket read datagrams from clients and forward it to the target
+// of client session. Target of a new session is dialed in the background, so
+// a slow target doesn't block datagrams of other clients
+func (p *Proxy) handlePacket(ctx context.Context, c config.ServerConfig, pc net.PacketConn) {
+	ss := &udpSessions{m: map[string]*udpSession{}}
+
+	idle := c.Listener.IdleTimeoutDuration
+	if idle == 0 {
+		idle = defaultUDPIdleTimeout
+	}
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				// datagrams can't be sent to clients after the listener is
+				// closed, so the sessions are closed forcefully
+				ss.Lock()
+				ss.closed = true
+				for _, s := range ss.m {
+					if s.ready {
+						atomic.AddInt64(&p.killed, 1)
+						s.target.Close()
+					}
+				}
+				ss.Unlock()
+				return
+			default:
+				log.Error().
+					Err(err).
+					Str("name", c.Name).
+					Msg("connection error")
+				downstreamConnErr.With(prometheus.Labels{"name": p.Name}).Inc()
+				continue
+			}
+		}
+
+		ss.Lock()
+		s, ok := ss.m[addr.String()]
+		if !ok {
+			// reserve the session, datagrams are queued until the target
+			// is dialed
+			s = &udpSession{client: addr}
+			ss.m[addr.String()] = s
+
+			p.Wg.Add(1)
+			go func() {
+				defer p.Wg.Done()
+				p.runUDPSession(c, pc, ss, addr, idle)
+			}()
+		}
+
+		if !s.ready {
+			if len(s.pending) < udpPendingSize {
+				s.pending = append(s.pending, append([]byte{}, buf[:n]...))
+			}
+			ss.Unlock()
+			continue
+		}
+		ss.Unlock()
+
+		p.forwardPacket(s, buf[:n])
+	}
+}
+
+// runUDPSession dial target of the reserved session and forward the queued
+// datagrams, then reply datagrams from the target until the session is idle.
+// The reserved session is removed when the target can't be dialed
+func (p *Proxy) runUDPSession(c config.ServerConfig, pc net.PacketConn, ss *udpSessions, client net.Addr, idle time.Duration) {
+	key := client.String()
+
+	s, err := p.newUDPSession(c, client)
+
+	ss.Lock()
+	if err != nil || ss.closed {
+		delete(ss.m, key)
+		ss.Unlock()
+
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("name", c.Name).
+				Msg("failed to get targets")
+			return
+		}
+
+		p.closeUDPSession(s)
+		return
+	}
+
+	// datagrams are forwarded while holding the lock, so new datagrams are
+	// not sent before the queued ones
+	for _, b := range ss.m[key].pending {
+		p.forwardPacket(s, b)
+	}
+	s.ready = true
+	ss.m[key] = s
+	ss.Unlock()
+
+	p.replyPacket(pc, s, idle)
+
+	ss.Lock()
+	delete(ss.m, key)
+	ss.Unlock()
+
+	p.closeUDPSession(s)
+}
+
+// forwardPacket send datagram to the target of the session
+func (p *Proxy) forwardPacket(s *udpSession, b []byte) {
+	if err := errCopy(s.forward(b), s.tConf.HostConfig); err != nil {
+		log.Debug().
+			Err(err).
+			Str("host", s.tConf.Host).
+			Str("port", s.tConf.Port).
+			Msg("failed to write to target")
+		s.group.outlier.failure(s.tConf)
+	}
+}
+
+// newUDPSession dial target and start mirrors for a new client, mirrors are
+// dialed in the background
+func (p *Proxy) newUDPSession(c config.ServerConfig, client net.Addr) (*udpSession, error) {
+	state := p.state.Load()
+
+	t, tc, err := state.dialUDPTargets()
+	if err != nil {
+		countDialError(c.Name, tc, err)
+		return nil, errors.New(c.Name, err.Error())
+	}
+
+	s := &udpSession{
+		client: client,
+		target: t,
+		tConf:  tc,
+		group:  state.targetGroup,
+	}
+	s.touch()
+
+	for _, mc := range sampleMirrors(state.conf) {
+		s.mirrors = append(s.mirrors, newMirrorWriter(udpMirrorDial(mc), mc, mirrorBufferSize))
+	}
+
+	atomic.AddInt64(&p.active, 1)
+	downstreamConnActive.With(prometheus.Labels{"name": p.Name}).Inc()
+	downstreamConnTotal.With(prometheus.Labels{"name": p.Name}).Inc()
+
+	upstreamConnActive.With(prometheus.Labels{"host": tc.Host, "port": tc.Port}).Inc()
+	upstreamConnTotal.With(prometheus.Labels{"host": tc.Host, "port": tc.Port}).Inc()
+
+	return s, nil
+}
+
+// replyPacket forward datagrams from target to the client until the session
+// is idle longer than idle timeout
+func (p *Proxy) replyPacket(pc net.PacketConn, s *udpSession, idle time.Duration) {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		s.target.SetReadDeadline(s.idleUntil(idle))
+
+		n, err := s.target.Read(buf)
+		if err != nil {
+			if goerrors.Is(err, os.ErrDeadlineExceeded) {
+				// client is still sending datagrams
+				if time.Now().Before(s.idleUntil(idle)) {
+					continue
+				}
+				return
+			}
+
+			if err := errCopy(err, s.tConf.HostConfig); err != nil {
+				log.Debug().
+					Err(err).
+					Str("host", s.tConf.Host).
+					Str("port", s.tConf.Port).
+					Msg("failed to read from target")
+				s.group.outlier.failure(s.tConf)
+			}
+			return
+		}
+
+		s.touch()
+		s.group.outlier.success(s.tConf)
+
+		if _, err := pc.WriteTo(buf[:n], s.client); err != nil {
+			log.Debug().
+				Err(err).
+				Str("client", s.client.String()).
+				Msg("failed to write to client")
+		}
+	}
+}
+
+// closeUDPSession close target and mirrors connection of the session
+func (p *Proxy) closeUDPSession(s *udpSession) {
+	s.target.Close()
+
+	for _, m := range s.mirrors {
+		m.Close()
+	}
+
+	s.tConf.release()
+	upstreamConnActive.With(prometheus.Labels{"host": s.tConf.Host, "port": s.tConf.Port}).Dec()
+	downstreamConnActive.With(prometheus.Labels{"name": p.Name}).Dec()
+	atomic.AddInt64(&p.active, -1)
+}
+
+// dialUDPTargets dial the first target picked by the load balancer that can
+// be reached, the returned target is acquired and must be released by the
+// caller
+func (g *targetGroup) dialUDPTargets() (net.Conn, *Target, error) {
+	targets := g.balancer.Next()
+	if len(targets) == 0 {
+		return nil, nil, errNoAvailableTargets
+	}
+
+	var tConf *Target
+
+	for _, target := range targets {
+		tConf = target
+		target.acquire()
+		c, err := dialUDPTarget(target.HostConfig)
+		if err == nil {
+			return c, tConf, nil
+		}
+		target.release()
+		g.outlier.failure(target)
+		log.Debug().Msgf("[targets] [%s:%s] dial error %v", target.Host, target.Port, err)
+	}
+
+	return nil, tConf, errors.New("targets", "no backends could be reached")
+}
+
+func dialUDPTarget(hc config.HostConfig) (net.Conn, error) {
+	return newDial(hc.ConnectionConfig).Dial("udp", net.JoinHostPort(hc.Host, hc.Port))
+}
+
+// udpMirrorDial returns function to dial the udp mirror
+func udpMirrorDial(mc config.MirrorConfig) mirrorDialer {
+	return func() (net.Conn, error) {
+		return dialUDPTarget(mc.HostConfig)
+	}
+}
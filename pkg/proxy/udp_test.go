@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/testhelper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProxyUDP(t *testing.T) {
+	mirrorResult := make(chan []byte, 10)
+
+	backend := testhelper.RunUDPServer(t, []byte("target-"), nil)
+	mirror := testhelper.RunUDPServer(t, []byte("mirror-"), mirrorResult)
+
+	cfg, err := config.GenerateConfig("127.0.0.1:9000", []string{backend}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerConfigs[0].Protocol = config.ProtocolUDP
+	cfg.ServerConfigs[0].Listener.IdleTimeoutDuration = 500 * time.Millisecond
+	cfg.ServerConfigs[0].Mirror = config.HostConfig{
+		Host: strings.Split(mirror, ":")[0],
+		Port: strings.Split(mirror, ":")[1],
+	}
+
+	p := New("test-udp-proxy")
+	go func() {
+		p.Run(cfg.ServerConfigs[0])
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("udp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Run("test datagram is forwarded to target", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if _, err := conn.Write(messageByte); err != nil {
+				t.Fatal(err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := append([]byte("target-"), messageByte...)
+			if !bytes.Equal(buf[:n], expected) {
+				t.Fatalf("got %s, want %s", buf[:n], expected)
+			}
+		}
+	})
+
+	t.Run("test datagram is mirrored", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			select {
+			case res := <-mirrorResult:
+				if !bytes.Equal(res, messageByte) {
+					t.Fatalf("got %s, want %s", res, messageByte)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("mirror must receive the datagram")
+			}
+		}
+	})
+
+	t.Run("test client use the same session", func(t *testing.T) {
+		if n := p.state.Load().balancer.Targets()[0].activeConn(); n != 1 {
+			t.Fatalf("got %v, want %v", n, 1)
+		}
+	})
+
+	t.Run("test session is closed when idle", func(t *testing.T) {
+		time.Sleep(1 * time.Second)
+
+		if n := p.state.Load().balancer.Targets()[0].activeConn(); n != 0 {
+			t.Fatalf("got %v, want %v", n, 0)
+		}
+	})
+
+	t.Run("test session is closed on shutdown", func(t *testing.T) {
+		if _, err := conn.Write(messageByte); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 64)); err != nil {
+			t.Fatal(err)
+		}
+
+		p.Shutdown()
+
+		if got := testutil.ToFloat64(downstreamConnKilled.With(prometheus.Labels{"name": p.Name})); got != 1 {
+			t.Fatalf("got %v, want %v", got, 1)
+		}
+	})
+}
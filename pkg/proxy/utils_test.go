@@ -3,6 +3,7 @@ package proxy
 import (
 	"crypto/tls"
 	"log"
+	"net"
 	"sync"
 
 	"github.com/nothinux/octo-proxy/pkg/config"
@@ -66,3 +67,9 @@ func RunTestTLSServer(wg *sync.WaitGroup, c config.TLSConfig, result chan []byte
 
 	return l.Addr().String()
 }
+
+// tlsHandshake complete tls handshake of the accepted connection and close it
+func tlsHandshake(c net.Conn) {
+	defer c.Close()
+	isTLSConn(c)
+}
@@ -2,15 +2,20 @@ package runner
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"reflect"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/nothinux/octo-proxy/pkg/config"
 	"github.com/nothinux/octo-proxy/pkg/metrics"
 	"github.com/nothinux/octo-proxy/pkg/proxy"
+	"github.com/nothinux/octo-proxy/pkg/upgrade"
 	"github.com/okzk/sdnotify"
 	"github.com/rs/zerolog/log"
 )
@@ -19,17 +24,46 @@ import (
 type Octo struct {
 	sync.Mutex
 	Proxies map[string]*proxy.Proxy
+	// draining hold old proxies that are still draining their connections
+	// after reload
+	draining sync.WaitGroup
 }
 
 type Server config.Config
 
+// upgradeTimeout is maximum time to wait for the new process to be ready on
+// upgrade
+const upgradeTimeout = time.Minute
+
+var (
+	reloadSuccess = metrics.AddGauge(
+		"octo_config_last_reload_successful",
+		"Whether the last configuration reload attempt was successful",
+	)
+	reloadSuccessTime = metrics.AddGauge(
+		"octo_config_last_reload_success_timestamp_seconds",
+		"Timestamp of the last successful configuration reload",
+	)
+)
+
 func Run(c *config.Config, cPath string) error {
+	// listeners passed by the previous process are used when octo-proxy is
+	// started by an upgrade
+	if err := upgrade.Init(); err != nil {
+		return err
+	}
+
 	ss := &Server{
 		ServerConfigs: c.ServerConfigs,
 		MetricsConfig: c.MetricsConfig,
 	}
 
-	proxies := ss.runProxy()
+	proxies, err := ss.runProxy()
+	if err != nil {
+		return err
+	}
+
+	setReloadStatus(nil)
 
 	octo := &Octo{
 		Proxies: proxies,
@@ -45,11 +79,18 @@ func Run(c *config.Config, cPath string) error {
 		}
 	}
 
+	upgrade.CloseUnused()
+	if err := upgrade.Ready(); err != nil {
+		log.Error().Err(err).Msg("failed to notify the previous process")
+	}
+
 	sigTerm := make(chan os.Signal, 1)
 	sigReload := make(chan os.Signal, 1)
+	sigUpgrade := make(chan os.Signal, 1)
 
 	signal.Notify(sigTerm, os.Interrupt, syscall.SIGTERM)
-	signal.Notify(sigReload, syscall.SIGUSR1, syscall.SIGUSR2)
+	signal.Notify(sigReload, syscall.SIGUSR1)
+	signal.Notify(sigUpgrade, syscall.SIGUSR2)
 
 	sdnotify.Ready()
 
@@ -63,91 +104,323 @@ alive:
 			shutdown(octo.Proxies, metricsServer)
 			octo.Unlock()
 
+			octo.draining.Wait()
+
 			break alive
 		case <-sigReload:
 			log.Info().Msg("octo-proxy reload triggered")
 
 			if err := reloadProxy(cPath, octo); err != nil {
-				log.Error().Err(err).Msg("octo-proxy reload failed")
+				log.Error().Err(err).Msg("octo-proxy reload failed, keep running the current configuration")
 				continue
 			}
 
 			log.Info().Msg("octo-proxy reloaded")
+		case <-sigUpgrade:
+			log.Info().Msg("octo-proxy upgrade triggered")
+
+			if err := upgradeProcess(octo, metricsServer); err != nil {
+				log.Error().Err(err).Msg("octo-proxy upgrade failed, keep running the current process")
+				continue
+			}
+
+			log.Info().Msg("new octo-proxy process is ready, draining connections")
+
+			octo.Lock()
+			shutdown(octo.Proxies, metricsServer)
+			octo.Unlock()
+
+			octo.draining.Wait()
+
+			break alive
 		}
 	}
 
 	return nil
 }
 
-func reloadProxy(cPath string, octo *Octo) error {
+// reloadProxy apply the new configuration to running servers, servers are
+// matched by name. Unchanged servers are left untouched, servers that only
+// change their targets are updated in place, and only servers whose listener
+// changed are started again. Listeners of the new servers are bound and
+// targets of the updated servers are prepared before anything is changed. New
+// listeners are published before the running servers are changed, the running
+// servers are kept when one of them failed
+func reloadProxy(cPath string, octo *Octo) (err error) {
+	defer func() {
+		setReloadStatus(err)
+	}()
+
 	c, err := config.New(cPath)
 	if err != nil {
 		return err
 	}
 
-	ss := &Server{
-		ServerConfigs: c.ServerConfigs,
-		MetricsConfig: c.MetricsConfig,
+	octo.Lock()
+	defer octo.Unlock()
+
+	proxies := make(map[string]*proxy.Proxy)
+	started := []*proxy.Proxy{}
+	updates := []func(){}
+	discards := []func(){}
+	stale := []*proxy.Proxy{}
+
+	rollback := func() {
+		for _, p := range started {
+			p.Shutdown()
+		}
+		for _, discard := range discards {
+			discard()
+		}
 	}
 
-	proxies := ss.runProxy()
+	for _, sc := range c.ServerConfigs {
+		p, ok := octo.Proxies[sc.Name]
+
+		switch {
+		case ok && reflect.DeepEqual(p.Config(), sc):
+			proxies[sc.Name] = p
+		case ok && !listenerChanged(p.Config(), sc):
+			update, discard, err := p.PrepareUpdate(sc)
+			if err != nil {
+				rollback()
+				return err
+			}
 
-	octo.Lock()
-	// shutdown old listener in
-	oldOcto := octo.Proxies
-	shutdown(oldOcto, nil)
+			updates = append(updates, update)
+			discards = append(discards, discard)
+			proxies[sc.Name] = p
+		default:
+			np, err := listenProxy(sc)
+			if err != nil {
+				rollback()
+				return err
+			}
 
-	// set new listener
-	octo.Proxies = proxies
+			if ok {
+				log.Info().Str("name", sc.Name).Msg("listener changed, restarting server")
+				stale = append(stale, p)
+			} else {
+				log.Info().Str("name", sc.Name).Msg("starting new server")
+			}
+
+			started = append(started, np)
+			proxies[sc.Name] = np
+		}
+	}
+
+	for name, p := range octo.Proxies {
+		if _, ok := proxies[name]; !ok {
+			log.Info().Str("name", name).Msg("stopping removed server")
+			stale = append(stale, p)
+		}
+	}
+
+	// socket files replaced by the new listeners are restored when the
+	// started proxies are shut down by rollback
+	for _, p := range started {
+		if err := p.Publish(); err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	for _, update := range updates {
+		update()
+	}
+
+	for _, p := range started {
+		serveProxy(p)
+	}
 
-	// done
-	octo.Unlock()
+	// new listeners are started before the old one is closed, so the port
+	// is not unbound when only listener configuration is changed. Old
+	// proxies drain their connections in the background, so reload doesn't
+	// wait for them
+	for _, p := range stale {
+		octo.draining.Add(1)
+		go func(p *proxy.Proxy) {
+			defer octo.draining.Done()
+			p.Shutdown()
+		}(p)
+	}
+
+	octo.Proxies = proxies
 
 	return nil
 }
 
-// runProxy
-func (s *Server) runProxy() map[string]*proxy.Proxy {
+// setReloadStatus record result of the last configuration reload
+func setReloadStatus(err error) {
+	if err != nil {
+		reloadSuccess.Set(0)
+		return
+	}
+
+	reloadSuccess.Set(1)
+	reloadSuccessTime.SetToCurrentTime()
+}
+
+// listenerChanged returns true when the listener of the server must be
+// bound again to apply the new configuration
+func listenerChanged(old, new config.ServerConfig) bool {
+	return old.Protocol != new.Protocol || !reflect.DeepEqual(old.Listener, new.Listener)
+}
+
+// runProxy bind and publish listeners of all servers before serving any of
+// them, so octo-proxy doesn't start partially
+func (s *Server) runProxy() (map[string]*proxy.Proxy, error) {
 	proxies := make(map[string]*proxy.Proxy)
 
-	for _, serverConfig := range s.ServerConfigs {
-		sc := serverConfig
+	rollback := func() {
+		for _, p := range proxies {
+			p.Shutdown()
+		}
+	}
+
+	for _, sc := range s.ServerConfigs {
+		p, err := listenProxy(sc)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+
+		proxies[sc.Name] = p
+	}
+
+	for _, p := range proxies {
+		if err := p.Publish(); err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+
+	for _, p := range proxies {
+		serveProxy(p)
+	}
+
+	return proxies, nil
+}
 
-		//
-		proxy := proxy.New(sc.Name)
-		proxies[sc.Name] = proxy
+// listenProxy bind listener and load tls configuration of the server
+func listenProxy(sc config.ServerConfig) (*proxy.Proxy, error) {
+	p := proxy.New(sc.Name)
 
-		// run proxy
-		proxy.Wg.Add(1)
-		go func() {
-			proxy.Run(sc)
-			proxy.Wg.Done()
-		}()
+	if err := p.Listen(sc); err != nil {
+		return nil, err
 	}
 
-	return proxies
+	return p, nil
+}
+
+// serveProxy serve connections of the proxy in the background
+func serveProxy(p *proxy.Proxy) {
+	p.Wg.Add(1)
+	go func() {
+		defer p.Wg.Done()
+
+		if err := p.Serve(); err != nil {
+			log.Error().Err(err).Str("name", p.Name).Msg("failed to serve")
+		}
+	}()
 }
 
 func runMetrics(c config.HostConfig) (*metrics.Metrics, error) {
 	m := metrics.New(c)
 
+	l, err := m.Listen()
+	if err != nil {
+		return nil, err
+	}
+
 	go func() {
 		log.Info().
 			Str("host", c.Host).
 			Str("port", c.Port).
 			Msg("starting metrics server")
-		m.Run()
+
+		if err := m.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("metrics server stopped")
+		}
 	}()
 
 	return m, nil
 }
 
+// upgradeProcess start the new octo-proxy process with listeners of the
+// running servers, the current process must be stopped when it returns nil.
+// The running servers keep serving when the new process can't be started
+func upgradeProcess(octo *Octo, m *metrics.Metrics) error {
+	octo.Lock()
+	defer octo.Unlock()
+
+	files := []*upgrade.File{}
+	defer func() {
+		for _, f := range files {
+			f.File.Close()
+		}
+	}()
+
+	for _, p := range octo.Proxies {
+		f, err := p.ListenerFile()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, f)
+	}
+
+	if m != nil {
+		f, err := m.ListenerFile()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, f)
+	}
+
+	sdnotify.Reloading()
+
+	pid, err := upgrade.Upgrade(files, upgradeTimeout)
+	if err != nil {
+		sdnotify.Ready()
+		return err
+	}
+
+	// systemd must follow the new process, the current process exits after
+	// its connections are drained. Ready is sent by the current process
+	// together with the new main pid, so the notification is accepted when
+	// only the main process is allowed to notify
+	err = sdnotify.SdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", pid))
+	if err != nil && !errors.Is(err, sdnotify.ErrSdNotifyNoSocket) {
+		log.Warn().Err(err).Msg("failed to notify systemd")
+	}
+
+	// socket files are used by the new process, so they are kept when the
+	// proxies are shut down
+	for _, p := range octo.Proxies {
+		p.Handoff()
+	}
+
+	log.Info().Int("pid", pid).Msg("new octo-proxy process started")
+
+	return nil
+}
+
 func shutdown(proxies map[string]*proxy.Proxy, m *metrics.Metrics) {
 	log.Info().Msg("shutdown octo-proxy")
 
+	// proxies are drained at the same time, so shutdown takes at most the
+	// longest drain timeout
+	var wg sync.WaitGroup
 	for _, p := range proxies {
-		p.Shutdown()
+		wg.Add(1)
+		go func(p *proxy.Proxy) {
+			defer wg.Done()
+			p.Shutdown()
+		}(p)
 	}
+	wg.Wait()
 
 	if m != nil {
 		if err := m.Shutdown(context.Background()); err != nil {
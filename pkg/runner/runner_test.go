@@ -2,15 +2,20 @@ package runner
 
 import (
 	"bytes"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/nothinux/octo-proxy/pkg/config"
+	"github.com/nothinux/octo-proxy/pkg/proxy"
 	"github.com/nothinux/octo-proxy/pkg/testhelper"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestRunningRunner(t *testing.T) {
@@ -29,7 +34,10 @@ func TestRunningRunner(t *testing.T) {
 
 	// starting octo proxy
 	ss := &Server{ServerConfigs: c.ServerConfigs}
-	proxies := ss.runProxy()
+	proxies, err := ss.runProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// store created proxy data
 	octo := &Octo{
@@ -130,3 +138,294 @@ func SendData(address string, message []byte) error {
 
 	return nil
 }
+
+func writeConfig(t *testing.T, path string, servers map[string][2]string) {
+	var b strings.Builder
+
+	b.WriteString("servers:\n")
+	for name, s := range servers {
+		fmt.Fprintf(&b, "- name: %s\n  listener:\n    host: 127.0.0.1\n    port: %s\n  targets:\n    - host: 127.0.0.1\n      port: %s\n", name, s[0], s[1])
+	}
+
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadProxy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	writeConfig(t, path, map[string][2]string{
+		"unchanged":        {"9991", "80"},
+		"target-changed":   {"9992", "80"},
+		"listener-changed": {"9993", "80"},
+		"removed":          {"9994", "80"},
+	})
+
+	c, err := config.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss := &Server{ServerConfigs: c.ServerConfigs}
+	proxies, err := ss.runProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	octo := &Octo{
+		Proxies: proxies,
+	}
+
+	time.Sleep(1 * time.Second)
+
+	old := map[string]*proxy.Proxy{}
+	for name, p := range octo.Proxies {
+		old[name] = p
+	}
+
+	writeConfig(t, path, map[string][2]string{
+		"unchanged":        {"9991", "80"},
+		"target-changed":   {"9992", "81"},
+		"listener-changed": {"9995", "80"},
+		"added":            {"9996", "80"},
+	})
+
+	if err := reloadProxy(path, octo); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1 * time.Second)
+
+	t.Run("test unchanged server is not restarted", func(t *testing.T) {
+		if octo.Proxies["unchanged"] != old["unchanged"] {
+			t.Fatalf("unchanged server must not be restarted")
+		}
+	})
+
+	t.Run("test server targets are updated in place", func(t *testing.T) {
+		p := octo.Proxies["target-changed"]
+		if p != old["target-changed"] {
+			t.Fatalf("server must not be restarted")
+		}
+
+		if got := p.Config().Targets[0].Port; got != "81" {
+			t.Fatalf("got %v, want %v", got, "81")
+		}
+	})
+
+	t.Run("test server with changed listener is restarted", func(t *testing.T) {
+		if octo.Proxies["listener-changed"] == old["listener-changed"] {
+			t.Fatalf("server must be restarted")
+		}
+
+		if _, err := net.DialTimeout("tcp", "127.0.0.1:9993", time.Second); err == nil {
+			t.Fatalf("old listener must be closed")
+		}
+
+		if err := SendData("127.0.0.1:9995", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test removed server is stopped", func(t *testing.T) {
+		if _, ok := octo.Proxies["removed"]; ok {
+			t.Fatalf("removed server must be stopped")
+		}
+
+		if _, err := net.DialTimeout("tcp", "127.0.0.1:9994", time.Second); err == nil {
+			t.Fatalf("removed server listener must be closed")
+		}
+	})
+
+	t.Run("test reload status is recorded", func(t *testing.T) {
+		if got := testutil.ToFloat64(reloadSuccess); got != 1 {
+			t.Fatalf("got %v, want %v", got, 1)
+		}
+	})
+
+	t.Run("test added server is started", func(t *testing.T) {
+		if _, ok := octo.Proxies["added"]; !ok {
+			t.Fatalf("added server must be started")
+		}
+
+		if err := SendData("127.0.0.1:9996", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	shutdown(octo.Proxies, nil)
+	octo.draining.Wait()
+}
+
+func TestReloadProxyRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	writeConfig(t, path, map[string][2]string{
+		"server-a": {"9991", "80"},
+		"server-b": {"9992", "80"},
+	})
+
+	c, err := config.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss := &Server{ServerConfigs: c.ServerConfigs}
+	proxies, err := ss.runProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	octo := &Octo{
+		Proxies: proxies,
+	}
+
+	time.Sleep(1 * time.Second)
+
+	old := map[string]*proxy.Proxy{}
+	for name, p := range octo.Proxies {
+		old[name] = p
+	}
+
+	// port is bound without SO_REUSEPORT, so the new listener can't be bound
+	l, err := net.Listen("tcp", "127.0.0.1:9995")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	writeConfig(t, path, map[string][2]string{
+		"server-a": {"9991", "81"},
+		"server-b": {"9995", "80"},
+		"added":    {"9996", "80"},
+	})
+
+	err = reloadProxy(path, octo)
+	if err == nil {
+		t.Fatalf("reloadProxy must return error")
+	}
+
+	if !strings.Contains(err.Error(), "failed to listen") {
+		t.Fatalf("got %v, want failed to listen error", err)
+	}
+
+	t.Run("test running servers are kept", func(t *testing.T) {
+		if len(octo.Proxies) != len(old) {
+			t.Fatalf("got %v servers, want %v", len(octo.Proxies), len(old))
+		}
+
+		for name, p := range old {
+			if octo.Proxies[name] != p {
+				t.Fatalf("server %s must not be replaced", name)
+			}
+		}
+
+		if got := octo.Proxies["server-a"].Config().Targets[0].Port; got != "80" {
+			t.Fatalf("got %v, want %v", got, "80")
+		}
+
+		if err := SendData("127.0.0.1:9992", []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("test listener of new server is closed", func(t *testing.T) {
+		if _, err := net.DialTimeout("tcp", "127.0.0.1:9996", time.Second); err == nil {
+			t.Fatalf("new server listener must be closed")
+		}
+	})
+
+	t.Run("test reload status is recorded", func(t *testing.T) {
+		if got := testutil.ToFloat64(reloadSuccess); got != 0 {
+			t.Fatalf("got %v, want %v", got, 0)
+		}
+	})
+
+	shutdown(octo.Proxies, nil)
+	octo.draining.Wait()
+}
+
+func TestReloadProxyInvalidTargetTLS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	writeConfig(t, path, map[string][2]string{
+		"server-a": {"9991", "80"},
+	})
+
+	c, err := config.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss := &Server{ServerConfigs: c.ServerConfigs}
+	proxies, err := ss.runProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	octo := &Octo{
+		Proxies: proxies,
+	}
+
+	time.Sleep(1 * time.Second)
+
+	old := octo.Proxies["server-a"]
+
+	// caCert of the target is not a valid certificate
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caCert, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := fmt.Sprintf(`servers:
+- name: server-a
+  listener:
+    host: 127.0.0.1
+    port: 9991
+  targets:
+    - host: 127.0.0.1
+      port: 81
+      tls:
+        mode: simple
+        caCert: %s
+- name: added
+  listener:
+    host: 127.0.0.1
+    port: 9996
+  targets:
+    - host: 127.0.0.1
+      port: 80
+`, caCert)
+	if err := os.WriteFile(path, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = reloadProxy(path, octo)
+	if err == nil {
+		t.Fatalf("reloadProxy must return error")
+	}
+
+	if !strings.Contains(err.Error(), "failed to get target TLS config") {
+		t.Fatalf("got %v, want failed to get target TLS config error", err)
+	}
+
+	t.Run("test running server is kept", func(t *testing.T) {
+		if octo.Proxies["server-a"] != old {
+			t.Fatalf("server must not be replaced")
+		}
+
+		if got := old.Config().Targets[0].Port; got != "80" {
+			t.Fatalf("got %v, want %v", got, "80")
+		}
+	})
+
+	t.Run("test listener of new server is closed", func(t *testing.T) {
+		if _, err := net.DialTimeout("tcp", "127.0.0.1:9996", time.Second); err == nil {
+			t.Fatalf("new server listener must be closed")
+		}
+	})
+
+	shutdown(octo.Proxies, nil)
+	octo.draining.Wait()
+}
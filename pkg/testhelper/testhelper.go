@@ -1,6 +1,7 @@
 package testhelper
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"testing"
 	"time"
 )
 
@@ -103,3 +105,115 @@ func RunTestServerSlowMode(wg *sync.WaitGroup, connCount int) string {
 
 	return l.Addr().String()
 }
+
+// RunTestServerWithReply run tcp server that reply every received message
+// with the given reply
+func RunTestServerWithReply(wg *sync.WaitGroup, reply []byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		buf := make([]byte, 512)
+		if _, err := c.Read(buf); err != nil {
+			log.Println(err)
+			return
+		}
+
+		if _, err := c.Write(reply); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// RunServer run tcp server on random port that handle every accepted
+// connection with handle, the server is closed when the test is finished
+func RunServer(t testing.TB, handle func(net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Serve(t, l, handle)
+}
+
+// RunTLSServer run tls server on random port that handle every accepted
+// connection with handle, the server is closed when the test is finished
+func RunTLSServer(t testing.TB, conf *tls.Config, handle func(net.Conn)) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Serve(t, l, handle)
+}
+
+// RunEchoServer run tcp server that write back everything it reads until the
+// connection is closed
+func RunEchoServer(t testing.TB) string {
+	return RunServer(t, func(c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+}
+
+// Serve accept connections on the listener and handle every connection with
+// handle in its own goroutine, the listener is closed when the test is
+// finished
+func Serve(t testing.TB, l net.Listener, handle func(net.Conn)) string {
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go handle(c)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// RunUDPServer run udp server on random port that reply every datagram with
+// prefix, every received datagram is sent to result when it's not nil
+func RunUDPServer(t testing.TB, prefix []byte, result chan []byte) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			data := append([]byte{}, buf[:n]...)
+			if result != nil {
+				result <- data
+			}
+
+			pc.WriteTo(append(append([]byte{}, prefix...), data...), addr)
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
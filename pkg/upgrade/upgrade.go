@@ -0,0 +1,253 @@
+// Package upgrade pass listeners of the running octo-proxy process to the new
+// process, so the binary can be upgraded without closing the listeners
+package upgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// listenersEnv hold network and address of the listener files passed
+	// to the new process, in the same order as the files
+	listenersEnv = "OCTO_UPGRADE_LISTENERS"
+
+	// readyFd is file descriptor of the pipe used by the new process to
+	// notify that it's ready, the listener files start after it
+	readyFd = 3
+)
+
+// Filer is implemented by listeners that can return a copy of their file
+type Filer interface {
+	File() (*os.File, error)
+}
+
+// File is listener file passed to the new process
+type File struct {
+	Network string
+	Address string
+	File    *os.File
+}
+
+// NewFile returns copy of the listener file
+func NewFile(network, address string, l Filer) (*File, error) {
+	f, err := l.File()
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		Network: network,
+		Address: address,
+		File:    f,
+	}, nil
+}
+
+func (f *File) key() string {
+	return key(f.Network, f.Address)
+}
+
+func key(network, address string) string {
+	return network + "://" + address
+}
+
+var inherited = struct {
+	sync.Mutex
+	files map[string]*os.File
+	ready *os.File
+}{files: make(map[string]*os.File)}
+
+// Init load listener files passed by the parent process, it does nothing
+// when the process is not started by an upgrade
+func Init() error {
+	v, ok := os.LookupEnv(listenersEnv)
+	if !ok {
+		return nil
+	}
+
+	os.Unsetenv(listenersEnv)
+
+	keys := []string{}
+	if err := json.Unmarshal([]byte(v), &keys); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", listenersEnv, err)
+	}
+
+	inherited.Lock()
+	defer inherited.Unlock()
+
+	// the files must not be inherited by the next process, listeners are
+	// passed explicitly on the next upgrade
+	syscall.CloseOnExec(readyFd)
+	inherited.ready = os.NewFile(readyFd, "ready")
+
+	for i, k := range keys {
+		syscall.CloseOnExec(readyFd + 1 + i)
+
+		f := os.NewFile(uintptr(readyFd+1+i), k)
+		if f == nil {
+			return fmt.Errorf("listener %s is not passed", k)
+		}
+
+		inherited.files[k] = f
+	}
+
+	return nil
+}
+
+// TakeFile returns the listener file passed by the parent process and
+// removes it from the inherited files, the caller must close the file. nil
+// is returned when the file is not inherited
+func TakeFile(network, address string) *os.File {
+	inherited.Lock()
+	defer inherited.Unlock()
+
+	f, ok := inherited.files[key(network, address)]
+	if !ok {
+		return nil
+	}
+
+	delete(inherited.files, key(network, address))
+
+	return f
+}
+
+// Listener returns the listener passed by the parent process, nil is
+// returned when the listener is not inherited
+func Listener(network, address string) (net.Listener, error) {
+	f := TakeFile(network, address)
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	return net.FileListener(f)
+}
+
+// PacketConn returns the packet listener passed by the parent process, nil
+// is returned when the listener is not inherited
+func PacketConn(network, address string) (net.PacketConn, error) {
+	f := TakeFile(network, address)
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	return net.FilePacketConn(f)
+}
+
+// CloseUnused close inherited listeners that are not used by the new
+// configuration
+func CloseUnused() {
+	inherited.Lock()
+	defer inherited.Unlock()
+
+	for k, f := range inherited.files {
+		f.Close()
+		delete(inherited.files, k)
+	}
+}
+
+// Ready notify the parent process that the listeners are served, so the
+// parent can stop. It does nothing when the process is not started by an
+// upgrade
+func Ready() error {
+	inherited.Lock()
+	defer inherited.Unlock()
+
+	if inherited.ready == nil {
+		return nil
+	}
+
+	defer func() {
+		inherited.ready.Close()
+		inherited.ready = nil
+	}()
+
+	_, err := inherited.ready.Write([]byte{1})
+
+	return err
+}
+
+// Upgrade start the current executable with the same arguments and pass the
+// listener files to it, it returns pid of the new process after the new
+// process is ready. The new process is killed when it's not ready before
+// the timeout
+func Upgrade(files []*File, timeout time.Duration) (int, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	return start(path, os.Args[1:], files, timeout)
+}
+
+func start(path string, args []string, files []*File, timeout time.Duration) (int, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	keys := []string{}
+	extra := []*os.File{w}
+
+	for _, f := range files {
+		keys = append(keys, f.key())
+		extra = append(extra, f.File)
+	}
+
+	v, err := json.Marshal(keys)
+	if err != nil {
+		w.Close()
+		return 0, err
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), listenersEnv+"="+string(v))
+	cmd.ExtraFiles = extra
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// the process is waited in the background so it's not left as zombie
+	// when it exits before it's ready
+	go cmd.Wait()
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			return cmd.Process.Pid, nil
+		}
+
+		if errors.Is(err, io.EOF) {
+			err = errors.New("new process exited before it's ready")
+		}
+
+		cmd.Process.Kill()
+		return 0, err
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process is not ready after %v", timeout)
+	}
+}
@@ -0,0 +1,160 @@
+package upgrade
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess is run as the new process by the upgrade tests
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv("OCTO_UPGRADE_TEST_HELPER")
+	if mode == "" {
+		return
+	}
+
+	if err := Init(); err != nil {
+		os.Exit(1)
+	}
+
+	if mode == "exit" {
+		os.Exit(1)
+	}
+
+	l, err := Listener("tcp", os.Getenv("OCTO_UPGRADE_TEST_ADDR"))
+	if err != nil || l == nil {
+		os.Exit(1)
+	}
+	defer l.Close()
+
+	if err := Ready(); err != nil {
+		os.Exit(1)
+	}
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+
+	c, err := l.Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	c.Write([]byte("new process"))
+	c.Close()
+
+	os.Exit(0)
+}
+
+func listenerFile(t *testing.T) (net.Listener, *File) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	f, err := NewFile("tcp", l.Addr().String(), l.(Filer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.File.Close() })
+
+	return l, f
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Run("test listener is served by the new process", func(t *testing.T) {
+		l, f := listenerFile(t)
+
+		t.Setenv("OCTO_UPGRADE_TEST_HELPER", "serve")
+		t.Setenv("OCTO_UPGRADE_TEST_ADDR", f.Address)
+
+		pid, err := start(os.Args[0], []string{"-test.run=TestHelperProcess"}, []*File{f}, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pid == 0 {
+			t.Fatalf("pid of the new process must be returned")
+		}
+
+		// the current process stop accepting connections, so the
+		// connection is accepted by the new process
+		l.Close()
+
+		c, err := net.Dial("tcp", f.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		b, err := io.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != "new process" {
+			t.Fatalf("got %v, want %v", string(b), "new process")
+		}
+	})
+
+	t.Run("test new process exited before it's ready", func(t *testing.T) {
+		_, f := listenerFile(t)
+
+		t.Setenv("OCTO_UPGRADE_TEST_HELPER", "exit")
+
+		if _, err := start(os.Args[0], []string{"-test.run=TestHelperProcess"}, []*File{f}, 10*time.Second); err == nil {
+			t.Fatalf("start must return error")
+		}
+	})
+}
+
+func TestListener(t *testing.T) {
+	l, f := listenerFile(t)
+
+	inherited.Lock()
+	inherited.files[f.key()] = f.File
+	inherited.Unlock()
+
+	t.Run("test listener is not inherited", func(t *testing.T) {
+		nl, err := Listener("tcp", "127.0.0.1:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if nl != nil {
+			t.Fatalf("listener must not be inherited")
+		}
+	})
+
+	t.Run("test inherited listener use the same socket", func(t *testing.T) {
+		nl, err := Listener("tcp", f.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nl.Close()
+
+		if nl.Addr().String() != l.Addr().String() {
+			t.Fatalf("got %v, want %v", nl.Addr(), l.Addr())
+		}
+
+		// listener can only be taken once
+		nl, err = Listener("tcp", f.Address)
+		if err != nil || nl != nil {
+			t.Fatalf("listener must not be inherited twice")
+		}
+	})
+
+	t.Run("test unused listeners are closed", func(t *testing.T) {
+		_, f := listenerFile(t)
+
+		inherited.Lock()
+		inherited.files[f.key()] = f.File
+		inherited.Unlock()
+
+		CloseUnused()
+
+		if nl, _ := Listener("tcp", f.Address); nl != nil {
+			t.Fatalf("unused listener must be closed")
+		}
+	})
+}